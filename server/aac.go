@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+)
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000,
+	24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// aacConfig contains the parameters of an AudioSpecificConfig
+// (ISO 14496-3) that are needed to remux AAC streams.
+type aacConfig struct {
+	objectType   int
+	rateIndex    int
+	sampleRate   int
+	channelCount int
+}
+
+func aacParseConfig(buf []byte) (*aacConfig, error) {
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("invalid AAC configuration")
+	}
+
+	conf := &aacConfig{
+		objectType:   int(buf[0] >> 3),
+		rateIndex:    int((buf[0]&0x07)<<1 | buf[1]>>7),
+		channelCount: int((buf[1] >> 3) & 0x0F),
+	}
+
+	if conf.objectType == 0 || conf.objectType == 31 {
+		return nil, fmt.Errorf("unsupported AAC object type %d", conf.objectType)
+	}
+
+	if conf.rateIndex >= len(aacSampleRates) {
+		return nil, fmt.Errorf("unsupported AAC sample rate index %d", conf.rateIndex)
+	}
+	conf.sampleRate = aacSampleRates[conf.rateIndex]
+
+	return conf, nil
+}
+
+// adtsHeader returns the ADTS header of an access unit, without CRC.
+func (conf *aacConfig) adtsHeader(auLen int) []byte {
+	frameLen := 7 + auLen
+
+	// the profile field can represent only the first 4 object types
+	profile := conf.objectType - 1
+	if profile > 3 {
+		profile = 1
+	}
+
+	return []byte{
+		0xFF,
+		0xF1,
+		byte(profile<<6) | byte(conf.rateIndex<<2) | byte(conf.channelCount>>2),
+		byte((conf.channelCount&0x03)<<6) | byte((frameLen>>11)&0x03),
+		byte(frameLen >> 3),
+		byte((frameLen&0x07)<<5) | 0x1F,
+		0xFC,
+	}
+}
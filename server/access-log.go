@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// accessLog writes a line for each completed reader session, in Common Log
+// Format, with the duration of the session appended. It is used by the
+// program event loop.
+type accessLog struct {
+	f *os.File
+}
+
+func newAccessLog(fpath string) (*accessLog, error) {
+	err := os.MkdirAll(filepath.Dir(fpath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLog{
+		f: f,
+	}, nil
+}
+
+func (l *accessLog) close() {
+	l.f.Close()
+}
+
+func (l *accessLog) write(ip string, path string, start time.Time, duration time.Duration, bytes uint64) {
+	l.f.Write([]byte(formatAccessLogLine(ip, path, start, duration, bytes)))
+}
+
+// formatAccessLogLine returns a line in the format
+// <ip> - - [<start time>] "PLAY /<path> RTSP/1.0" 200 <bytes sent> <duration in seconds>
+func formatAccessLogLine(ip string, path string, start time.Time, duration time.Duration, bytes uint64) string {
+	return fmt.Sprintf("%s - - [%s] \"PLAY /%s RTSP/1.0\" 200 %d %.3f\n",
+		ip, start.Format("02/Jan/2006:15:04:05 -0700"), path, bytes, duration.Seconds())
+}
@@ -0,0 +1,615 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	_API_DEFAULT_DRAIN_GRACE_PERIOD = 10 * time.Second
+)
+
+type apiHealthRes struct {
+	live  bool
+	ready bool
+}
+
+type apiSdpRes struct {
+	found bool   // the path has a publisher
+	sdp   []byte // filled only if the publisher is ready
+}
+
+type apiCaptureRes struct {
+	fpath string
+	err   error
+}
+
+var errCaptureRunning = errors.New("capture already running")
+
+type apiTrackState struct {
+	Id            int        `json:"id"`
+	Bytes         uint64     `json:"bytes"`
+	Packets       uint64     `json:"packets"`
+	LastFrameTime *time.Time `json:"lastFrameTime"` // nil if no packet has been received or sent yet
+}
+
+type apiClientState struct {
+	Id         string            `json:"id"` // session id
+	RemoteAddr string            `json:"remoteAddr"`
+	Path       string            `json:"path"`
+	State      string            `json:"state"`
+	Protocol   string            `json:"protocol"`
+	Labels     map[string]string `json:"labels,omitempty"` // labels of the path
+	Tracks     []apiTrackState   `json:"tracks"`
+}
+
+type apiStateRes struct {
+	Clients []apiClientState `json:"clients"`
+}
+
+type apiExportedPath struct {
+	Path  string    `json:"path"`
+	Ready bool      `json:"ready"`
+	Conf  *ConfPath `json:"conf"`
+}
+
+// _API_REDACTED replaces the credentials of the exported paths.
+const _API_REDACTED = "xxxxx"
+
+// redactConfPath returns a copy of a path configuration without credentials.
+func redactConfPath(pconf *ConfPath) *ConfPath {
+	ret := *pconf
+
+	if ur, err := url.Parse(ret.Source); err == nil {
+		ret.Source = redactUrl(ur)
+	}
+	if ret.SourcePass != "" {
+		ret.SourcePass = _API_REDACTED
+	}
+	if ret.PublishPass != "" {
+		ret.PublishPass = _API_REDACTED
+	}
+	if ret.ReadPass != "" {
+		ret.ReadPass = _API_REDACTED
+	}
+	return &ret
+}
+
+// checkImportedPath rejects the parameters that can't be imported: commands,
+// that would allow to execute anything on the host, and credentials that
+// were redacted during the export and can't be restored.
+func checkImportedPath(pconf *ConfPath) error {
+	if pconf.SourceTranscode != "" {
+		return fmt.Errorf("sourceTranscode can't be imported")
+	}
+
+	if ur, err := url.Parse(pconf.Source); err == nil && ur.User != nil {
+		if pass, ok := ur.User.Password(); ok && pass == _API_REDACTED {
+			return fmt.Errorf("source contains a redacted password")
+		}
+	}
+	if pconf.SourcePass == _API_REDACTED ||
+		pconf.PublishPass == _API_REDACTED ||
+		pconf.ReadPass == _API_REDACTED {
+		return fmt.Errorf("credentials are redacted")
+	}
+	return nil
+}
+
+// restoreRedactedCredentials fills the credentials that were redacted during
+// the export with the ones of the path of the running configuration that
+// matches the imported path, if they are set.
+func restoreRedactedCredentials(pconf *ConfPath, own *ConfPath) {
+	if ur, err := url.Parse(own.Source); err == nil && redactUrl(ur) == pconf.Source {
+		pconf.Source = own.Source
+	}
+	if pconf.SourcePass == _API_REDACTED && own.SourcePass != "" {
+		pconf.SourcePass = own.SourcePass
+	}
+	if pconf.PublishPass == _API_REDACTED && own.PublishPass != "" {
+		pconf.PublishPass = own.PublishPass
+	}
+	if pconf.ReadPass == _API_REDACTED && own.ReadPass != "" {
+		pconf.ReadPass = own.ReadPass
+	}
+}
+
+type apiImportRes struct {
+	imported []string
+	err      error
+}
+
+type api struct {
+	p        *program
+	listener net.Listener
+	server   *http.Server
+}
+
+func newApi(p *program) (*api, error) {
+	listener, err := net.Listen("tcp", p.conf.ApiAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &api{
+		p:        p,
+		listener: listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.onHealthz)
+	mux.HandleFunc("/readyz", a.onReadyz)
+	mux.HandleFunc("/drain/", a.onDrain)
+	mux.HandleFunc("/undrain/", a.onUndrain)
+	mux.HandleFunc("/kick/", a.onKick)
+	mux.HandleFunc("/reload/", a.onReload)
+	mux.HandleFunc("/capture/", a.onCapture)
+	mux.HandleFunc("/state", a.onState)
+	mux.HandleFunc("/paths/export", a.onPathsExport)
+	mux.HandleFunc("/paths/import", a.onPathsImport)
+	mux.HandleFunc("/", a.onSdp)
+
+	a.server = &http.Server{
+		Handler: mux,
+	}
+
+	a.log("opened on %s", p.conf.ApiAddress)
+	return a, nil
+}
+
+func (a *api) log(format string, args ...interface{}) {
+	a.p.log("[api] "+format, args...)
+}
+
+func (a *api) run() {
+	err := a.server.Serve(a.listener)
+	if err != http.ErrServerClosed {
+		a.log("ERR: %s", err)
+	}
+}
+
+func (a *api) close() {
+	a.server.Shutdown(context.Background())
+}
+
+// authorize checks the credentials of requests that change the state of the
+// server or that expose the clients, when apiUser and apiPass are set.
+func (a *api) authorize(w http.ResponseWriter, req *http.Request) bool {
+	if a.p.conf.ApiUser == "" {
+		return true
+	}
+
+	user, pass, ok := req.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(a.p.conf.ApiUser)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(a.p.conf.ApiPass)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"rtsp-simple-server\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// authorizeAdmin authorizes requests that expose or change the
+// configuration, that are refused when the API is not protected.
+func (a *api) authorizeAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if a.p.conf.ApiUser == "" || a.p.conf.ApiPass == "" {
+		a.log("ERR: %s is disabled since apiUser and apiPass are not set", req.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	return a.authorize(w, req)
+}
+
+func (a *api) health() apiHealthRes {
+	res := make(chan apiHealthRes)
+	a.p.events <- programEventApiHealth{res}
+	return <-res
+}
+
+// onHealthz returns 200 as long as the event loop is running.
+func (a *api) onHealthz(w http.ResponseWriter, req *http.Request) {
+	if !a.health().live {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// onReadyz returns 200 when all the RTSP sources are ready.
+func (a *api) onReadyz(w http.ResponseWriter, req *http.Request) {
+	if !a.health().ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// onDrain stops accepting readers and publishers on a path and closes
+// the existing ones after a grace period, that can be set with ?grace=.
+func (a *api) onDrain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorize(w, req) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/drain/")
+	if path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	grace := _API_DEFAULT_DRAIN_GRACE_PERIOD
+	if v := req.URL.Query().Get("grace"); v != "" {
+		var err error
+		grace, err = time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := make(chan error)
+	a.p.events <- programEventDrainPath{res, path, true, grace}
+	if err := <-res; err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// onUndrain makes a drained path usable again.
+func (a *api) onUndrain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorize(w, req) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/undrain/")
+	if path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res := make(chan error)
+	a.p.events <- programEventDrainPath{res, path, false, 0}
+	if err := <-res; err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// onKick closes the client with the given session id or remote address
+// (ip:port), and returns 404 if no client is found.
+func (a *api) onKick(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorize(w, req) {
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/kick/")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res := make(chan bool)
+	a.p.events <- programEventKickClient{res, id}
+	if !<-res {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// onReload reads the configuration file again and applies the new
+// configuration of a single path, without touching the other ones.
+// Sources that are publishing are restarted only if ?force=true is set.
+func (a *api) onReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorize(w, req) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/reload/")
+	if path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if a.p.confPath == "" || a.p.confPath == "stdin" {
+		a.log("ERR: the configuration can't be reloaded, since it was not read from a file or an url")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conf, err := loadConf(a.p.confPath, nil)
+	if err == nil {
+		_, err = checkConf(conf)
+	}
+	if err != nil {
+		a.log("ERR: unable to reload path '%s': %s", path, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pconf, ok := conf.Paths[path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	res := make(chan error)
+	a.p.events <- programEventReloadPath{res, path, pconf, req.URL.Query().Get("force") == "true"}
+	err = <-res
+	if err == errTerminated {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		a.log("ERR: unable to reload path '%s': %s", path, err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// onCapture starts writing the packets received on a path to a pcap file,
+// for the duration set with ?duration= or until the size set with ?maxSize=
+// is reached. The name of the file is returned in the body.
+func (a *api) onCapture(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorize(w, req) {
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/capture/")
+	if path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if a.p.findConfForPath(path) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	duration := _CAPTURE_DEFAULT_DURATION
+	if v := req.URL.Query().Get("duration"); v != "" {
+		var err error
+		duration, err = time.ParseDuration(v)
+		if err != nil || duration <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	maxSize := _CAPTURE_DEFAULT_MAX_SIZE
+	if v := req.URL.Query().Get("maxSize"); v != "" {
+		var err error
+		maxSize, err = strconv.Atoi(v)
+		if err != nil || maxSize <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := make(chan apiCaptureRes)
+	a.p.events <- programEventStartCapture{res, path, duration, maxSize}
+	cres := <-res
+
+	switch {
+	case cres.err == errTerminated:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+
+	case cres.err == errCaptureRunning:
+		w.WriteHeader(http.StatusConflict)
+		return
+
+	case cres.err != nil:
+		a.log("ERR: unable to start the capture of path '%s': %s", path, cres.err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(cres.fpath + "\n"))
+}
+
+// onState returns the publishers and the readers with the statistics of
+// each of their tracks, in JSON format.
+func (a *api) onState(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorize(w, req) {
+		return
+	}
+
+	res := make(chan apiStateRes)
+	a.p.events <- programEventApiState{res}
+	state := <-res
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(state)
+}
+
+// onPathsExport returns the paths that have a source or a publisher, with
+// their configuration, in JSON format. The output can be passed to
+// /paths/import of another instance.
+func (a *api) onPathsExport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorizeAdmin(w, req) {
+		return
+	}
+
+	res := make(chan []apiExportedPath)
+	a.p.events <- programEventExportPaths{res}
+	paths := <-res
+	if paths == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(paths)
+}
+
+// onPathsImport adds the paths exported by another instance that are not in
+// the running configuration, and starts their sources. The names of the
+// imported paths are returned in the body.
+func (a *api) onPathsImport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !a.authorizeAdmin(w, req) {
+		return
+	}
+
+	var exported []apiExportedPath
+	err := json.NewDecoder(req.Body).Decode(&exported)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the paths are checked with the global parameters of the running
+	// configuration, that provide their defaults
+	conf := *a.p.conf
+	conf.pathPatterns = nil
+	conf.Paths = make(map[string]*ConfPath)
+	for _, ep := range exported {
+		if ep.Path == "" || ep.Conf == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if own := a.p.findConfForPath(ep.Path); own != nil {
+			restoreRedactedCredentials(ep.Conf, own)
+		}
+
+		err = checkImportedPath(ep.Conf)
+		if err != nil {
+			a.log("ERR: unable to import path '%s': %s", ep.Path, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conf.Paths[ep.Path] = ep.Conf
+	}
+
+	if len(conf.Paths) > 0 {
+		_, err = checkConf(&conf)
+		if err != nil {
+			a.log("ERR: unable to import paths: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := make(chan apiImportRes)
+	a.p.events <- programEventImportPaths{res, conf.Paths}
+	ires := <-res
+	if ires.err == errTerminated {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if ires.err != nil {
+		a.log("ERR: unable to import paths: %s", ires.err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ires.imported)
+}
+
+// onSdp returns the SDP of the publisher of a path, requested with
+// /<path>.sdp. Readers are authenticated like HLS readers.
+func (a *api) onSdp(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasSuffix(req.URL.Path, ".sdp") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/"), ".sdp")
+	if path == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	pconf := a.p.findConfForPath(path)
+	if pconf == nil || pconf.DisableRead {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !authorizeHttpReader(a.p, w, req, pconf, path) {
+		return
+	}
+
+	res := make(chan apiSdpRes)
+	a.p.events <- programEventApiSdp{res, path}
+	sdpRes := <-res
+
+	if !sdpRes.found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if sdpRes.sdp == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusOK)
+	w.Write(sdpRes.sdp)
+}
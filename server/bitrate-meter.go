@@ -0,0 +1,49 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	_BITRATE_METER_WINDOW = 1 * time.Second
+)
+
+// bitrateMeter measures the bitrate of a stream over a sliding window, that is
+// approximated by weighting the bytes of the previous window with the portion
+// of it that still falls inside the sliding one.
+type bitrateMeter struct {
+	windowStart time.Time
+	curBytes    uint64
+	prevBytes   uint64
+	lastReport  time.Time
+}
+
+func newBitrateMeter(now time.Time) *bitrateMeter {
+	return &bitrateMeter{
+		windowStart: now,
+	}
+}
+
+// add adds n bytes to the meter and returns the current bitrate in kbit/s.
+func (m *bitrateMeter) add(now time.Time, n int) uint64 {
+	elapsed := now.Sub(m.windowStart)
+
+	if elapsed >= 2*_BITRATE_METER_WINDOW {
+		m.prevBytes = 0
+		m.curBytes = 0
+		m.windowStart = now
+		elapsed = 0
+
+	} else if elapsed >= _BITRATE_METER_WINDOW {
+		m.prevBytes = m.curBytes
+		m.curBytes = 0
+		m.windowStart = m.windowStart.Add(_BITRATE_METER_WINDOW)
+		elapsed -= _BITRATE_METER_WINDOW
+	}
+
+	m.curBytes += uint64(n)
+
+	prevWeight := float64(_BITRATE_METER_WINDOW-elapsed) / float64(_BITRATE_METER_WINDOW)
+	bytes := float64(m.prevBytes)*prevWeight + float64(m.curBytes)
+	return uint64(bytes * 8 / 1000 / _BITRATE_METER_WINDOW.Seconds())
+}
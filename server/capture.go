@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	_CAPTURE_QUEUE_SIZE        = 1024
+	_CAPTURE_DROP_LOG_INTERVAL = 5 * time.Second
+	_CAPTURE_DEFAULT_DURATION  = 30 * time.Second
+	_CAPTURE_DEFAULT_MAX_SIZE  = 10 * 1024 * 1024
+
+	// the packets are wrapped into IPv4 and UDP headers, therefore the
+	// maximum payload is the maximum size of an IPv4 packet minus the headers
+	_CAPTURE_MAX_PAYLOAD_SIZE = 65535 - 20 - 8
+
+	// packets of track n are sent from and to port 5000 + 2n (RTP)
+	// and 5000 + 2n + 1 (RTCP)
+	_CAPTURE_BASE_PORT = 5000
+)
+
+type captureFrame struct {
+	time          time.Time
+	trackId       int
+	trackFlowType trackFlowType
+	buf           []byte
+}
+
+// capture writes the RTP and RTCP packets received on a path to a pcap file,
+// for a limited time or size. Packets are wrapped into fake IPv4 and UDP headers,
+// that allow to decode them with Wireshark (Decode As > RTP).
+type capture struct {
+	p              *program
+	path           string
+	fpath          string
+	deadline       time.Time
+	maxSize        int
+	size           int
+	droppedCount   int
+	droppedLastLog time.Time
+
+	queue chan captureFrame
+	done  chan struct{}
+}
+
+func newCapture(p *program, path string, duration time.Duration, maxSize int) (*capture, error) {
+	now := p.clock.Now()
+	fpath := formatFilePath(p.conf.CapturePath, path, now)
+
+	err := os.MkdirAll(filepath.Dir(fpath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Write(pcapFileHeader())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := &capture{
+		p:        p,
+		path:     path,
+		fpath:    fpath,
+		deadline: now.Add(duration),
+		maxSize:  maxSize,
+		queue:    make(chan captureFrame, _CAPTURE_QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+
+	c.log("capturing to %s for %s or %d bytes", fpath, duration, maxSize)
+
+	go c.run(f)
+	return c, nil
+}
+
+func (c *capture) log(format string, args ...interface{}) {
+	c.p.log("[capture "+c.path+"] "+format, args...)
+}
+
+// write enqueues a packet. It is called by the program event loop, therefore
+// it never blocks. It returns false when the capture window has ended.
+func (c *capture) write(now time.Time, trackId int, trackFlowType trackFlowType, buf []byte) bool {
+	if !now.Before(c.deadline) || c.size >= c.maxSize {
+		return false
+	}
+
+	if len(buf) > _CAPTURE_MAX_PAYLOAD_SIZE {
+		return true
+	}
+
+	frame := captureFrame{now, trackId, trackFlowType, append([]byte(nil), buf...)}
+
+	select {
+	case c.queue <- frame:
+		c.size += len(buf)
+	default:
+		c.droppedCount++
+		if time.Since(c.droppedLastLog) >= _CAPTURE_DROP_LOG_INTERVAL {
+			c.droppedLastLog = time.Now()
+			c.log("ERR: disk is too slow, %d packets dropped", c.droppedCount)
+		}
+	}
+	return true
+}
+
+func (c *capture) close() {
+	close(c.queue)
+	<-c.done
+	c.log("capture of %d bytes saved to %s", c.size, c.fpath)
+}
+
+func (c *capture) run(f *os.File) {
+	defer close(c.done)
+	defer f.Close()
+
+	for frame := range c.queue {
+		_, err := f.Write(pcapPacket(frame.time, frame.trackId, frame.trackFlowType, frame.buf))
+		if err != nil {
+			c.log("ERR: %s", err)
+
+			// skip the remaining packets
+			for range c.queue {
+			}
+			return
+		}
+	}
+}
+
+// pcapFileHeader returns the header of a pcap file that contains raw IP packets.
+func pcapFileHeader() []byte {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4) // magic number
+	binary.LittleEndian.PutUint16(header[4:6], 2)          // major version
+	binary.LittleEndian.PutUint16(header[6:8], 4)          // minor version
+	binary.LittleEndian.PutUint32(header[16:20], 65535)    // snapshot length
+	binary.LittleEndian.PutUint32(header[20:24], 101)      // LINKTYPE_RAW
+	return header
+}
+
+// pcapPacket returns a pcap record that contains a packet of a track,
+// wrapped into IPv4 and UDP headers between two loopback addresses.
+func pcapPacket(t time.Time, trackId int, trackFlowType trackFlowType, buf []byte) []byte {
+	port := _CAPTURE_BASE_PORT + trackId*2
+	if trackFlowType == _TRACK_FLOW_RTCP {
+		port++
+	}
+
+	ipLen := 20 + 8 + len(buf)
+	ret := make([]byte, 16+ipLen)
+
+	binary.LittleEndian.PutUint32(ret[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(ret[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(ret[8:12], uint32(ipLen))
+	binary.LittleEndian.PutUint32(ret[12:16], uint32(ipLen))
+
+	ip := ret[16:36]
+	ip[0] = 0x45 // version 4, header length 20 bytes
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen))
+	ip[8] = 64 // TTL
+	ip[9] = 17 // UDP
+	copy(ip[12:16], []byte{127, 0, 0, 1})
+	copy(ip[16:20], []byte{127, 0, 0, 1})
+	binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip))
+
+	// the UDP checksum is optional in IPv4 and is left empty
+	udp := ret[36:44]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(buf)))
+
+	copy(ret[44:], buf)
+	return ret
+}
+
+// ipv4Checksum computes the checksum of an IPv4 header.
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
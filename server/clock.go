@@ -0,0 +1,17 @@
+package server
+
+import (
+	"time"
+)
+
+// clock provides the current time to the timeout logic, in order to allow
+// tests to control the passing of time.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_EXTERNAL_AUTH_TIMEOUT = 5 * time.Second
+
+	// time a successful external authentication of a HTTP reader is reused,
+	// since players send a request for each playlist and segment
+	_EXTERNAL_AUTH_CACHE_TTL = 30 * time.Second
+)
+
+var externalAuthClient = &http.Client{
+	Timeout: _EXTERNAL_AUTH_TIMEOUT,
+}
+
+type externalAuthReq struct {
+	Ip       string `json:"ip"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Path     string `json:"path"`
+	Action   string `json:"action"`
+}
+
+// parseBasicAuth extracts the credentials from a Basic Authorization header.
+func parseBasicAuth(header []string) (string, string, bool) {
+	if len(header) != 1 || !strings.HasPrefix(header[0], "Basic ") {
+		return "", "", false
+	}
+
+	dec, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header[0], "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(dec), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// externalAuth asks an external HTTP server whether the client is allowed to
+// perform an action. The client is allowed only if the server replies with 200.
+func externalAuth(ur string, req externalAuthReq) error {
+	enc, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	res, err := externalAuthClient.Post(ur, "application/json", bytes.NewReader(enc))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("external authentication replied with code %d", res.StatusCode)
+	}
+	return nil
+}
+
+type externalAuthCacheKey struct {
+	ur  string
+	req externalAuthReq
+}
+
+// externalAuthCache stores the successful external authentications of the
+// HTTP readers, that don't keep a connection open like RTSP clients.
+type externalAuthCache struct {
+	mutex   sync.Mutex
+	entries map[externalAuthCacheKey]time.Time // key -> expiration
+}
+
+func newExternalAuthCache() *externalAuthCache {
+	return &externalAuthCache{
+		entries: make(map[externalAuthCacheKey]time.Time),
+	}
+}
+
+// auth calls externalAuth, unless the same request has been authorized less
+// than _EXTERNAL_AUTH_CACHE_TTL ago.
+func (c *externalAuthCache) auth(ur string, req externalAuthReq, now time.Time) error {
+	key := externalAuthCacheKey{ur, req}
+
+	c.mutex.Lock()
+	exp, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok && now.Before(exp) {
+		return nil
+	}
+
+	err := externalAuth(ur, req)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, exp := range c.entries {
+		if !now.Before(exp) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = now.Add(_EXTERNAL_AUTH_CACHE_TTL)
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/binary"
+)
+
+type gopCacheFrame struct {
+	trackId int
+	buf     []byte
+}
+
+// gopCache stores the RTP packets of a path since the last H264 keyframe,
+// in order to send them to new readers, that can start decoding immediately
+// instead of waiting for the next keyframe. When the packets exceed the
+// maximum size, the cache is emptied until the next keyframe.
+type gopCache struct {
+	maxSize      int
+	videoTrackId int
+	valid        bool // the cache begins with a keyframe
+	size         int
+	frames       []gopCacheFrame
+}
+
+func newGopCache(maxSize int, videoTrackId int) *gopCache {
+	return &gopCache{
+		maxSize:      maxSize,
+		videoTrackId: videoTrackId,
+	}
+}
+
+// write stores a RTP packet.
+func (g *gopCache) write(trackId int, buf []byte) {
+	if trackId == g.videoTrackId && rtpH264IsKeyframeStart(buf) {
+		g.valid = true
+		g.size = 0
+		g.frames = g.frames[:0]
+	}
+
+	if !g.valid {
+		return
+	}
+
+	if g.size+len(buf) > g.maxSize {
+		g.valid = false
+		g.size = 0
+		g.frames = nil
+		return
+	}
+
+	g.frames = append(g.frames, gopCacheFrame{trackId, append([]byte(nil), buf...)})
+	g.size += len(buf)
+}
+
+// replay returns a copy of the cached packets, if they fit into a write queue
+// with the given free space, otherwise nil.
+func (g *gopCache) replay(free int) []gopCacheFrame {
+	if !g.valid || len(g.frames) == 0 || len(g.frames) > free {
+		return nil
+	}
+
+	// the frames are overwritten by the next keyframe
+	return append([]gopCacheFrame(nil), g.frames...)
+}
+
+// gopReplayRtpInfo returns the sequence number and the RTP time of the first
+// replayed packet of a track.
+func gopReplayRtpInfo(frames []gopCacheFrame, trackId int) (uint16, uint32, bool) {
+	for _, f := range frames {
+		if f.trackId == trackId && len(f.buf) >= 12 {
+			return binary.BigEndian.Uint16(f.buf[2:4]), binary.BigEndian.Uint32(f.buf[4:8]), true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gortc.io/sdp"
+)
+
+const (
+	_HLS_QUEUE_SIZE        = 1024
+	_HLS_DROP_LOG_INTERVAL = 5 * time.Second
+
+	// timestamps start from this value, in order to allow the DTS to be
+	// lower than the PTS
+	_HLS_PTS_OFFSET = 90000
+
+	// distance between the PTS and the DTS of video frames. RTP packets
+	// carry only the PTS, and the DTS must be lower than the PTS of
+	// B-frames that are sent before the frames they are displayed after.
+	_HLS_DTS_DELAY = 90000 / 5
+)
+
+type hlsVideoTrack struct {
+	id        int
+	clockRate int
+	sps       []byte
+	pps       []byte
+}
+
+type hlsAudioTrack struct {
+	id        int
+	clockRate int
+	config    *aacConfig
+}
+
+// hlsTracks contains the tracks of a stream that can be muxed into HLS.
+type hlsTracks struct {
+	video *hlsVideoTrack // nil if the stream has no H264 track
+	audio *hlsAudioTrack // nil if the stream has no AAC track
+}
+
+// fmtpParams returns the parameters of the fmtp attribute of a media.
+func fmtpParams(media *sdp.Media) map[string]string {
+	ret := make(map[string]string)
+
+	// format is "<payload type> <param>=<value>; <param>=<value>"
+	parts := strings.SplitN(media.Attributes.Value("fmtp"), " ", 2)
+	if len(parts) != 2 {
+		return ret
+	}
+
+	for _, kv := range strings.Split(parts[1], ";") {
+		kv = strings.TrimSpace(kv)
+		if i := strings.Index(kv, "="); i > 0 {
+			ret[strings.ToLower(kv[:i])] = kv[i+1:]
+		}
+	}
+	return ret
+}
+
+// hlsTracksFromSdp finds the first H264 track and the first AAC track of
+// a stream. The AAC track is used only if it uses the AAC-hbr mode.
+func hlsTracksFromSdp(sdpParsed *sdp.Message) hlsTracks {
+	var tracks hlsTracks
+
+	for i, media := range sdpParsed.Medias {
+		codecs := mediaCodecs(&media)
+		if len(codecs) == 0 {
+			continue
+		}
+
+		switch {
+		case tracks.video == nil && strings.EqualFold(codecs[0], "H264"):
+			t := &hlsVideoTrack{
+				id:        i,
+				clockRate: mediaClockRate(&media),
+			}
+
+			// parameters can also be sent in band
+			params := strings.Split(fmtpParams(&media)["sprop-parameter-sets"], ",")
+			if len(params) >= 2 {
+				sps, err1 := base64.StdEncoding.DecodeString(params[0])
+				pps, err2 := base64.StdEncoding.DecodeString(params[1])
+				if err1 == nil && err2 == nil && len(sps) > 0 && len(pps) > 0 {
+					t.sps = sps
+					t.pps = pps
+				}
+			}
+
+			tracks.video = t
+
+		case tracks.audio == nil && strings.EqualFold(codecs[0], "mpeg4-generic"):
+			params := fmtpParams(&media)
+			if !strings.EqualFold(params["mode"], "AAC-hbr") ||
+				params["sizelength"] != "13" || params["indexlength"] != "3" {
+				continue
+			}
+
+			raw, err := hex.DecodeString(params["config"])
+			if err != nil {
+				continue
+			}
+
+			conf, err := aacParseConfig(raw)
+			if err != nil {
+				continue
+			}
+
+			tracks.audio = &hlsAudioTrack{
+				id:        i,
+				clockRate: mediaClockRate(&media),
+				config:    conf,
+			}
+		}
+	}
+
+	return tracks
+}
+
+// hlsTrackClock converts the RTP timestamps of a track into 90kHz timestamps.
+// RTP timestamps of different tracks have random offsets, therefore tracks
+// are aligned with the arrival time of their first packet.
+type hlsTrackClock struct {
+	rate        int64
+	initialized bool
+	last        uint32
+	elapsed     int64 // in units of the clock rate, since the first packet
+	base        int64
+}
+
+func (c *hlsTrackClock) convert(ts uint32, arrival time.Duration) int64 {
+	if !c.initialized {
+		c.initialized = true
+		c.base = int64(arrival) * 90000 / int64(time.Second)
+	} else {
+		c.elapsed += int64(int32(ts - c.last))
+	}
+	c.last = ts
+
+	return _HLS_PTS_OFFSET + c.base + c.elapsed*90000/c.rate
+}
+
+type hlsSegment struct {
+	seq      int
+	startDts int64
+	duration time.Duration
+	content  []byte
+}
+
+type hlsFrame struct {
+	trackId int
+	buf     []byte
+}
+
+// hlsMuxer converts the RTP packets of a path into MPEG-TS segments, that
+// are served by the HLS server together with a playlist.
+type hlsMuxer struct {
+	p              *program
+	path           string
+	tracks         hlsTracks
+	startTime      time.Time
+	h264           rtpH264Depacketizer
+	aac            rtpAacDepacketizer
+	videoClock     hlsTrackClock
+	audioClock     hlsTrackClock
+	sps            []byte
+	pps            []byte
+	dtsInitialized bool
+	lastDts        int64
+	ts             *mpegtsWriter
+	curSegment     *hlsSegment // segment being written
+	nextSeq        int
+	droppedCount   int
+	droppedLastLog time.Time
+
+	// read by the HLS server
+	mutex          sync.Mutex
+	segments       []*hlsSegment // oldest first
+	keyframe       []byte        // last IDR frame with its parameters, in Annex-B format
+	targetDuration int
+	firstSegment   chan struct{} // closed when the first segment is ready
+
+	queue chan hlsFrame
+	done  chan struct{}
+}
+
+func newHlsMuxer(p *program, path string, tracks hlsTracks) *hlsMuxer {
+	m := &hlsMuxer{
+		p:              p,
+		path:           path,
+		tracks:         tracks,
+		startTime:      time.Now(),
+		ts:             newMpegtsWriter(tracks.video != nil, tracks.audio != nil),
+		targetDuration: int(math.Ceil(p.conf.HlsSegmentDuration.Seconds())),
+		firstSegment:   make(chan struct{}),
+		queue:          make(chan hlsFrame, _HLS_QUEUE_SIZE),
+		done:           make(chan struct{}),
+	}
+
+	if tracks.video != nil {
+		m.videoClock.rate = int64(tracks.video.clockRate)
+		m.sps = tracks.video.sps
+		m.pps = tracks.video.pps
+	}
+	if tracks.audio != nil {
+		m.audioClock.rate = int64(tracks.audio.clockRate)
+	}
+
+	go m.run()
+	return m
+}
+
+func (m *hlsMuxer) log(format string, args ...interface{}) {
+	m.p.log("[HLS muxer "+m.path+"] "+format, args...)
+}
+
+// write enqueues a RTP packet. It is called by the program event loop,
+// therefore it never blocks: packets are dropped if the muxer is too slow.
+func (m *hlsMuxer) write(trackId int, buf []byte) {
+	if !(m.tracks.video != nil && trackId == m.tracks.video.id) &&
+		!(m.tracks.audio != nil && trackId == m.tracks.audio.id) {
+		return
+	}
+
+	frame := hlsFrame{trackId, append([]byte(nil), buf...)}
+
+	select {
+	case m.queue <- frame:
+	default:
+		m.droppedCount++
+		if time.Since(m.droppedLastLog) >= _HLS_DROP_LOG_INTERVAL {
+			m.droppedLastLog = time.Now()
+			m.log("ERR: muxer is too slow, %d packets dropped", m.droppedCount)
+		}
+	}
+}
+
+func (m *hlsMuxer) close() {
+	close(m.queue)
+	<-m.done
+}
+
+func (m *hlsMuxer) run() {
+	defer close(m.done)
+
+	for frame := range m.queue {
+		arrival := time.Since(m.startTime)
+
+		if m.tracks.video != nil && frame.trackId == m.tracks.video.id {
+			nalus, ts, ok := m.h264.process(frame.buf)
+			if ok {
+				m.writeVideo(nalus, m.videoClock.convert(ts, arrival))
+			}
+			continue
+		}
+
+		aus, ts, ok := m.aac.process(frame.buf)
+		if ok {
+			m.writeAudio(aus, m.audioClock.convert(ts, arrival))
+		}
+	}
+}
+
+func (m *hlsMuxer) segmentElapsed(dts int64) time.Duration {
+	return time.Duration(dts-m.curSegment.startDts) * time.Second / 90000
+}
+
+func (m *hlsMuxer) writeVideo(nalus [][]byte, pts int64) {
+	idr := false
+	hasParams := false
+	var filtered [][]byte
+
+	for _, nalu := range nalus {
+		switch nalu[0] & 0x1F {
+		case 5:
+			idr = true
+
+		case 7:
+			m.sps = nalu
+			hasParams = true
+
+		case 8:
+			m.pps = nalu
+			hasParams = true
+
+		// access unit delimiters are added below
+		case 9:
+			continue
+		}
+		filtered = append(filtered, nalu)
+	}
+
+	// the first segment starts with an IDR frame
+	if len(filtered) == 0 || (m.curSegment == nil && !idr) {
+		return
+	}
+
+	dts := pts - _HLS_DTS_DELAY
+	if m.dtsInitialized && dts <= m.lastDts {
+		dts = m.lastDts + 1
+	}
+	if dts > pts {
+		dts = pts
+	}
+	m.lastDts = dts
+	m.dtsInitialized = true
+
+	if idr && (m.curSegment == nil || m.segmentElapsed(dts) >= m.p.conf.HlsSegmentDuration) {
+		m.startSegment(dts)
+	}
+
+	// parameters are repeated before each IDR frame, in order to allow
+	// decoding to start from any segment
+	if idr && !hasParams && m.sps != nil && m.pps != nil {
+		filtered = append([][]byte{m.sps, m.pps}, filtered...)
+	}
+
+	data := []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0}
+	for _, nalu := range filtered {
+		data = append(data, 0x00, 0x00, 0x00, 0x01)
+		data = append(data, nalu...)
+	}
+
+	m.ts.writePes(_MPEGTS_PID_VIDEO, _MPEGTS_STREAM_ID_VIDEO, pts, dts, dts, idr, data)
+
+	// the last keyframe is kept for snapshots
+	if idr && m.p.conf.SnapshotCommand != "" {
+		m.mutex.Lock()
+		m.keyframe = data
+		m.mutex.Unlock()
+	}
+}
+
+func (m *hlsMuxer) writeAudio(aus [][]byte, pts int64) {
+	audioOnly := (m.tracks.video == nil)
+
+	if audioOnly {
+		if m.curSegment == nil || m.segmentElapsed(pts) >= m.p.conf.HlsSegmentDuration {
+			m.startSegment(pts)
+		}
+	} else if m.curSegment == nil {
+		return
+	}
+
+	for i, au := range aus {
+		// each AAC access unit contains 1024 samples
+		auPts := pts + int64(i)*1024*90000/int64(m.tracks.audio.clockRate)
+
+		pcr := int64(-1)
+		if audioOnly {
+			pcr = auPts
+		}
+
+		data := append(m.tracks.audio.config.adtsHeader(len(au)), au...)
+		m.ts.writePes(_MPEGTS_PID_AUDIO, _MPEGTS_STREAM_ID_AUDIO, auPts, -1, pcr, audioOnly, data)
+	}
+}
+
+// startSegment completes the current segment, if any, and starts a new one.
+func (m *hlsMuxer) startSegment(dts int64) {
+	if m.curSegment != nil {
+		seg := m.curSegment
+		seg.duration = m.segmentElapsed(dts)
+		seg.content = m.ts.flush()
+
+		m.mutex.Lock()
+		m.segments = append(m.segments, seg)
+		if len(m.segments) > m.p.conf.HlsSegmentCount {
+			m.segments = m.segments[1:]
+		}
+
+		// the target duration can't decrease
+		if d := int(math.Ceil(seg.duration.Seconds())); d > m.targetDuration {
+			m.targetDuration = d
+		}
+
+		if seg.seq == 0 {
+			close(m.firstSegment)
+		}
+		m.mutex.Unlock()
+	}
+
+	m.curSegment = &hlsSegment{
+		seq:      m.nextSeq,
+		startDts: dts,
+	}
+	m.nextSeq++
+
+	m.ts.writeTables()
+}
+
+// playlist returns the playlist, that contains the completed segments.
+func (m *hlsMuxer) playlist() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lines := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-ALLOW-CACHE:NO",
+		"#EXT-X-TARGETDURATION:" + strconv.Itoa(m.targetDuration),
+	}
+
+	if len(m.segments) > 0 {
+		lines = append(lines, "#EXT-X-MEDIA-SEQUENCE:"+strconv.Itoa(m.segments[0].seq))
+	}
+
+	for _, seg := range m.segments {
+		lines = append(lines,
+			"#EXTINF:"+strconv.FormatFloat(seg.duration.Seconds(), 'f', 3, 64)+",",
+			strconv.Itoa(seg.seq)+".ts")
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// lastKeyframe returns the last IDR frame, or nil if no IDR frame has been
+// received yet.
+func (m *hlsMuxer) lastKeyframe() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.keyframe
+}
+
+// segment returns the content of a segment, or nil if it doesn't exist
+// anymore.
+func (m *hlsMuxer) segment(seq int) []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, seg := range m.segments {
+		if seg.seq == seq {
+			return seg.content
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum time a playlist request waits for the first segment of a path
+	_HLS_PLAYLIST_WAIT = 10 * time.Second
+)
+
+// hlsServer serves the playlists and the segments produced by the HLS muxers,
+// and the snapshots of their last keyframes.
+type hlsServer struct {
+	p         *program
+	listener  *net.TCPListener
+	server    *http.Server
+	snapshots *snapshotter // filled only if snapshotCommand is set
+
+	mutex  sync.Mutex
+	muxers map[string]*hlsMuxer
+
+	terminate chan struct{}
+}
+
+func newHlsServer(p *program) (*hlsServer, error) {
+	addr := &net.TCPAddr{
+		IP:   p.conf.listenIp,
+		Port: p.conf.HlsPort,
+	}
+
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &hlsServer{
+		p:         p,
+		listener:  listener,
+		muxers:    make(map[string]*hlsMuxer),
+		terminate: make(chan struct{}),
+	}
+
+	if p.conf.SnapshotCommand != "" {
+		s.snapshots = newSnapshotter(p)
+	}
+
+	s.server = &http.Server{
+		Handler:     http.HandlerFunc(s.onRequest),
+		ReadTimeout: p.conf.ReadTimeout,
+		// playlist requests can wait for the first segment before the response
+		WriteTimeout: _HLS_PLAYLIST_WAIT + p.conf.WriteTimeout,
+		IdleTimeout:  p.conf.ReadTimeout,
+	}
+
+	s.log("opened on %s", addr)
+	return s, nil
+}
+
+func (s *hlsServer) log(format string, args ...interface{}) {
+	s.p.log("[HLS server] "+format, args...)
+}
+
+func (s *hlsServer) run() {
+	err := s.server.Serve(s.listener)
+	if err != http.ErrServerClosed {
+		s.log("ERR: %s", err)
+	}
+}
+
+func (s *hlsServer) close() {
+	// stop requests that are waiting for a segment
+	close(s.terminate)
+	s.server.Shutdown(context.Background())
+}
+
+func (s *hlsServer) setMuxer(path string, m *hlsMuxer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.muxers[path] = m
+}
+
+func (s *hlsServer) removeMuxer(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.muxers, path)
+
+	if s.snapshots != nil {
+		s.snapshots.remove(path)
+	}
+}
+
+func (s *hlsServer) muxer(path string) *hlsMuxer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.muxers[path]
+}
+
+func (s *hlsServer) onRequest(w http.ResponseWriter, req *http.Request) {
+	// allow players hosted on other domains
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// url is /<path>/index.m3u8, /<path>/<segment>.ts or /<path>/snapshot.jpg
+	i := strings.LastIndex(req.URL.Path, "/")
+	path, file := strings.TrimPrefix(req.URL.Path[:i], "/"), req.URL.Path[i+1:]
+	if path == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	pconf := s.p.findConfForPath(path)
+	if pconf == nil || pconf.DisableRead {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !authorizeHttpReader(s.p, w, req, pconf, path) {
+		return
+	}
+
+	switch {
+	case file == "index.m3u8":
+		m := s.muxer(s.p.sourcePath(path))
+		if m == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// players stop if the first playlist is empty
+		select {
+		case <-m.firstSegment:
+		case <-time.After(_HLS_PLAYLIST_WAIT):
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case <-req.Context().Done():
+			return
+		case <-s.terminate:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(m.playlist())
+
+	case strings.HasSuffix(file, ".ts"):
+		seq, err := strconv.Atoi(strings.TrimSuffix(file, ".ts"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		m := s.muxer(s.p.sourcePath(path))
+		if m == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		content := m.segment(seq)
+		if content == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "video/MP2T")
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+
+	case file == "snapshot.jpg" && s.snapshots != nil:
+		m := s.muxer(s.p.sourcePath(path))
+		if m == nil || m.tracks.video == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		keyframe := m.lastKeyframe()
+		if keyframe == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		jpeg, err := s.snapshots.get(s.p.sourcePath(path), keyframe)
+		if err != nil {
+			s.log("ERR: unable to generate the snapshot of path '%s': %s", path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jpeg)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// authorizeHttpReader checks the IP and the credentials of a reader that
+// uses HTTP, with the read parameters of the path. Credentials are sent with
+// Basic authentication.
+func authorizeHttpReader(p *program, w http.ResponseWriter, req *http.Request, pconf *ConfPath, path string) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	zone := ""
+	if i := strings.Index(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+
+	if pconf.readIps != nil && !ipEqualOrInRange(ip, zone, pconf.readIps) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	if (pconf.ReadUser != "" || pconf.ExternalAuthURL != "") && p.authLockedOut(ip) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	user, pass, hasCredentials := req.BasicAuth()
+
+	if pconf.ReadUser != "" && !credentialsMatch(user, pass, pconf.ReadUser, pconf.ReadPass) {
+		if hasCredentials {
+			p.events <- programEventAuthFailure{ip}
+		}
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"rtsp-simple-server\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	if pconf.ExternalAuthURL != "" {
+		err := p.httpAuthCache.auth(pconf.ExternalAuthURL, externalAuthReq{
+			Ip:       ip.String(),
+			User:     user,
+			Password: pass,
+			Path:     path,
+			Action:   "read",
+		}, p.clock.Now())
+		if err != nil {
+			if hasCredentials {
+				p.events <- programEventAuthFailure{ip}
+			}
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"rtsp-simple-server\"")
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+	}
+
+	return true
+}
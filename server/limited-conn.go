@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/aler9/gortsplib"
+)
+
+var errRequestTooLarge = errors.New("request too large")
+
+// limitedConn limits the bytes read from a connection while a limit is set,
+// in order to bound the memory used by the requests of a client, whose
+// headers and body would be read without limits by the RTSP parser.
+// The limit is approximate, since the parser reads in advance.
+// It is used by the client routine only.
+type limitedConn struct {
+	net.Conn
+	limit    int // zero means unlimited
+	count    int
+	exceeded bool
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.limit > 0 {
+		if c.count >= c.limit {
+			c.exceeded = true
+			return 0, errRequestTooLarge
+		}
+		if len(p) > c.limit-c.count {
+			p = p[:c.limit-c.count]
+		}
+	}
+
+	n, err := c.Conn.Read(p)
+	c.count += n
+	return n, err
+}
+
+// setLimit sets the maximum number of bytes that can be read from now on.
+func (c *limitedConn) setLimit(limit int) {
+	c.limit = limit
+	c.count = 0
+}
+
+// checkRequestHeader checks the number of headers of a request and the
+// length of each header line.
+func checkRequestHeader(header gortsplib.Header, maxCount int, maxSize int) error {
+	count := 0
+	for key, values := range header {
+		for _, v := range values {
+			count++
+			if count > maxCount {
+				return fmt.Errorf("request has more than %d headers", maxCount)
+			}
+
+			// <key>: <value>
+			if len(key)+2+len(v) > maxSize {
+				return fmt.Errorf("header '%s' is longer than %d bytes", key, maxSize)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	_MPEGTS_PACKET_SIZE  = 188
+	_MPEGTS_PAYLOAD_SIZE = _MPEGTS_PACKET_SIZE - 4
+
+	_MPEGTS_PID_PAT   = 0x0000
+	_MPEGTS_PID_PMT   = 0x1000
+	_MPEGTS_PID_VIDEO = 0x0100
+	_MPEGTS_PID_AUDIO = 0x0101
+
+	_MPEGTS_STREAM_TYPE_H264 = 0x1B
+	_MPEGTS_STREAM_TYPE_AAC  = 0x0F
+
+	_MPEGTS_STREAM_ID_VIDEO = 0xE0
+	_MPEGTS_STREAM_ID_AUDIO = 0xC0
+)
+
+// mpegtsCrc32 computes the CRC of a PSI section (MPEG-2, not reflected).
+func mpegtsCrc32(buf []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range buf {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if (crc & 0x80000000) != 0 {
+				crc = (crc << 1) ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// mpegtsWriter writes an MPEG transport stream with a single program, that
+// contains a H264 track, an AAC track or both.
+type mpegtsWriter struct {
+	hasVideo   bool
+	hasAudio   bool
+	buf        bytes.Buffer
+	continuity map[uint16]uint8
+}
+
+func newMpegtsWriter(hasVideo bool, hasAudio bool) *mpegtsWriter {
+	return &mpegtsWriter{
+		hasVideo:   hasVideo,
+		hasAudio:   hasAudio,
+		continuity: make(map[uint16]uint8),
+	}
+}
+
+// flush returns the data written so far. Continuity counters are preserved,
+// in order to allow players to concatenate the returned chunks.
+func (w *mpegtsWriter) flush() []byte {
+	ret := append([]byte(nil), w.buf.Bytes()...)
+	w.buf.Reset()
+	return ret
+}
+
+// writePackets splits a payload into TS packets. The adaptation field of
+// the first packet can contain a PCR and the random access indicator,
+// while the last packet is filled with stuffing bytes.
+func (w *mpegtsWriter) writePackets(pid uint16, payload []byte, pcr int64, randomAccess bool) {
+	for first := true; len(payload) > 0; first = false {
+		// adaptation field, without the length byte
+		var af []byte
+
+		if first && (pcr >= 0 || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			af = append(af, flags)
+
+			if pcr >= 0 {
+				af[0] |= 0x10
+				af = append(af,
+					byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1),
+					byte(pcr<<7)|0x7E, 0x00)
+			}
+		}
+
+		afLen := 0
+		if af != nil {
+			afLen = 1 + len(af)
+		}
+
+		n := len(payload)
+		if n > _MPEGTS_PAYLOAD_SIZE-afLen {
+			n = _MPEGTS_PAYLOAD_SIZE - afLen
+		}
+
+		// stuffing
+		if stuffing := _MPEGTS_PAYLOAD_SIZE - afLen - n; stuffing > 0 {
+			if af == nil {
+				stuffing--
+				af = []byte{}
+				if stuffing > 0 {
+					af = append(af, 0x00)
+					stuffing--
+				}
+			}
+			af = append(af, bytes.Repeat([]byte{0xFF}, stuffing)...)
+		}
+
+		header := []byte{
+			0x47,
+			byte(pid >> 8),
+			byte(pid),
+			0x10 | w.continuity[pid],
+		}
+		if first {
+			header[1] |= 0x40
+		}
+		if af != nil {
+			header[3] |= 0x20
+		}
+		w.continuity[pid] = (w.continuity[pid] + 1) & 0x0F
+
+		w.buf.Write(header)
+		if af != nil {
+			w.buf.WriteByte(byte(len(af)))
+			w.buf.Write(af)
+		}
+		w.buf.Write(payload[:n])
+		payload = payload[n:]
+	}
+}
+
+func (w *mpegtsWriter) writeSection(pid uint16, section []byte) {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, mpegtsCrc32(section))
+
+	// pointer field, section, CRC, stuffing
+	payload := append([]byte{0x00}, section...)
+	payload = append(payload, crc...)
+	payload = append(payload, bytes.Repeat([]byte{0xFF}, _MPEGTS_PAYLOAD_SIZE-len(payload))...)
+
+	w.writePackets(pid, payload, -1, false)
+}
+
+// writeTables writes the PAT and the PMT, that must be repeated at the
+// beginning of each segment.
+func (w *mpegtsWriter) writeTables() {
+	w.writeSection(_MPEGTS_PID_PAT, []byte{
+		0x00,       // table id
+		0xB0, 0x0D, // section syntax indicator, section length
+		0x00, 0x01, // transport stream id
+		0xC1,       // version, current next indicator
+		0x00, 0x00, // section number, last section number
+		0x00, 0x01, // program number
+		0xE0 | byte(_MPEGTS_PID_PMT>>8), byte(_MPEGTS_PID_PMT & 0xFF),
+	})
+
+	pcrPid := uint16(_MPEGTS_PID_AUDIO)
+	if w.hasVideo {
+		pcrPid = _MPEGTS_PID_VIDEO
+	}
+
+	var streams []byte
+	if w.hasVideo {
+		streams = append(streams, _MPEGTS_STREAM_TYPE_H264,
+			0xE0|byte(_MPEGTS_PID_VIDEO>>8), byte(_MPEGTS_PID_VIDEO&0xFF), 0xF0, 0x00)
+	}
+	if w.hasAudio {
+		streams = append(streams, _MPEGTS_STREAM_TYPE_AAC,
+			0xE0|byte(_MPEGTS_PID_AUDIO>>8), byte(_MPEGTS_PID_AUDIO&0xFF), 0xF0, 0x00)
+	}
+
+	// the section length includes the fields after it and the CRC
+	sectionLen := 9 + len(streams) + 4
+	pmt := []byte{
+		0x02, // table id
+		0xB0 | byte(sectionLen>>8), byte(sectionLen),
+		0x00, 0x01, // program number
+		0xC1,       // version, current next indicator
+		0x00, 0x00, // section number, last section number
+		0xE0 | byte(pcrPid>>8), byte(pcrPid),
+		0xF0, 0x00, // program info length
+	}
+	w.writeSection(_MPEGTS_PID_PMT, append(pmt, streams...))
+}
+
+func mpegtsPutTimestamp(buf []byte, prefix byte, ts int64) {
+	buf[0] = prefix<<4 | byte((ts>>29)&0x0E) | 0x01
+	binary.BigEndian.PutUint16(buf[1:], uint16((ts>>14)&0xFFFE)|0x01)
+	binary.BigEndian.PutUint16(buf[3:], uint16((ts<<1)&0xFFFE)|0x01)
+}
+
+// writePes writes a PES packet. Timestamps use a 90kHz clock; a negative
+// DTS means that it is equal to the PTS, while a negative PCR means that
+// no PCR is written.
+func (w *mpegtsWriter) writePes(pid uint16, streamId byte, pts int64, dts int64, pcr int64,
+	randomAccess bool, data []byte) {
+	pts &= 0x1FFFFFFFF
+	if dts >= 0 {
+		dts &= 0x1FFFFFFFF
+	}
+	if pcr >= 0 {
+		pcr &= 0x1FFFFFFFF
+	}
+
+	var header []byte
+	if dts >= 0 && dts != pts {
+		header = make([]byte, 19)
+		header[7] = 0xC0
+		header[8] = 10
+		mpegtsPutTimestamp(header[9:], 0x03, pts)
+		mpegtsPutTimestamp(header[14:], 0x01, dts)
+	} else {
+		header = make([]byte, 14)
+		header[7] = 0x80
+		header[8] = 5
+		mpegtsPutTimestamp(header[9:], 0x02, pts)
+	}
+
+	header[2] = 0x01
+	header[3] = streamId
+	header[6] = 0x80
+
+	// the length can be zero only for video streams
+	if pesLen := len(header) - 6 + len(data); pesLen <= 0xFFFF {
+		binary.BigEndian.PutUint16(header[4:], uint16(pesLen))
+	}
+
+	w.writePackets(pid, append(header, data...), pcr, randomAccess)
+}
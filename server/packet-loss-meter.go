@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// gaps bigger than this are considered a restart of the stream
+	_PACKET_LOSS_MAX_GAP = 1000
+)
+
+// packetLossMeter estimates the packet loss of a track by detecting gaps
+// in the sequence numbers of RTP packets.
+type packetLossMeter struct {
+	initialized bool
+	expectedSeq uint16
+	received    uint64
+	lost        uint64
+}
+
+func (m *packetLossMeter) processFrame(frame []byte) {
+	if len(frame) < 4 {
+		return
+	}
+
+	seq := binary.BigEndian.Uint16(frame[2:4])
+
+	if !m.initialized {
+		m.initialized = true
+		m.expectedSeq = seq + 1
+		m.received++
+		return
+	}
+
+	// sequence numbers wrap around, therefore the gap is computed
+	// with 16-bit arithmetic
+	gap := seq - m.expectedSeq
+
+	switch {
+	case gap == 0:
+
+	// packet is late or duplicated, it has already been counted as lost
+	case gap >= 0x8000:
+		if m.lost > 0 {
+			m.lost--
+		}
+		m.received++
+		return
+
+	case gap > _PACKET_LOSS_MAX_GAP:
+
+	default:
+		m.lost += uint64(gap)
+	}
+
+	m.expectedSeq = seq + 1
+	m.received++
+}
+
+// reset returns the packet loss percentage since the last reset,
+// and resets the counters.
+func (m *packetLossMeter) reset() (float64, uint64) {
+	lost := m.lost
+	total := m.received + m.lost
+	m.received = 0
+	m.lost = 0
+
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(lost) * 100 / float64(total), lost
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pathLogs writes the log lines of the clients of a path into the file set
+// with the logFile parameter of the path, in addition to the global log.
+// Files are opened when the first line is written and are closed when the
+// program exits. It is used by the clients and by the program.
+type pathLogs struct {
+	p       *program
+	mutex   sync.Mutex
+	files   map[string]*os.File    // file path -> file
+	loggers map[string]*log.Logger // file path -> logger, nil if the file can't be opened
+}
+
+func newPathLogs(p *program) *pathLogs {
+	return &pathLogs{
+		p:       p,
+		files:   make(map[string]*os.File),
+		loggers: make(map[string]*log.Logger),
+	}
+}
+
+func (l *pathLogs) write(path string, line string) {
+	pconf := l.p.findConfForPath(path)
+	if pconf == nil || pconf.LogFile == "" {
+		return
+	}
+
+	fpath := strings.ReplaceAll(pconf.LogFile, "%path", sanitizePath(path))
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	logger, ok := l.loggers[fpath]
+	if !ok {
+		f, err := openPathLog(fpath)
+		if err != nil {
+			// the error is logged once, the file is not opened again
+			l.p.log("ERR: unable to open the log file of path '%s': %s", path, err)
+		} else {
+			l.files[fpath] = f
+			logger = log.New(f, "", log.LstdFlags)
+		}
+		l.loggers[fpath] = logger
+	}
+
+	if logger != nil {
+		logger.Println(line)
+	}
+}
+
+func (l *pathLogs) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, f := range l.files {
+		f.Close()
+	}
+	l.files = make(map[string]*os.File)
+	l.loggers = make(map[string]*log.Logger)
+}
+
+func openPathLog(fpath string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(fpath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
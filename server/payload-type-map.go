@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePayloadTypeMap parses the payload types that are replaced in the
+// streams sent to readers.
+func parsePayloadTypeMap(in map[string]int) (map[uint8]uint8, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+
+	ret := make(map[uint8]uint8)
+	targets := make(map[int]string)
+
+	for from, to := range in {
+		v, err := strconv.ParseUint(from, 10, 8)
+		if err != nil || v > 127 {
+			return nil, fmt.Errorf("invalid payload type '%s'", from)
+		}
+		if to < 0 || to > 127 {
+			return nil, fmt.Errorf("invalid payload type %d", to)
+		}
+
+		if prev, ok := targets[to]; ok {
+			return nil, fmt.Errorf("payload types '%s' and '%s' are both mapped to %d", prev, from, to)
+		}
+		targets[to] = from
+
+		ret[uint8(v)] = uint8(to)
+	}
+
+	return ret, nil
+}
+
+// remapRtpPayloadType replaces the payload type of a RTP packet in place.
+// RTCP packets do not contain payload types and must not be passed here.
+func remapRtpPayloadType(buf []byte, ptMap map[uint8]uint8) {
+	if len(buf) < 2 {
+		return
+	}
+
+	if pt, ok := ptMap[buf[1]&0x7F]; ok {
+		buf[1] = (buf[1] & 0x80) | pt
+	}
+}
+
+// remapSdpPayloadTypes replaces the payload types in the formats of the
+// medias and in their rtpmap, fmtp and rtcp-fb attributes.
+func remapSdpPayloadTypes(sdpText []byte, ptMap map[uint8]uint8) []byte {
+	remap := func(v string) string {
+		pt, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return v
+		}
+		if to, ok := ptMap[uint8(pt)]; ok {
+			return strconv.FormatUint(uint64(to), 10)
+		}
+		return v
+	}
+
+	lines := strings.Split(strings.TrimRight(string(sdpText), "\r\n"), "\n")
+
+	var out []string
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+
+		if strings.HasPrefix(line, "m=") {
+			// format is "m=<media> <port> <proto> <fmt> ..."
+			parts := strings.Split(line, " ")
+			for i := 3; i < len(parts); i++ {
+				parts[i] = remap(parts[i])
+			}
+			line = strings.Join(parts, " ")
+
+		} else {
+			for _, attr := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+				if strings.HasPrefix(line, attr) {
+					parts := strings.SplitN(strings.TrimPrefix(line, attr), " ", 2)
+					parts[0] = remap(parts[0])
+					line = attr + strings.Join(parts, " ")
+					break
+				}
+			}
+		}
+
+		out = append(out, line)
+	}
+
+	return []byte(strings.Join(out, "\r\n") + "\r\n")
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+type pprofServer struct {
+	p        *program
+	listener net.Listener
+	server   *http.Server
+}
+
+func newPprofServer(p *program) (*pprofServer, error) {
+	listener, err := net.Listen("tcp", p.conf.PprofAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	s := &pprofServer{
+		p:        p,
+		listener: listener,
+		server: &http.Server{
+			Handler: mux,
+		},
+	}
+
+	s.log("opened on %s", p.conf.PprofAddress)
+	return s, nil
+}
+
+func (s *pprofServer) log(format string, args ...interface{}) {
+	s.p.log("[pprof] "+format, args...)
+}
+
+func (s *pprofServer) run() {
+	err := s.server.Serve(s.listener)
+	if err != http.ErrServerClosed {
+		s.log("ERR: %s", err)
+	}
+}
+
+func (s *pprofServer) close() {
+	s.server.Shutdown(context.Background())
+}
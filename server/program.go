@@ -0,0 +1,4218 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aler9/gortsplib"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+	"gortc.io/sdp"
+)
+
+var Version = "v0.0.0"
+
+const (
+	_CONN_REJECTED_LOG_INTERVAL   = 5 * time.Second
+	_CHECK_CLIENTS_INTERVAL       = 1 * time.Second
+	_BITRATE_REPORT_INTERVAL      = 5 * time.Second
+	_PACKET_LOSS_REPORT_INTERVAL  = 10 * time.Second
+	_MAX_SOCKET_BUFFER_SIZE       = 64 * 1024 * 1024
+	_CONF_FETCH_TIMEOUT           = 10 * time.Second
+	_CONF_FETCH_MAX_SIZE          = 1024 * 1024
+	_OVERSIZED_FRAME_LOG_INTERVAL = 5 * time.Second
+	_STARTUP_PROBE_INTERVAL       = 100 * time.Millisecond
+	_INVALID_RTP_LOG_INTERVAL     = 5 * time.Second
+
+	// maximum size of a interleaved frame, whose length is on 16 bits
+	_MAX_FRAME_SIZE = 65535
+)
+
+func parseIpCidrList(in []string) ([]interface{}, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+
+	var ret []interface{}
+	for _, t := range in {
+		_, ipnet, err := net.ParseCIDR(t)
+		if err == nil {
+			ret = append(ret, ipnet)
+			continue
+		}
+
+		ip := net.ParseIP(t)
+		if ip != nil {
+			ret = append(ret, ip)
+			continue
+		}
+
+		// link-local IPv6 addresses can be followed by a zone (i.e. fe80::1%eth0)
+		if n := strings.LastIndex(t, "%"); n >= 0 {
+			ip := net.ParseIP(t[:n])
+			if ip != nil && ip.To4() == nil && n < len(t)-1 {
+				ret = append(ret, &net.IPAddr{IP: ip, Zone: t[n+1:]})
+				continue
+			}
+		}
+
+		return nil, fmt.Errorf("unable to parse ip/network '%s'", t)
+	}
+	return ret, nil
+}
+
+// ipEqualOrInRange returns whether an ip, with its zone, matches any of
+// the items returned by parseIpCidrList. Items without a zone match
+// any zone.
+func ipEqualOrInRange(ip net.IP, zone string, ips []interface{}) bool {
+	for _, item := range ips {
+		switch titem := item.(type) {
+		case net.IP:
+			if titem.Equal(ip) {
+				return true
+			}
+
+		case *net.IPAddr:
+			if titem.IP.Equal(ip) && titem.Zone == zone {
+				return true
+			}
+
+		case *net.IPNet:
+			if titem.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isLocalIp(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type staticPayloadType struct {
+	codec     string
+	clockRate int
+}
+
+// static RTP payload types, that can be used without a rtpmap attribute
+var staticPayloadTypes = map[string]staticPayloadType{
+	"0":  {"PCMU", 8000},
+	"3":  {"GSM", 8000},
+	"4":  {"G723", 8000},
+	"5":  {"DVI4", 8000},
+	"6":  {"DVI4", 16000},
+	"7":  {"LPC", 8000},
+	"8":  {"PCMA", 8000},
+	"9":  {"G722", 8000},
+	"10": {"L16", 44100},
+	"11": {"L16", 44100},
+	"12": {"QCELP", 8000},
+	"13": {"CN", 8000},
+	"14": {"MPA", 90000},
+	"15": {"G728", 8000},
+	"16": {"DVI4", 11025},
+	"17": {"DVI4", 22050},
+	"18": {"G729", 8000},
+	"25": {"CelB", 90000},
+	"26": {"JPEG", 90000},
+	"28": {"nv", 90000},
+	"31": {"H261", 90000},
+	"32": {"MPV", 90000},
+	"33": {"MP2T", 90000},
+	"34": {"H263", 90000},
+}
+
+// sdpParse parses a SDP received from the network. Panics of the parser,
+// caused by malformed SDPs, are returned as errors.
+func sdpParse(buf []byte) (ret *sdp.Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return gortsplib.SDPParse(buf)
+}
+
+// mediaCodecs returns the encoding names of the formats of a media.
+func mediaCodecs(media *sdp.Media) []string {
+	// rtpmap format is "<payload type> <encoding name>/<clock rate>[/<parameters>]"
+	rtpmaps := make(map[string]string)
+	for _, rtpmap := range media.Attributes.Values("rtpmap") {
+		parts := strings.SplitN(rtpmap, " ", 2)
+		if len(parts) == 2 {
+			rtpmaps[parts[0]] = strings.Split(parts[1], "/")[0]
+		}
+	}
+
+	var ret []string
+	for _, format := range media.Description.Formats {
+		if codec, ok := rtpmaps[format]; ok {
+			ret = append(ret, codec)
+		} else if pt, ok := staticPayloadTypes[format]; ok {
+			ret = append(ret, pt.codec)
+		} else {
+			ret = append(ret, format)
+		}
+	}
+	return ret
+}
+
+// h264TrackId returns the index of the first H264 track of a SDP.
+func h264TrackId(sdpParsed *sdp.Message) (int, bool) {
+	for i, media := range sdpParsed.Medias {
+		if codecs := mediaCodecs(&media); len(codecs) > 0 && strings.EqualFold(codecs[0], "H264") {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// sdpSetConnectionIp replaces the address of the connection lines of a SDP.
+// If the SDP doesn't contain any connection line, it is added to the session.
+func sdpSetConnectionIp(sdpText []byte, ip net.IP) []byte {
+	conn := "c=IN IP4 " + ip.String()
+	if ip.To4() == nil {
+		conn = "c=IN IP6 " + ip.String()
+	}
+
+	lines := strings.Split(strings.TrimRight(string(sdpText), "\r\n"), "\n")
+
+	found := false
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(lines[i], "c=") {
+			lines[i] = conn
+			found = true
+		}
+	}
+
+	if !found {
+		// the connection line precedes the bandwidth and time lines
+		for i, line := range lines {
+			if strings.HasPrefix(line, "b=") || strings.HasPrefix(line, "t=") || strings.HasPrefix(line, "m=") {
+				lines = append(lines[:i], append([]string{conn}, lines[i:]...)...)
+				break
+			}
+		}
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// compilePathPattern returns a regular expression if the path is a pattern,
+// or nil otherwise. Paths that start with ~ are regular expressions, paths that
+// contain * are wildcards, in which * matches any sequence of characters
+// except /, and 'all' matches any path.
+func compilePathPattern(path string) (*regexp.Regexp, error) {
+	switch {
+	case path == "all":
+		return regexp.MustCompile("^.*$"), nil
+
+	case strings.HasPrefix(path, "~"):
+		return regexp.Compile(path[1:])
+
+	case strings.Contains(path, "*"):
+		return regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(path), "\\*", "[^/]*", -1) + "$")
+	}
+	return nil, nil
+}
+
+type trackFlowType int
+
+const (
+	_TRACK_FLOW_RTP trackFlowType = iota
+	_TRACK_FLOW_RTCP
+)
+
+type track struct {
+	rtpPort     int
+	rtcpPort    int
+	rtpChannel  uint8        // filled only if the protocol is TCP
+	rtcpChannel uint8        // filled only if the protocol is TCP
+	srtp        *srtpContext // filled only if the path uses SRTP
+
+	// statistics of the RTP packets received from publishers or sent to readers,
+	// filled by the event loop
+	bytes         uint64
+	packets       uint64
+	lastFrameTime time.Time
+}
+
+// addFrame updates the statistics of the track with a RTP packet.
+func (t *track) addFrame(now time.Time, size int) {
+	t.bytes += uint64(size)
+	t.packets += 1
+	t.lastFrameTime = now
+}
+
+type streamProtocol int
+
+const (
+	_STREAM_PROTOCOL_UDP streamProtocol = iota
+	_STREAM_PROTOCOL_TCP
+)
+
+func (s streamProtocol) String() string {
+	if s == _STREAM_PROTOCOL_UDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+type programEvent interface {
+	isProgramEvent()
+}
+
+type programEventClientNew struct {
+	nconn net.Conn
+}
+
+func (programEventClientNew) isProgramEvent() {}
+
+type programEventClientClose struct {
+	done   chan struct{}
+	client *serverClient
+}
+
+func (programEventClientClose) isProgramEvent() {}
+
+type programEventClientTeardown struct {
+	done   chan struct{}
+	client *serverClient
+}
+
+func (programEventClientTeardown) isProgramEvent() {}
+
+type describeRes struct {
+	sdp      []byte
+	redirect string
+	err      error
+}
+
+type programEventClientDescribe struct {
+	res    chan describeRes
+	client *serverClient
+	path   string
+}
+
+func (programEventClientDescribe) isProgramEvent() {}
+
+type programEventClientAnnounce struct {
+	res       chan error
+	client    *serverClient
+	path      string
+	sdpText   []byte
+	sdpParsed *sdp.Message
+}
+
+func (programEventClientAnnounce) isProgramEvent() {}
+
+type programEventClientSetupPlay struct {
+	res         chan error
+	client      *serverClient
+	path        string
+	control     string
+	protocol    streamProtocol
+	srtp        bool
+	rtpPort     int
+	rtcpPort    int
+	rtpChannel  uint8
+	rtcpChannel uint8
+	destination net.IP
+}
+
+func (programEventClientSetupPlay) isProgramEvent() {}
+
+type programEventClientSetupRecord struct {
+	res         chan error
+	client      *serverClient
+	protocol    streamProtocol
+	rtpPort     int
+	rtcpPort    int
+	rtpChannel  uint8
+	rtcpChannel uint8
+}
+
+func (programEventClientSetupRecord) isProgramEvent() {}
+
+type playRtpInfo struct {
+	control string
+	seq     uint16
+	rtpTime uint32
+}
+
+type play1Res struct {
+	rtpInfo []playRtpInfo // filled only if all tracks have received a packet
+	err     error
+}
+
+type programEventClientPlay1 struct {
+	res    chan play1Res
+	client *serverClient
+}
+
+func (programEventClientPlay1) isProgramEvent() {}
+
+type programEventClientPlay2 struct {
+	res    chan error
+	client *serverClient
+}
+
+func (programEventClientPlay2) isProgramEvent() {}
+
+// programEventClientWaitFirstFrame asks to close res when the path of the
+// client receives the first frame, or immediately if it already did.
+type programEventClientWaitFirstFrame struct {
+	res    chan struct{}
+	client *serverClient
+}
+
+func (programEventClientWaitFirstFrame) isProgramEvent() {}
+
+type programEventClientPause struct {
+	res    chan error
+	client *serverClient
+}
+
+func (programEventClientPause) isProgramEvent() {}
+
+type programEventClientRecord struct {
+	res    chan error
+	client *serverClient
+}
+
+func (programEventClientRecord) isProgramEvent() {}
+
+type programEventClientFrameUdp struct {
+	trackFlowType trackFlowType
+	addr          *net.UDPAddr
+	buf           []byte
+}
+
+func (programEventClientFrameUdp) isProgramEvent() {}
+
+type programEventClientFrameTcp struct {
+	client        *serverClient
+	path          string
+	trackId       int
+	trackFlowType trackFlowType
+	buf           []byte
+}
+
+func (programEventClientFrameTcp) isProgramEvent() {}
+
+type programEventStreamerReady struct {
+	streamer  *streamer
+	sdpText   []byte
+	sdpParsed *sdp.Message
+}
+
+func (programEventStreamerReady) isProgramEvent() {}
+
+type programEventStreamerNotReady struct {
+	streamer *streamer
+}
+
+func (programEventStreamerNotReady) isProgramEvent() {}
+
+// programEventStreamerFailed is sent when a streamer fails to connect to its
+// source or to start reading it.
+type programEventStreamerFailed struct {
+	streamer *streamer
+}
+
+func (programEventStreamerFailed) isProgramEvent() {}
+
+type programEventStreamerFrame struct {
+	streamer      *streamer
+	trackId       int
+	trackFlowType trackFlowType
+	buf           []byte
+}
+
+func (programEventStreamerFrame) isProgramEvent() {}
+
+type programEventRtmpNew struct {
+	nconn net.Conn
+}
+
+func (programEventRtmpNew) isProgramEvent() {}
+
+type programEventRtmpPublish struct {
+	res       chan error
+	publisher *rtmpPublisher
+	path      string
+}
+
+func (programEventRtmpPublish) isProgramEvent() {}
+
+type programEventRtmpReady struct {
+	publisher *rtmpPublisher
+}
+
+func (programEventRtmpReady) isProgramEvent() {}
+
+type programEventRtmpFrame struct {
+	publisher *rtmpPublisher
+	trackId   int
+	buf       []byte
+}
+
+func (programEventRtmpFrame) isProgramEvent() {}
+
+type programEventRtmpClose struct {
+	done      chan struct{}
+	publisher *rtmpPublisher
+}
+
+func (programEventRtmpClose) isProgramEvent() {}
+
+type programEventApiHealth struct {
+	res chan apiHealthRes
+}
+
+func (programEventApiHealth) isProgramEvent() {}
+
+type programEventApiSdp struct {
+	res  chan apiSdpRes
+	path string
+}
+
+func (programEventApiSdp) isProgramEvent() {}
+
+type programEventApiState struct {
+	res chan apiStateRes
+}
+
+func (programEventApiState) isProgramEvent() {}
+
+type programEventReloadPath struct {
+	res   chan error
+	path  string
+	pconf *ConfPath
+	force bool
+}
+
+func (programEventReloadPath) isProgramEvent() {}
+
+type programEventExportPaths struct {
+	res chan []apiExportedPath
+}
+
+func (programEventExportPaths) isProgramEvent() {}
+
+type programEventImportPaths struct {
+	res   chan apiImportRes
+	paths map[string]*ConfPath
+}
+
+func (programEventImportPaths) isProgramEvent() {}
+
+type programEventStartCapture struct {
+	res      chan apiCaptureRes
+	path     string
+	duration time.Duration
+	maxSize  int
+}
+
+func (programEventStartCapture) isProgramEvent() {}
+
+// sourceProbeState is the state of a RTSP source during the startup probe.
+type sourceProbeState int
+
+const (
+	_SOURCE_PROBE_WAITING sourceProbeState = iota
+	_SOURCE_PROBE_READY
+	_SOURCE_PROBE_FAILED
+)
+
+// programEventSourcesReady asks the state of the RTSP sources, by path.
+type programEventSourcesReady struct {
+	res chan map[string]sourceProbeState
+}
+
+func (programEventSourcesReady) isProgramEvent() {}
+
+type programEventDrainPath struct {
+	res   chan error
+	path  string
+	drain bool
+	grace time.Duration
+}
+
+func (programEventDrainPath) isProgramEvent() {}
+
+type programEventKickClient struct {
+	res chan bool
+	id  string
+}
+
+func (programEventKickClient) isProgramEvent() {}
+
+type programEventAuthFailure struct {
+	ip net.IP
+}
+
+func (programEventAuthFailure) isProgramEvent() {}
+
+type programEventAuthLocked struct {
+	res chan bool
+	ip  net.IP
+}
+
+func (programEventAuthLocked) isProgramEvent() {}
+
+type programEventUpgrade struct{}
+
+func (programEventUpgrade) isProgramEvent() {}
+
+type programEventUpgradeReady struct {
+	err error
+}
+
+func (programEventUpgradeReady) isProgramEvent() {}
+
+type programEventTerminate struct{}
+
+func (programEventTerminate) isProgramEvent() {}
+
+type ConfPath struct {
+	Source                   string `yaml:"source" json:"source"`
+	SourceProtocol           string `yaml:"sourceProtocol" json:"sourceProtocol"`
+	SourceUser               string `yaml:"sourceUser" json:"sourceUser"`
+	SourcePass               string `yaml:"sourcePass" json:"sourcePass"`
+	SourceUserAgent          string `yaml:"sourceUserAgent" json:"sourceUserAgent"`
+	SourceFingerprint        string `yaml:"sourceFingerprint" json:"sourceFingerprint"`
+	sourceFingerprint        []byte
+	SourceInsecureSkipVerify bool     `yaml:"sourceInsecureSkipVerify" json:"sourceInsecureSkipVerify"`
+	SourceTranscode          string   `yaml:"sourceTranscode" json:"sourceTranscode"`
+	SourceRedirect           string   `yaml:"sourceRedirect" json:"sourceRedirect"`
+	SourceOf                 string   `yaml:"sourceOf" json:"sourceOf"`
+	DisablePublish           bool     `yaml:"disablePublish" json:"disablePublish"`
+	PublishUser              string   `yaml:"publishUser" json:"publishUser"`
+	PublishPass              string   `yaml:"publishPass" json:"publishPass"`
+	PublishIps               []string `yaml:"publishIps" json:"publishIps"`
+	publishIps               []interface{}
+	ExternalAuthURL          string        `yaml:"externalAuthURL" json:"externalAuthURL"`
+	DisableRead              bool          `yaml:"disableRead" json:"disableRead"`
+	ReadUser                 string        `yaml:"readUser" json:"readUser"`
+	ReadPass                 string        `yaml:"readPass" json:"readPass"`
+	ReadRateLimit            uint64        `yaml:"readRateLimit" json:"readRateLimit"`
+	ReadTcpBatchWindow       time.Duration `yaml:"readTcpBatchWindow" json:"readTcpBatchWindow"`
+	ReadTcpBatchSize         int           `yaml:"readTcpBatchSize" json:"readTcpBatchSize"`
+	ReadSRTP                 bool          `yaml:"readSRTP" json:"readSRTP"`
+	ReadIps                  []string      `yaml:"readIps" json:"readIps"`
+	readIps                  []interface{}
+	regexp                   *regexp.Regexp // filled only if the path is a pattern
+	PublishBitrateMax        uint64         `yaml:"publishBitrateMax" json:"publishBitrateMax"`
+	PublishBitrateAction     string         `yaml:"publishBitrateAction" json:"publishBitrateAction"`
+	GenerateRTCP             bool           `yaml:"generateRTCP" json:"generateRTCP"`
+	ValidateRTP              bool           `yaml:"validateRTP" json:"validateRTP"`
+	PublishMode              string         `yaml:"publishMode" json:"publishMode"`
+	PublisherReconnectGrace  time.Duration  `yaml:"publisherReconnectGrace" json:"publisherReconnectGrace"`
+	AllowedCodecs            []string       `yaml:"allowedCodecs" json:"allowedCodecs"`
+	PayloadTypeMap           map[string]int `yaml:"payloadTypeMap" json:"payloadTypeMap"`
+	payloadTypeMap           map[uint8]uint8
+	SdpAttributes            map[string][]string `yaml:"sdpAttributes" json:"sdpAttributes"`
+	sdpAttributes            map[string][]string
+	UdpPacing                bool              `yaml:"udpPacing" json:"udpPacing"`
+	ReadWaitKeyframe         bool              `yaml:"readWaitKeyframe" json:"readWaitKeyframe"`
+	ReadDropPolicy           string            `yaml:"readDropPolicy" json:"readDropPolicy"`
+	ReadWaitFirstFrame       time.Duration     `yaml:"readWaitFirstFrame" json:"readWaitFirstFrame"`
+	GopCacheSize             int               `yaml:"gopCacheSize" json:"gopCacheSize"`
+	MaxSessionDuration       time.Duration     `yaml:"maxSessionDuration" json:"maxSessionDuration"`
+	LogFile                  string            `yaml:"logFile" json:"logFile"`
+	Record                   bool              `yaml:"record" json:"record"`
+	RecordPath               string            `yaml:"recordPath" json:"recordPath"`
+	RecordSegmentDuration    time.Duration     `yaml:"recordSegmentDuration" json:"recordSegmentDuration"`
+	RecordDeleteAfter        time.Duration     `yaml:"recordDeleteAfter" json:"recordDeleteAfter"`
+	Labels                   map[string]string `yaml:"labels" json:"labels"`
+}
+
+type Conf struct {
+	Protocols              []string `yaml:"protocols" json:"protocols"`
+	ListenIp               string   `yaml:"listenIp" json:"listenIp"`
+	listenIp               net.IP
+	ExternalIp             string `yaml:"externalIp" json:"externalIp"`
+	externalIp             net.IP
+	RtspPort               int      `yaml:"rtspPort" json:"rtspPort"`
+	RtpPort                int      `yaml:"rtpPort" json:"rtpPort"`
+	RtcpPort               int      `yaml:"rtcpPort" json:"rtcpPort"`
+	AllowUdpDestination    bool     `yaml:"allowUdpDestination" json:"allowUdpDestination"`
+	UdpDestinationIps      []string `yaml:"udpDestinationIps" json:"udpDestinationIps"`
+	udpDestinationIps      []interface{}
+	RtmpPort               int           `yaml:"rtmpPort" json:"rtmpPort"`
+	HlsPort                int           `yaml:"hlsPort" json:"hlsPort"`
+	HlsSegmentDuration     time.Duration `yaml:"hlsSegmentDuration" json:"hlsSegmentDuration"`
+	HlsSegmentCount        int           `yaml:"hlsSegmentCount" json:"hlsSegmentCount"`
+	SnapshotCommand        string        `yaml:"snapshotCommand" json:"snapshotCommand"`
+	SnapshotInterval       time.Duration `yaml:"snapshotInterval" json:"snapshotInterval"`
+	ReadTimeout            time.Duration `yaml:"readTimeout" json:"readTimeout"`
+	WriteTimeout           time.Duration `yaml:"writeTimeout" json:"writeTimeout"`
+	SourceReadTimeout      time.Duration `yaml:"sourceReadTimeout" json:"sourceReadTimeout"`
+	SourceWriteTimeout     time.Duration `yaml:"sourceWriteTimeout" json:"sourceWriteTimeout"`
+	SourceProtocol         string        `yaml:"sourceProtocol" json:"sourceProtocol"`
+	StartupProbeTimeout    time.Duration `yaml:"startupProbeTimeout" json:"startupProbeTimeout"`
+	ReadBufferSize         int           `yaml:"readBufferSize" json:"readBufferSize"`
+	WriteBufferSize        int           `yaml:"writeBufferSize" json:"writeBufferSize"`
+	UdpReadBufferSize      int           `yaml:"udpReadBufferSize" json:"udpReadBufferSize"`
+	MaxSocketBufferSize    int           `yaml:"maxSocketBufferSize" json:"maxSocketBufferSize"`
+	ListenBacklog          int           `yaml:"listenBacklog" json:"listenBacklog"`
+	AcceptRoutines         int           `yaml:"acceptRoutines" json:"acceptRoutines"`
+	ReadBufferCount        int           `yaml:"readBufferCount" json:"readBufferCount"`
+	MaxFrameSize           int           `yaml:"maxFrameSize" json:"maxFrameSize"`
+	maxTcpFrameSize        int
+	MaxConnections         int           `yaml:"maxConnections" json:"maxConnections"`
+	MaxConnectionsPerIp    int           `yaml:"maxConnectionsPerIp" json:"maxConnectionsPerIp"`
+	BindRetries            int           `yaml:"bindRetries" json:"bindRetries"`
+	AuthFailureThreshold   int           `yaml:"authFailureThreshold" json:"authFailureThreshold"`
+	AuthFailureWindow      time.Duration `yaml:"authFailureWindow" json:"authFailureWindow"`
+	BindRetryInterval      time.Duration `yaml:"bindRetryInterval" json:"bindRetryInterval"`
+	WriteQueueSize         int           `yaml:"writeQueueSize" json:"writeQueueSize"`
+	WriteQueueFullAction   string        `yaml:"writeQueueFullAction" json:"writeQueueFullAction"`
+	PathNotReadyStatus     int           `yaml:"pathNotReadyStatus" json:"pathNotReadyStatus"`
+	MaxSdpSize             int           `yaml:"maxSdpSize" json:"maxSdpSize"`
+	MaxRequestSize         int           `yaml:"maxRequestSize" json:"maxRequestSize"`
+	MaxHeaderCount         int           `yaml:"maxHeaderCount" json:"maxHeaderCount"`
+	MaxHeaderSize          int           `yaml:"maxHeaderSize" json:"maxHeaderSize"`
+	ConnectionTimeout      time.Duration `yaml:"connectionTimeout" json:"connectionTimeout"`
+	SessionTimeout         time.Duration `yaml:"sessionTimeout" json:"sessionTimeout"`
+	RtcpReportPeriod       time.Duration `yaml:"rtcpReportPeriod" json:"rtcpReportPeriod"`
+	SourceRtcpReportPeriod time.Duration `yaml:"sourceRtcpReportPeriod" json:"sourceRtcpReportPeriod"`
+	PreScript              string        `yaml:"preScript" json:"preScript"`
+	PostScript             string        `yaml:"postScript" json:"postScript"`
+	LogLevel               string        `yaml:"logLevel" json:"logLevel"`
+	LogReverseDNS          bool          `yaml:"logReverseDNS" json:"logReverseDNS"`
+	LogPathsPeriod         time.Duration `yaml:"logPathsPeriod" json:"logPathsPeriod"`
+	AccessLog              string        `yaml:"accessLog" json:"accessLog"`
+	ServerHeader           string        `yaml:"serverHeader" json:"serverHeader"`
+	TlsMinVersion          string        `yaml:"tlsMinVersion" json:"tlsMinVersion"`
+	tlsMinVersion          uint16
+	TlsCipherSuites        []string `yaml:"tlsCipherSuites" json:"tlsCipherSuites"`
+	tlsCipherSuites        []uint16
+	Pprof                  bool                 `yaml:"pprof" json:"pprof"`
+	PprofPort              int                  `yaml:"pprofPort" json:"pprofPort"`
+	PprofAddress           string               `yaml:"pprofAddress" json:"pprofAddress"`
+	Api                    bool                 `yaml:"api" json:"api"`
+	ApiAddress             string               `yaml:"apiAddress" json:"apiAddress"`
+	ApiUser                string               `yaml:"apiUser" json:"apiUser"`
+	ApiPass                string               `yaml:"apiPass" json:"apiPass"`
+	WebhookURL             string               `yaml:"webhookURL" json:"webhookURL"`
+	CapturePath            string               `yaml:"capturePath" json:"capturePath"`
+	DisableDefaultPath     bool                 `yaml:"disableDefaultPath" json:"disableDefaultPath"`
+	Include                []string             `yaml:"include" json:"include"`
+	Paths                  map[string]*ConfPath `yaml:"paths" json:"paths"`
+	pathPatterns           []string             // sorted, 'all' is always the last one
+}
+
+// decodeConf decodes a configuration in the given format.
+// JSON and TOML configurations are converted into YAML before being decoded,
+// in order to share the same decoding rules (i.e. durations like "5s").
+func decodeConf(r io.Reader, format string) (*Conf, error) {
+	var ret Conf
+
+	switch format {
+	case "json", "toml":
+		var raw map[string]interface{}
+		var err error
+		if format == "json" {
+			err = json.NewDecoder(r).Decode(&raw)
+		} else {
+			_, err = toml.DecodeReader(r, &raw)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		byts, err := yaml.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		err = yaml.Unmarshal(byts, &ret)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		err := yaml.NewDecoder(r).Decode(&ret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ret, nil
+}
+
+func loadConf(fpath string, stdin io.Reader) (*Conf, error) {
+	if fpath == "stdin" || strings.HasPrefix(fpath, "http://") || strings.HasPrefix(fpath, "https://") {
+		var conf *Conf
+		var err error
+		if fpath == "stdin" {
+			conf, err = decodeConf(stdin, "yaml")
+		} else {
+			conf, err = fetchConf(fpath)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// includes are resolved relative to the including file
+		if len(conf.Include) > 0 {
+			return nil, fmt.Errorf("include can be used only in configuration files")
+		}
+		return conf, nil
+	}
+
+	// conf.yml is optional
+	if fpath == "conf.yml" {
+		if _, err := os.Stat(fpath); err != nil {
+			return &Conf{}, nil
+		}
+	}
+
+	return loadConfFile(fpath, nil)
+}
+
+// loadConfFile loads a configuration file and merges the paths of the files
+// it includes. Paths of later includes override the ones of earlier includes,
+// and paths of the including file override the included ones.
+// stack contains the files that are being loaded, in order to detect cycles.
+func loadConfFile(fpath string, stack []string) (*Conf, error) {
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range stack {
+		if f == abs {
+			return nil, fmt.Errorf("cyclic include of '%s'", fpath)
+		}
+	}
+	stack = append(stack, abs)
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var conf *Conf
+
+	// the format is detected from the file extension
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".json":
+		conf, err = decodeConf(f, "json")
+
+	case ".toml":
+		conf, err = decodeConf(f, "toml")
+
+	default:
+		conf, err = decodeConf(f, "yaml")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.Include) == 0 {
+		return conf, nil
+	}
+
+	paths := make(map[string]*ConfPath)
+	for _, inc := range conf.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(fpath), inc)
+		}
+
+		// only the paths and the includes of included files are read
+		iconf, err := loadConfFile(inc, stack)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load included file '%s': %s", inc, err)
+		}
+
+		for path, pconf := range iconf.Paths {
+			paths[path] = pconf
+		}
+	}
+	for path, pconf := range conf.Paths {
+		paths[path] = pconf
+	}
+	conf.Paths = paths
+
+	return conf, nil
+}
+
+// fetchConf downloads a configuration from a HTTP server. The format is
+// detected from the extension of the url path, like for files.
+func fetchConf(ur string) (*Conf, error) {
+	pu, err := url.Parse(ur)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration url")
+	}
+
+	client := &http.Client{Timeout: _CONF_FETCH_TIMEOUT}
+	res, err := client.Get(ur)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the configuration: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch the configuration: server returned %s", res.Status)
+	}
+
+	// a truncated configuration could still be valid, therefore the body
+	// is read entirely before decoding it
+	byts, err := ioutil.ReadAll(io.LimitReader(res.Body, _CONF_FETCH_MAX_SIZE+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the configuration: %s", err)
+	}
+	if len(byts) > _CONF_FETCH_MAX_SIZE {
+		return nil, fmt.Errorf("unable to fetch the configuration: it is bigger than %d bytes", _CONF_FETCH_MAX_SIZE)
+	}
+
+	switch strings.ToLower(filepath.Ext(pu.Path)) {
+	case ".json":
+		return decodeConf(bytes.NewReader(byts), "json")
+
+	case ".toml":
+		return decodeConf(bytes.NewReader(byts), "toml")
+	}
+	return decodeConf(bytes.NewReader(byts), "yaml")
+}
+
+// orphanedPath is a path whose publisher disconnected, whose readers are
+// kept during the reconnect grace period.
+type orphanedPath struct {
+	deadline time.Time
+	medias   int // number of tracks of the previous publisher
+}
+
+// authFailures are the failed authentications of an IP.
+type authFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time // filled only if the IP is locked out
+}
+
+// a publisher can be either a serverClient or a streamer
+type publisher interface {
+	publisherIsReady() bool
+	publisherSdpText() []byte
+	publisherSdpParsed() *sdp.Message
+}
+
+type program struct {
+	conf              *Conf
+	confPath          string       // filled only if the program is started by newProgram
+	confMutex         sync.RWMutex // protects the paths of conf, that can be reloaded by the API
+	protocols         map[streamProtocol]struct{}
+	pprof             *pprofServer
+	api               *api
+	tcpl              *serverTcpListener
+	udplRtp           *serverUdpListener
+	udplRtcp          *serverUdpListener
+	rtmpl             *rtmpListener
+	hls               *hlsServer
+	clients           map[*serverClient]struct{}
+	connsPerIp        map[string]int // ip -> number of clients and RTMP publishers
+	authFailures      map[string]*authFailures
+	rtmpPublishers    map[*rtmpPublisher]struct{}
+	streamers         []*streamer
+	publishers        map[string]publisher
+	publishMeters     map[string]*bitrateMeter
+	rtcpSenders       map[string][]*rtcpSender
+	lossMeters        map[string][]*packetLossMeter
+	rtpInfos          map[string][]*trackRtpInfo
+	drainedPaths      map[string]time.Time       // path -> time after which clients are closed
+	orphanedPaths     map[string]orphanedPath    // paths whose readers wait for a new publisher
+	standbyPublishers map[string][]*serverClient // ordered by arrival
+	recorders         map[string]*recorder
+	hlsMuxers         map[string]*hlsMuxer
+	captures          map[string]*capture
+	udpPacers         map[string][]*udpPacer
+	rtpRewriters      map[string][]*rtpRewriter
+	gopCaches         map[string]*gopCache // nil if the path has no H264 track
+	invalidRtp        map[string]*invalidRtpCount
+	readyPaths        map[string]struct{}
+	firstFramePaths   map[string]struct{}                        // ready paths that received at least a frame
+	firstFrameWaiters map[string]map[*serverClient]chan struct{} // closed when the path receives the first frame
+	webhook           *webhook
+	pathLogs          *pathLogs
+	accessLog         *accessLog // filled only if accessLog is set
+	reverseDns        *reverseDnsCache
+	httpAuthCache     *externalAuthCache
+	clock             clock
+	publisherCount    int
+	receiverCount     int
+
+	connRejectedCount   int
+	connRejectedLastLog time.Time
+
+	upgrading bool          // a new instance is being started
+	handedOff bool          // the listener has been passed to a new instance
+	upgraded  chan struct{} // closed when the connections left after the upgrade are closed
+
+	events chan programEvent
+	done   chan struct{}
+}
+
+// credentialsMatch compares credentials in constant time, in order not to
+// leak their content through the time taken by the comparison.
+func credentialsMatch(user string, pass string, expectedUser string, expectedPass string) bool {
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser))
+	passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(expectedPass))
+	return (userOk & passOk) == 1
+}
+
+// checkCredential checks that a username or a password can be sent inside
+// the Authorization header of RTSP and HTTP requests.
+func checkCredential(value string, isUser bool) error {
+	for _, r := range value {
+		// control characters, like CR and LF, would break the header
+		if unicode.IsControl(r) {
+			return fmt.Errorf("control characters are not allowed")
+		}
+
+		if isUser {
+			switch r {
+			// with Basic authentication, the username ends at the first colon
+			case ':':
+				return fmt.Errorf("colons are not allowed")
+
+			// with Digest authentication, the username is sent inside a quoted string
+			case '"', '\\':
+				return fmt.Errorf("quotes and backslashes are not allowed")
+			}
+		}
+	}
+	return nil
+}
+
+// confErrors are the errors found while validating the configuration.
+type confErrors []error
+
+func (e confErrors) Error() string {
+	ret := fmt.Sprintf("%d errors in the configuration:", len(e))
+	for _, err := range e {
+		ret += "\n  " + err.Error()
+	}
+	return ret
+}
+
+// checkConf validates the configuration and fills the default values,
+// without opening any socket.
+func checkConf(conf *Conf) (map[streamProtocol]struct{}, error) {
+	// all the errors are collected, in order to report them at once
+	var errs confErrors
+
+	if conf.ReadTimeout == 0 {
+		conf.ReadTimeout = 5 * time.Second
+	}
+	if conf.WriteTimeout == 0 {
+		conf.WriteTimeout = 5 * time.Second
+	}
+	if conf.SourceReadTimeout == 0 {
+		conf.SourceReadTimeout = conf.ReadTimeout
+	}
+	if conf.SourceWriteTimeout == 0 {
+		conf.SourceWriteTimeout = conf.WriteTimeout
+	}
+	if conf.SourceProtocol == "" {
+		conf.SourceProtocol = "udp"
+	}
+	if conf.SourceProtocol != "udp" && conf.SourceProtocol != "tcp" && conf.SourceProtocol != "auto" {
+		errs = append(errs, fmt.Errorf("unsupported source protocol '%s'", conf.SourceProtocol))
+	}
+	if conf.StartupProbeTimeout < 0 {
+		errs = append(errs, fmt.Errorf("startup probe timeout must be greater or equal than zero"))
+	}
+
+	if conf.MaxSocketBufferSize == 0 {
+		conf.MaxSocketBufferSize = _MAX_SOCKET_BUFFER_SIZE
+	}
+	if conf.MaxSocketBufferSize < 0 {
+		errs = append(errs, fmt.Errorf("max socket buffer size must be greater than zero"))
+	}
+
+	for _, size := range []struct {
+		name  string
+		value int
+	}{
+		{"read buffer size", conf.ReadBufferSize},
+		{"write buffer size", conf.WriteBufferSize},
+		{"UDP read buffer size", conf.UdpReadBufferSize},
+	} {
+		if size.value < 0 || size.value > conf.MaxSocketBufferSize {
+			errs = append(errs, fmt.Errorf("%s must be between 0 and %d", size.name, conf.MaxSocketBufferSize))
+		}
+	}
+
+	if conf.ListenBacklog < 0 {
+		errs = append(errs, fmt.Errorf("listen backlog must be greater or equal than zero"))
+	}
+	if conf.AcceptRoutines == 0 {
+		conf.AcceptRoutines = 1
+	}
+	if conf.AcceptRoutines < 0 {
+		errs = append(errs, fmt.Errorf("accept routines must be greater than zero"))
+	}
+
+	if conf.ReadBufferCount == 0 {
+		conf.ReadBufferCount = 512
+	}
+	if conf.ReadBufferCount < 2 {
+		errs = append(errs, fmt.Errorf("read buffer count must be at least 2"))
+	}
+
+	// frames received with TCP don't fill the buffers of the UDP listeners,
+	// therefore they can be as big as the interleaved format allows
+	if conf.MaxFrameSize == 0 {
+		conf.MaxFrameSize = 2048
+		conf.maxTcpFrameSize = _MAX_FRAME_SIZE
+	} else {
+		conf.maxTcpFrameSize = conf.MaxFrameSize
+	}
+	if conf.MaxFrameSize < 0 || conf.MaxFrameSize > _MAX_FRAME_SIZE {
+		errs = append(errs, fmt.Errorf("max frame size must be between 1 and %d", _MAX_FRAME_SIZE))
+	}
+
+	if conf.WriteQueueSize == 0 {
+		conf.WriteQueueSize = 512
+	}
+	if conf.WriteQueueSize < 0 {
+		errs = append(errs, fmt.Errorf("write queue size must be greater than zero"))
+	}
+	if conf.WriteQueueFullAction == "" {
+		conf.WriteQueueFullAction = "drop"
+	}
+	if conf.WriteQueueFullAction != "drop" && conf.WriteQueueFullAction != "disconnect" {
+		errs = append(errs, fmt.Errorf("unsupported write queue full action '%s'", conf.WriteQueueFullAction))
+	}
+
+	if conf.LogLevel == "" {
+		conf.LogLevel = "info"
+	}
+	if conf.LogLevel != "info" && conf.LogLevel != "debug" {
+		errs = append(errs, fmt.Errorf("unsupported log level '%s'", conf.LogLevel))
+	}
+
+	tlsMinVersion, err := parseTlsMinVersion(conf.TlsMinVersion)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	conf.tlsMinVersion = tlsMinVersion
+
+	tlsCipherSuites, err := parseTlsCipherSuites(conf.TlsCipherSuites)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	conf.tlsCipherSuites = tlsCipherSuites
+
+	if conf.LogPathsPeriod < 0 {
+		errs = append(errs, fmt.Errorf("log paths period must be positive"))
+	}
+
+	if conf.PathNotReadyStatus == 0 {
+		conf.PathNotReadyStatus = int(gortsplib.StatusNotFound)
+	}
+	switch gortsplib.StatusCode(conf.PathNotReadyStatus) {
+	case gortsplib.StatusNotFound, gortsplib.StatusSessionNotFound, gortsplib.StatusServiceUnavailable:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported path not ready status %d", conf.PathNotReadyStatus))
+	}
+
+	if conf.MaxSdpSize == 0 {
+		conf.MaxSdpSize = 65536
+	}
+	if conf.MaxSdpSize < 0 {
+		errs = append(errs, fmt.Errorf("max SDP size must be greater than zero"))
+	}
+	if conf.MaxRequestSize == 0 {
+		conf.MaxRequestSize = 262144
+	}
+	if conf.MaxRequestSize <= conf.MaxSdpSize {
+		errs = append(errs, fmt.Errorf("max request size must be greater than max SDP size"))
+	}
+	if conf.MaxHeaderCount == 0 {
+		conf.MaxHeaderCount = 64
+	}
+	if conf.MaxHeaderCount < 0 {
+		errs = append(errs, fmt.Errorf("max header count must be greater than zero"))
+	}
+	if conf.MaxHeaderSize == 0 {
+		conf.MaxHeaderSize = 8192
+	}
+	if conf.MaxHeaderSize < 0 {
+		errs = append(errs, fmt.Errorf("max header size must be greater than zero"))
+	}
+
+	if conf.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("max connections must be greater or equal than zero"))
+	}
+	if conf.MaxConnectionsPerIp < 0 {
+		errs = append(errs, fmt.Errorf("max connections per IP must be greater or equal than zero"))
+	}
+	if conf.AuthFailureThreshold < 0 {
+		errs = append(errs, fmt.Errorf("auth failure threshold must be greater or equal than zero"))
+	}
+	if conf.AuthFailureWindow == 0 {
+		conf.AuthFailureWindow = 5 * time.Minute
+	}
+	if conf.BindRetries < 0 {
+		errs = append(errs, fmt.Errorf("bind retries must be greater or equal than zero"))
+	}
+	if conf.BindRetryInterval == 0 {
+		conf.BindRetryInterval = 1 * time.Second
+	}
+	if conf.ConnectionTimeout == 0 {
+		conf.ConnectionTimeout = 10 * time.Second
+	}
+	if conf.SessionTimeout == 0 {
+		conf.SessionTimeout = 60 * time.Second
+	}
+	// the timeout is advertised in seconds
+	if conf.SessionTimeout < time.Second {
+		errs = append(errs, fmt.Errorf("session timeout must be at least 1s"))
+	}
+	if conf.ServerHeader == "" {
+		conf.ServerHeader = "rtsp-simple-server/" + Version
+	}
+	if conf.SourceRtcpReportPeriod == 0 {
+		conf.SourceRtcpReportPeriod = 5 * time.Second
+	}
+	if conf.SourceRtcpReportPeriod < 0 {
+		errs = append(errs, fmt.Errorf("source RTCP report period must be greater than zero"))
+	}
+	if conf.RtcpReportPeriod == 0 {
+		conf.RtcpReportPeriod = 5 * time.Second
+	}
+
+	if len(conf.Protocols) == 0 {
+		conf.Protocols = []string{"udp", "tcp"}
+	}
+	protocols := make(map[streamProtocol]struct{})
+	for _, proto := range conf.Protocols {
+		switch proto {
+		case "udp":
+			protocols[_STREAM_PROTOCOL_UDP] = struct{}{}
+
+		case "tcp":
+			protocols[_STREAM_PROTOCOL_TCP] = struct{}{}
+
+		default:
+			errs = append(errs, fmt.Errorf("unsupported protocol: %s", proto))
+		}
+	}
+	if len(protocols) == 0 {
+		errs = append(errs, fmt.Errorf("no protocols provided"))
+	}
+
+	if conf.ListenIp != "" {
+		conf.listenIp = net.ParseIP(conf.ListenIp)
+		if conf.listenIp == nil {
+			errs = append(errs, fmt.Errorf("unable to parse listen ip '%s'", conf.ListenIp))
+		} else if !conf.listenIp.IsUnspecified() && !isLocalIp(conf.listenIp) {
+			errs = append(errs, fmt.Errorf("listen ip '%s' is not assigned to any interface", conf.ListenIp))
+		}
+	}
+
+	if conf.ExternalIp != "" {
+		conf.externalIp = net.ParseIP(conf.ExternalIp)
+		if conf.externalIp == nil || conf.externalIp.IsUnspecified() {
+			errs = append(errs, fmt.Errorf("unable to parse external ip '%s'", conf.ExternalIp))
+		}
+	}
+
+	if conf.RtspPort == 0 {
+		conf.RtspPort = 8554
+	}
+	// UDP ports are used only when UDP is enabled
+	if _, ok := protocols[_STREAM_PROTOCOL_UDP]; ok {
+		if conf.RtpPort == 0 {
+			conf.RtpPort = 8000
+		}
+		if (conf.RtpPort % 2) != 0 {
+			errs = append(errs, fmt.Errorf("rtp port must be even"))
+		}
+		if conf.RtcpPort == 0 {
+			conf.RtcpPort = 8001
+		}
+		if conf.RtcpPort != (conf.RtpPort + 1) {
+			errs = append(errs, fmt.Errorf("rtcp and rtp ports must be consecutive"))
+		}
+	}
+
+	if len(conf.UdpDestinationIps) > 0 && !conf.AllowUdpDestination {
+		errs = append(errs, fmt.Errorf("udp destination ips can be used only when udp destinations are allowed"))
+	}
+	if conf.AllowUdpDestination && len(conf.UdpDestinationIps) == 0 {
+		errs = append(errs, fmt.Errorf("udp destinations can be allowed only if udp destination ips are set"))
+	}
+	udpDestinationIps, err := parseIpCidrList(conf.UdpDestinationIps)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	conf.udpDestinationIps = udpDestinationIps
+
+	// the RTMP listener is opened only if a port is set
+	if conf.RtmpPort < 0 || conf.RtmpPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid rtmp port %d", conf.RtmpPort))
+	}
+	if conf.RtmpPort != 0 && conf.RtmpPort == conf.RtspPort {
+		errs = append(errs, fmt.Errorf("rtmp and rtsp ports must be different"))
+	}
+
+	// the HLS server is opened only if a port is set
+	if conf.HlsPort < 0 || conf.HlsPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid hls port %d", conf.HlsPort))
+	}
+	if conf.HlsPort != 0 && (conf.HlsPort == conf.RtspPort || conf.HlsPort == conf.RtmpPort) {
+		errs = append(errs, fmt.Errorf("hls port must be different from rtsp and rtmp ports"))
+	}
+	if conf.HlsSegmentDuration == 0 {
+		conf.HlsSegmentDuration = 1 * time.Second
+	}
+	if conf.HlsSegmentDuration < 0 {
+		errs = append(errs, fmt.Errorf("hls segment duration must be greater than zero"))
+	}
+	if conf.HlsSegmentCount == 0 {
+		conf.HlsSegmentCount = 3
+	}
+	if conf.HlsSegmentCount < 0 {
+		errs = append(errs, fmt.Errorf("hls segment count must be greater than zero"))
+	}
+	if conf.SnapshotCommand != "" && conf.HlsPort == 0 {
+		errs = append(errs, fmt.Errorf("snapshots require the HLS server"))
+	}
+	if conf.SnapshotInterval == 0 {
+		conf.SnapshotInterval = 5 * time.Second
+	}
+	if conf.SnapshotInterval < 0 {
+		errs = append(errs, fmt.Errorf("snapshot interval must be greater than zero"))
+	}
+
+	if conf.Pprof {
+		if conf.PprofPort != 0 && conf.PprofAddress != "" {
+			errs = append(errs, fmt.Errorf("pprof port and pprof address can't be used together"))
+		}
+		if conf.PprofAddress == "" {
+			if conf.PprofPort == 0 {
+				conf.PprofPort = 9999
+			}
+			conf.PprofAddress = ":" + strconv.FormatInt(int64(conf.PprofPort), 10)
+		}
+		if _, err := net.ResolveTCPAddr("tcp", conf.PprofAddress); err != nil {
+			errs = append(errs, fmt.Errorf("invalid pprof address '%s': %s", conf.PprofAddress, err))
+		}
+	}
+
+	if conf.Api {
+		if conf.ApiAddress == "" {
+			conf.ApiAddress = ":9997"
+		}
+		if _, err := net.ResolveTCPAddr("tcp", conf.ApiAddress); err != nil {
+			errs = append(errs, fmt.Errorf("invalid api address '%s': %s", conf.ApiAddress, err))
+		}
+		if (conf.ApiUser == "") != (conf.ApiPass == "") {
+			errs = append(errs, fmt.Errorf("api username and password must be both provided"))
+		}
+	}
+
+	if conf.WebhookURL != "" {
+		ur, err := url.Parse(conf.WebhookURL)
+		if err != nil || (ur.Scheme != "http" && ur.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("webhook url must be an HTTP url"))
+		}
+	}
+
+	if conf.CapturePath == "" {
+		conf.CapturePath = "./captures/%path/%Y-%m-%d_%H-%M-%S.pcap"
+	}
+
+	if len(conf.Paths) == 0 {
+		if conf.DisableDefaultPath {
+			errs = append(errs, fmt.Errorf("no paths provided, and the default path is disabled"))
+		}
+
+		conf.Paths = map[string]*ConfPath{
+			"all": {},
+		}
+	}
+
+	// paths are checked in order, in order to always report errors in the same order
+	var paths []string
+	for path := range conf.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		pconf := conf.Paths[path]
+
+		if pconf.Source == "" {
+			pconf.Source = "record"
+		}
+
+		var err error
+		pconf.regexp, err = compilePathPattern(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': invalid pattern: %s", path, err))
+		}
+		if pconf.regexp != nil && path != "all" {
+			conf.pathPatterns = append(conf.pathPatterns, path)
+		}
+
+		if err := checkCredential(pconf.PublishUser, true); err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': publish username: %s", path, err))
+		}
+		if err := checkCredential(pconf.PublishPass, false); err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': publish password: %s", path, err))
+		}
+		pconf.publishIps, err = parseIpCidrList(pconf.PublishIps)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': %s", path, err))
+		}
+
+		if pconf.ReadUser != "" && pconf.ReadPass == "" || pconf.ReadUser == "" && pconf.ReadPass != "" {
+			errs = append(errs, fmt.Errorf("path '%s': read username and password must be both filled", path))
+		}
+		if err := checkCredential(pconf.ReadUser, true); err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': read username: %s", path, err))
+		}
+		if err := checkCredential(pconf.ReadPass, false); err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': read password: %s", path, err))
+		}
+		pconf.readIps, err = parseIpCidrList(pconf.ReadIps)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': %s", path, err))
+		}
+
+		pconf.payloadTypeMap, err = parsePayloadTypeMap(pconf.PayloadTypeMap)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': %s", path, err))
+		}
+
+		pconf.sdpAttributes, err = parseSdpAttributes(pconf.SdpAttributes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("path '%s': %s", path, err))
+		}
+
+		if pconf.ReadTcpBatchWindow < 0 {
+			errs = append(errs, fmt.Errorf("path '%s': read TCP batch window must be greater or equal than zero", path))
+		}
+		if pconf.ReadTcpBatchSize == 0 {
+			pconf.ReadTcpBatchSize = 16384
+		}
+		if pconf.ReadTcpBatchSize < 0 {
+			errs = append(errs, fmt.Errorf("path '%s': read TCP batch size must be greater than zero", path))
+		}
+
+		if pconf.ReadDropPolicy == "" {
+			pconf.ReadDropPolicy = "simple"
+		}
+		if pconf.ReadDropPolicy != "simple" && pconf.ReadDropPolicy != "smart" {
+			errs = append(errs, fmt.Errorf("path '%s': unsupported read drop policy '%s'", path, pconf.ReadDropPolicy))
+		}
+
+		if pconf.ReadWaitFirstFrame < 0 {
+			errs = append(errs, fmt.Errorf("path '%s': read wait first frame must be greater or equal than zero", path))
+		}
+
+		if pconf.GopCacheSize < 0 {
+			errs = append(errs, fmt.Errorf("path '%s': GOP cache size must be greater or equal than zero", path))
+		}
+
+		if pconf.MaxSessionDuration < 0 {
+			errs = append(errs, fmt.Errorf("path '%s': max session duration must be greater or equal than zero", path))
+		}
+
+		if pconf.PublishBitrateAction == "" {
+			pconf.PublishBitrateAction = "warn"
+		}
+		if pconf.PublishBitrateAction != "warn" && pconf.PublishBitrateAction != "disconnect" {
+			errs = append(errs, fmt.Errorf("path '%s': unsupported publish bitrate action '%s'", path, pconf.PublishBitrateAction))
+		}
+
+		if pconf.Record {
+			if pconf.RecordPath == "" {
+				pconf.RecordPath = "./recordings/%path/%Y-%m-%d_%H-%M-%S"
+			}
+			if pconf.RecordSegmentDuration == 0 {
+				pconf.RecordSegmentDuration = 1 * time.Hour
+			}
+			if pconf.RecordSegmentDuration < 0 || pconf.RecordDeleteAfter < 0 {
+				errs = append(errs, fmt.Errorf("path '%s': record durations must be positive", path))
+			}
+		}
+
+		if pconf.ExternalAuthURL != "" {
+			ur, err := url.Parse(pconf.ExternalAuthURL)
+			if err != nil || (ur.Scheme != "http" && ur.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("path '%s': external authentication url must be an HTTP url", path))
+			}
+		}
+
+		if pconf.PublishMode == "" {
+			pconf.PublishMode = "single"
+		}
+		if pconf.PublishMode != "single" && pconf.PublishMode != "failover" {
+			errs = append(errs, fmt.Errorf("path '%s': unsupported publish mode '%s'", path, pconf.PublishMode))
+		}
+
+		for key := range pconf.Labels {
+			if key == "" || strings.ContainsAny(key, " \t\r\n=,") {
+				errs = append(errs, fmt.Errorf("path '%s': invalid label '%s'", path, key))
+			}
+		}
+
+		if pconf.PublisherReconnectGrace < 0 {
+			errs = append(errs, fmt.Errorf("path '%s': publisher reconnect grace must be greater or equal than zero", path))
+		}
+
+		if pconf.SourceProtocol == "" {
+			pconf.SourceProtocol = conf.SourceProtocol
+
+			// the stream of RTSPS sources is read inside the encrypted connection
+			if strings.HasPrefix(pconf.Source, "rtsps://") {
+				pconf.SourceProtocol = "tcp"
+			}
+		}
+		if pconf.SourceProtocol != "udp" && pconf.SourceProtocol != "tcp" && pconf.SourceProtocol != "auto" {
+			errs = append(errs, fmt.Errorf("path '%s': unsupported source protocol '%s'", path, pconf.SourceProtocol))
+		}
+
+		if pconf.Source == "redirect" {
+			if pconf.regexp != nil {
+				errs = append(errs, fmt.Errorf("path '%s' is a pattern and cannot be redirected", path))
+			}
+
+			ur, err := url.Parse(pconf.SourceRedirect)
+			if err != nil || ur.Scheme != "rtsp" || ur.Host == "" {
+				errs = append(errs, fmt.Errorf("path '%s': source redirect '%s' is not a valid RTSP url", path, pconf.SourceRedirect))
+			}
+
+		} else if pconf.Source != "record" {
+			if pconf.regexp != nil {
+				errs = append(errs, fmt.Errorf("path '%s' is a pattern and cannot have a RTSP source", path))
+			}
+
+			ur, err := url.Parse(pconf.Source)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("path '%s': source is not a valid url", path))
+			} else if (ur.Scheme != "rtsp" && ur.Scheme != "rtsps") || ur.Host == "" {
+				errs = append(errs, fmt.Errorf("path '%s': source '%s' is not a valid RTSP url", path, redactUrl(ur)))
+			}
+
+			if err == nil {
+				user, pass := pconf.SourceUser, pconf.SourcePass
+				if ur.User != nil {
+					if user != "" || pass != "" {
+						errs = append(errs, fmt.Errorf("path '%s': credentials can't be provided both in the source url and in sourceUser / sourcePass", path))
+					}
+					user = ur.User.Username()
+					pass, _ = ur.User.Password()
+				}
+				if (user == "") != (pass == "") {
+					errs = append(errs, fmt.Errorf("path '%s': source username and password must be both provided", path))
+				}
+			}
+
+			if err == nil && ur.Scheme == "rtsps" && pconf.SourceProtocol != "tcp" {
+				errs = append(errs, fmt.Errorf("path '%s': RTSPS sources can be pulled only with the tcp protocol", path))
+			}
+
+			if err == nil && (pconf.SourceFingerprint != "" || pconf.SourceInsecureSkipVerify) && ur.Scheme != "rtsps" {
+				errs = append(errs, fmt.Errorf("path '%s': source fingerprint and source insecure skip verify can be used only with RTSPS sources", path))
+			}
+
+			if pconf.SourceFingerprint != "" {
+				if pconf.SourceInsecureSkipVerify {
+					errs = append(errs, fmt.Errorf("path '%s': source fingerprint and source insecure skip verify can't be used together", path))
+				}
+
+				// colons are allowed, in order to accept the format printed by openssl
+				fingerprint, err := hex.DecodeString(strings.ReplaceAll(pconf.SourceFingerprint, ":", ""))
+				if err != nil || len(fingerprint) != sha256.Size {
+					errs = append(errs, fmt.Errorf("path '%s': source fingerprint must be the hex encoded SHA-256 of the certificate", path))
+				}
+				pconf.sourceFingerprint = fingerprint
+			}
+
+			if pconf.SourceUserAgent == "" {
+				pconf.SourceUserAgent = "rtsp-simple-server/" + Version
+			}
+		}
+
+		if pconf.SourceOf != "" {
+			if pconf.regexp != nil {
+				errs = append(errs, fmt.Errorf("path '%s' is a pattern and cannot mirror another path", path))
+			}
+			if pconf.Source != "record" {
+				errs = append(errs, fmt.Errorf("path '%s': source and sourceOf can't be used together", path))
+			}
+			if pconf.SourceOf == path {
+				errs = append(errs, fmt.Errorf("path '%s' can't mirror itself", path))
+			}
+			if src, ok := conf.Paths[pconf.SourceOf]; ok && src.SourceOf != "" {
+				errs = append(errs, fmt.Errorf("path '%s' mirrors '%s', that is a mirror too", path, pconf.SourceOf))
+			}
+			if len(pconf.PayloadTypeMap) > 0 {
+				errs = append(errs, fmt.Errorf("path '%s': payload types of mirrors are the ones of the mirrored path", path))
+			}
+		}
+
+		if pconf.DisablePublish && pconf.DisableRead {
+			errs = append(errs, fmt.Errorf("path '%s': publishing and reading can't be both disabled", path))
+		}
+
+		pconf.SourceTranscode = strings.TrimSpace(pconf.SourceTranscode)
+		if pconf.SourceTranscode != "" && (pconf.Source == "record" || pconf.Source == "redirect") {
+			errs = append(errs, fmt.Errorf("path '%s': source transcode can be used only with RTSP sources", path))
+		}
+	}
+
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	sort.Strings(conf.pathPatterns)
+	if _, ok := conf.Paths["all"]; ok {
+		conf.pathPatterns = append(conf.pathPatterns, "all")
+	}
+
+	return protocols, nil
+}
+
+func newProgram(sargs []string, stdin io.Reader) (*program, error) {
+	k := kingpin.New("rtsp-simple-server",
+		"rtsp-simple-server "+Version+"\n\nRTSP server.")
+
+	argVersion := k.Flag("version", "print version").Bool()
+	argCheckConfig := k.Flag("check-config", "validate the configuration and exit, without starting the server").Bool()
+	argConfPath := k.Arg("confpath", "path to a config file. The default is conf.yml. Files ending with .json or .toml are decoded as JSON or TOML. Use 'stdin' to read config from stdin, or a http:// or https:// url to download it").Default("conf.yml").String()
+
+	kingpin.MustParse(k.Parse(sargs))
+
+	if *argVersion == true {
+		fmt.Println(Version)
+		os.Exit(0)
+	}
+
+	conf, err := loadConf(*argConfPath, stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	if *argCheckConfig {
+		_, err := checkConf(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
+	p, err := newProgramFromConf(conf)
+	if err != nil {
+		return nil, err
+	}
+	p.confPath = *argConfPath
+
+	err = p.start()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// releaseListeners closes the listeners opened by start() when it fails,
+// before their routines are started.
+func (p *program) releaseListeners() {
+	if p.pprof != nil {
+		p.pprof.listener.Close()
+		p.pprof = nil
+	}
+	if p.api != nil {
+		p.api.listener.Close()
+		p.api = nil
+	}
+	p.webhook = nil
+	if p.accessLog != nil {
+		p.accessLog.close()
+		p.accessLog = nil
+	}
+	if p.udplRtp != nil {
+		p.udplRtp.nconn.Close()
+		p.udplRtp = nil
+	}
+	if p.udplRtcp != nil {
+		p.udplRtcp.nconn.Close()
+		p.udplRtcp = nil
+	}
+	if p.tcpl != nil {
+		p.tcpl.nconn.Close()
+		p.tcpl = nil
+	}
+	if p.rtmpl != nil {
+		p.rtmpl.nconn.Close()
+		p.rtmpl = nil
+	}
+	if p.hls != nil {
+		p.hls.listener.Close()
+		p.hls = nil
+	}
+}
+
+// newProgramFromConf validates the configuration and allocates a program,
+// without opening any socket or starting any goroutine.
+func newProgramFromConf(conf *Conf) (*program, error) {
+	protocols, err := checkConf(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &program{
+		conf:              conf,
+		protocols:         protocols,
+		clients:           make(map[*serverClient]struct{}),
+		rtmpPublishers:    make(map[*rtmpPublisher]struct{}),
+		publishers:        make(map[string]publisher),
+		publishMeters:     make(map[string]*bitrateMeter),
+		rtcpSenders:       make(map[string][]*rtcpSender),
+		lossMeters:        make(map[string][]*packetLossMeter),
+		udpPacers:         make(map[string][]*udpPacer),
+		rtpRewriters:      make(map[string][]*rtpRewriter),
+		gopCaches:         make(map[string]*gopCache),
+		invalidRtp:        make(map[string]*invalidRtpCount),
+		connsPerIp:        make(map[string]int),
+		authFailures:      make(map[string]*authFailures),
+		rtpInfos:          make(map[string][]*trackRtpInfo),
+		drainedPaths:      make(map[string]time.Time),
+		orphanedPaths:     make(map[string]orphanedPath),
+		standbyPublishers: make(map[string][]*serverClient),
+		recorders:         make(map[string]*recorder),
+		hlsMuxers:         make(map[string]*hlsMuxer),
+		captures:          make(map[string]*capture),
+		readyPaths:        make(map[string]struct{}),
+		firstFramePaths:   make(map[string]struct{}),
+		firstFrameWaiters: make(map[string]map[*serverClient]chan struct{}),
+		reverseDns:        newReverseDnsCache(),
+		httpAuthCache:     newExternalAuthCache(),
+		clock:             systemClock{},
+		events:            make(chan programEvent),
+		upgraded:          make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+
+	p.pathLogs = newPathLogs(p)
+
+	for path, pconf := range conf.Paths {
+		if pconf.Source == "redirect" {
+			p.publishers[path] = newSourceRedirect(pconf.SourceRedirect)
+
+		} else if pconf.Source != "record" {
+			s, err := newStreamer(p, path, pconf.Source, pconf.SourceProtocol,
+				pconf.SourceUser, pconf.SourcePass, pconf.SourceUserAgent,
+				pconf.sourceFingerprint, pconf.SourceInsecureSkipVerify, pconf.SourceTranscode)
+			if err != nil {
+				return nil, err
+			}
+
+			p.streamers = append(p.streamers, s)
+			p.publishers[path] = s
+		}
+	}
+
+	return p, nil
+}
+
+// start opens the listeners and starts the goroutines of the program.
+func (p *program) start() (err error) {
+	// the listeners opened before a failure would keep their ports in use
+	defer func() {
+		if err != nil {
+			p.releaseListeners()
+		}
+	}()
+
+	p.log("rtsp-simple-server %s", Version)
+
+	if p.conf.Pprof {
+		p.pprof, err = newPprofServer(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.conf.Api {
+		p.api, err = newApi(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.conf.WebhookURL != "" {
+		p.webhook = newWebhook(p, p.conf.WebhookURL)
+	}
+
+	if p.conf.AccessLog != "" {
+		p.accessLog, err = newAccessLog(p.conf.AccessLog)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, ok := p.protocols[_STREAM_PROTOCOL_UDP]; ok {
+		err = p.bindWithRetries("UDP/RTP", func() error {
+			var err error
+			p.udplRtp, err = newServerUdpListener(p, p.conf.RtpPort, _TRACK_FLOW_RTP)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = p.bindWithRetries("UDP/RTCP", func() error {
+			var err error
+			p.udplRtcp, err = newServerUdpListener(p, p.conf.RtcpPort, _TRACK_FLOW_RTCP)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.bindWithRetries("TCP", func() error {
+		var err error
+		p.tcpl, err = newServerTcpListener(p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.conf.RtmpPort != 0 {
+		p.rtmpl, err = newRtmpListener(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.conf.HlsPort != 0 {
+		p.hls, err = newHlsServer(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.pprof != nil {
+		go p.pprof.run()
+	}
+	if p.api != nil {
+		go p.api.run()
+	}
+	if p.webhook != nil {
+		go p.webhook.run()
+	}
+	if p.udplRtp != nil {
+		go p.udplRtp.run()
+		go p.udplRtcp.run()
+	}
+	go p.tcpl.run()
+	if p.rtmpl != nil {
+		go p.rtmpl.run()
+	}
+	if p.hls != nil {
+		go p.hls.run()
+	}
+	for _, s := range p.streamers {
+		go s.run()
+	}
+	go p.run()
+
+	if p.conf.StartupProbeTimeout > 0 && len(p.streamers) > 0 {
+		p.probeSources()
+	}
+
+	return nil
+}
+
+// probeSources waits until all the RTSP sources are ready or have failed,
+// or until startupProbeTimeout expires, and prints the state of the sources.
+func (p *program) probeSources() {
+	deadline := time.Now().Add(p.conf.StartupProbeTimeout)
+	var states map[string]sourceProbeState
+
+	for {
+		res := make(chan map[string]sourceProbeState)
+		p.events <- programEventSourcesReady{res}
+		states = <-res
+
+		readyCount := 0
+		settledCount := 0
+		for _, state := range states {
+			if state == _SOURCE_PROBE_READY {
+				readyCount++
+			}
+			if state != _SOURCE_PROBE_WAITING {
+				settledCount++
+			}
+		}
+
+		if settledCount == len(states) || !time.Now().Before(deadline) {
+			p.log("startup probe: %d of %d sources are ready", readyCount, len(states))
+			break
+		}
+
+		time.Sleep(_STARTUP_PROBE_INTERVAL)
+	}
+
+	var paths []string
+	for path := range states {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		switch states[path] {
+		case _SOURCE_PROBE_READY:
+			p.log("startup probe:   %s: ready", path)
+		case _SOURCE_PROBE_FAILED:
+			p.log("startup probe:   %s: failed", path)
+		default:
+			p.log("startup probe:   %s: not ready after %s", path, p.conf.StartupProbeTimeout)
+		}
+	}
+}
+
+// bindWithRetries opens a listener, retrying if its port is still held,
+// i.e. by a previous instance that is being restarted. Other errors can't
+// be solved by waiting, therefore they are returned immediately.
+func (p *program) bindWithRetries(label string, bind func() error) error {
+	for i := 0; ; i++ {
+		err := bind()
+		if err == nil || i >= p.conf.BindRetries || !socketIsAddrInUse(err) {
+			return err
+		}
+
+		p.log("ERR: unable to open the %s listener: %s, retrying in %s (%d/%d)",
+			label, err, p.conf.BindRetryInterval, i+1, p.conf.BindRetries)
+		time.Sleep(p.conf.BindRetryInterval)
+	}
+}
+
+func (p *program) log(format string, args ...interface{}) {
+	log.Printf("[%d/%d/%d] "+format, append([]interface{}{len(p.clients),
+		p.publisherCount, p.receiverCount}, args...)...)
+}
+
+// rejectConn refuses a connection by closing it. RTSP connections receive a
+// 503 before, that is written in a separate routine in order not to block the
+// event loop. Rejections are logged at a throttled rate.
+func (p *program) rejectConn(nconn net.Conn, isRtsp bool, reason string) {
+	go func() {
+		if isRtsp {
+			conn := gortsplib.NewConnServer(gortsplib.ConnServerConf{
+				NConn:        nconn,
+				ReadTimeout:  p.conf.ReadTimeout,
+				WriteTimeout: p.conf.WriteTimeout,
+			})
+			conn.WriteResponse(&gortsplib.Response{
+				StatusCode: gortsplib.StatusServiceUnavailable,
+				Header: gortsplib.Header{
+					"Server": []string{p.conf.ServerHeader},
+				},
+			})
+		}
+		nconn.Close()
+	}()
+
+	p.connRejectedCount += 1
+	if time.Since(p.connRejectedLastLog) >= _CONN_REJECTED_LOG_INTERVAL {
+		p.log("rejected %d %s: %s", p.connRejectedCount, func() string {
+			if p.connRejectedCount == 1 {
+				return "connection"
+			}
+			return "connections"
+		}(), reason)
+		p.connRejectedCount = 0
+		p.connRejectedLastLog = time.Now()
+	}
+}
+
+func (p *program) run() {
+	checkClientsTicker := time.NewTicker(_CHECK_CLIENTS_INTERVAL)
+	defer checkClientsTicker.Stop()
+
+	rtcpReportTicker := time.NewTicker(p.conf.RtcpReportPeriod)
+	defer rtcpReportTicker.Stop()
+
+	packetLossTicker := time.NewTicker(_PACKET_LOSS_REPORT_INTERVAL)
+	defer packetLossTicker.Stop()
+
+	// a nil channel is never selected, therefore paths are not logged
+	// when the period is zero
+	var logPathsC <-chan time.Time
+	if p.conf.LogPathsPeriod > 0 {
+		logPathsTicker := time.NewTicker(p.conf.LogPathsPeriod)
+		defer logPathsTicker.Stop()
+		logPathsC = logPathsTicker.C
+	}
+
+outer:
+	for {
+		select {
+		case rawEvt := <-p.events:
+			switch evt := rawEvt.(type) {
+			case programEventClientNew:
+				if p.conf.MaxConnections > 0 && p.connCount() >= p.conf.MaxConnections {
+					p.rejectConn(evt.nconn, true, "maximum number of connections reached")
+					continue
+				}
+
+				ip := evt.nconn.RemoteAddr().(*net.TCPAddr).IP.String()
+				if p.conf.MaxConnectionsPerIp > 0 && p.connsPerIp[ip] >= p.conf.MaxConnectionsPerIp {
+					p.rejectConn(evt.nconn, true, "maximum number of connections per IP reached by "+ip)
+					continue
+				}
+
+				c := newServerClient(p, evt.nconn)
+				p.clients[c] = struct{}{}
+				p.connsPerIp[ip] += 1
+
+			case programEventClientClose:
+				// already deleted
+				if _, ok := p.clients[evt.client]; !ok {
+					close(evt.done)
+					continue
+				}
+
+				delete(p.clients, evt.client)
+				p.logAccess(evt.client)
+				p.releaseClient(evt.client)
+
+				p.releaseConnIp(evt.client.ip())
+
+				evt.client.log("disconnected")
+				close(evt.done)
+
+			case programEventClientTeardown:
+				p.logAccess(evt.client)
+				p.releaseClient(evt.client)
+
+				// reset the client to its pre-setup state,
+				// the connection stays open and can be reused
+				evt.client.state = _CLIENT_STATE_STARTING
+				evt.client.path = ""
+				evt.client.streamSdpText = nil
+				evt.client.streamSdpParsed = nil
+				evt.client.streamProtocol = 0
+				evt.client.udpDestination = nil
+				evt.client.streamTracks = make(map[int]*track)
+				evt.client.readLimiter.reset(0, p.clock.Now())
+				evt.client.playTime = time.Time{}
+				evt.client.waitingKeyframe = false
+				evt.client.srtpKeys = nil
+				evt.client.sessionId = ""
+
+				evt.client.log("torn down")
+				close(evt.done)
+
+			case programEventClientDescribe:
+				// do not leak the stream existence and its SDP
+				// to readers that are not allowed
+				if pconf := p.findConfForPath(evt.path); pconf != nil && pconf.readIps != nil &&
+					!ipEqualOrInRange(evt.client.ip(), evt.client.zone(), pconf.readIps) {
+					evt.res <- describeRes{err: fmt.Errorf("ip '%s' not allowed", evt.client.ip())}
+					continue
+				}
+
+				pub, ok := p.publishers[p.sourcePath(evt.path)]
+				if ok {
+					if r, ok := pub.(*sourceRedirect); ok {
+						evt.res <- describeRes{redirect: r.url}
+						continue
+					}
+				}
+
+				if pconf := p.findConfForPath(evt.path); pconf != nil && pconf.DisableRead {
+					evt.res <- describeRes{err: newStatusError(gortsplib.StatusForbidden, "reading from path '%s' is disabled", evt.path)}
+					continue
+				}
+
+				if !ok || !pub.publisherIsReady() {
+					evt.res <- describeRes{}
+					continue
+				}
+
+				sdpText := pub.publisherSdpText()
+
+				// frames are remapped with the payload types of the path of the publisher
+				if pconf := p.findConfForPath(p.sourcePath(evt.path)); pconf != nil && pconf.payloadTypeMap != nil {
+					sdpText = remapSdpPayloadTypes(sdpText, pconf.payloadTypeMap)
+				}
+
+				if pconf := p.findConfForPath(evt.path); pconf != nil && pconf.sdpAttributes != nil {
+					sdpText = applySdpAttributes(sdpText, pconf.sdpAttributes)
+				}
+
+				if p.conf.externalIp != nil {
+					sdpText = sdpSetConnectionIp(sdpText, p.conf.externalIp)
+				}
+
+				// each reader receives its own keys
+				if pconf := p.findConfForPath(evt.path); pconf != nil && pconf.ReadSRTP {
+					keys := make([][]byte, len(pub.publisherSdpParsed().Medias))
+					for i := range keys {
+						key, err := newSrtpMasterKey()
+						if err != nil {
+							evt.res <- describeRes{err: &statusError{gortsplib.StatusInternalServerError, err}}
+							continue outer
+						}
+						keys[i] = key
+					}
+
+					evt.client.srtpKeys = keys
+					sdpText = srtpSdp(sdpText, keys)
+				}
+
+				evt.res <- describeRes{sdp: sdpText}
+
+			case programEventClientAnnounce:
+				// a publisher without tracks would never become ready
+				if evt.sdpParsed == nil || len(evt.sdpParsed.Medias) == 0 {
+					evt.res <- newStatusError(gortsplib.StatusBadRequest, "SDP doesn't contain any media")
+					continue
+				}
+
+				if _, ok := p.drainedPaths[evt.path]; ok {
+					evt.res <- newStatusError(gortsplib.StatusServiceUnavailable, "path '%s' is being drained", evt.path)
+					continue
+				}
+
+				if src := p.sourcePath(evt.path); src != evt.path {
+					evt.res <- newStatusError(gortsplib.StatusBadRequest, "path '%s' is a mirror of '%s' and can't be published", evt.path, src)
+					continue
+				}
+
+				if pconf := p.findConfForPath(evt.path); pconf != nil && pconf.DisablePublish {
+					evt.res <- newStatusError(gortsplib.StatusForbidden, "publishing on path '%s' is disabled", evt.path)
+					continue
+				}
+
+				if pub, ok := p.publishers[evt.path]; ok {
+					pconf := p.findConfForPath(evt.path)
+					if _, isClient := pub.(*serverClient); !isClient ||
+						pconf == nil || pconf.PublishMode != "failover" {
+						evt.res <- newStatusError(gortsplib.StatusMethodNotValidInThisState,
+							"someone is already publishing on path '%s'", evt.path)
+						continue
+					}
+
+					// the client becomes a standby publisher, that takes the place
+					// of the active one when it disconnects
+					evt.client.path = evt.path
+					evt.client.state = _CLIENT_STATE_ANNOUNCE
+					evt.client.streamSdpText = evt.sdpText
+					evt.client.streamSdpParsed = evt.sdpParsed
+					p.standbyPublishers[evt.path] = append(p.standbyPublishers[evt.path], evt.client)
+					evt.client.log("is a standby publisher on path '%s'", evt.path)
+					evt.res <- nil
+					continue
+				}
+
+				evt.client.path = evt.path
+				evt.client.state = _CLIENT_STATE_ANNOUNCE
+				evt.client.streamSdpText = evt.sdpText
+				evt.client.streamSdpParsed = evt.sdpParsed
+				p.publishers[evt.path] = evt.client
+				evt.res <- nil
+
+			case programEventClientSetupPlay:
+				// the protocol is checked by the client too, but the
+				// session must never be setup with a disabled protocol
+				if _, ok := p.protocols[evt.protocol]; !ok {
+					evt.res <- errProtocolDisabled
+					continue
+				}
+
+				if _, ok := p.drainedPaths[evt.path]; ok {
+					evt.res <- newStatusError(gortsplib.StatusServiceUnavailable, "path '%s' is being drained", evt.path)
+					continue
+				}
+
+				if pconf := p.findConfForPath(evt.path); pconf != nil && pconf.DisableRead {
+					evt.res <- newStatusError(gortsplib.StatusForbidden, "reading from path '%s' is disabled", evt.path)
+					continue
+				}
+
+				pub, ok := p.publishers[p.sourcePath(evt.path)]
+				if !ok || !pub.publisherIsReady() {
+					evt.res <- newStatusError(gortsplib.StatusCode(p.conf.PathNotReadyStatus),
+						"no one is streaming on path '%s'", evt.path)
+					continue
+				}
+
+				sdpParsed := pub.publisherSdpParsed()
+
+				if len(evt.client.streamTracks) >= len(sdpParsed.Medias) {
+					evt.res <- newStatusError(gortsplib.StatusMethodNotValidInThisState, "all the tracks have already been setup")
+					continue
+				}
+
+				// tracks are identified by the index of their media in the SDP,
+				// that is used to route frames to readers
+				trackId, err := func() (int, error) {
+					// the request url does not contain the control attribute,
+					// tracks are setup in order
+					if evt.control == "" {
+						return len(evt.client.streamTracks), nil
+					}
+
+					for i, media := range sdpParsed.Medias {
+						if media.Attributes.Value("control") == evt.control {
+							return i, nil
+						}
+					}
+					return 0, errTrackNotFound
+				}()
+				if err != nil {
+					evt.res <- err
+					continue
+				}
+
+				if _, ok := evt.client.streamTracks[trackId]; ok {
+					evt.res <- newStatusError(gortsplib.StatusMethodNotValidInThisState, "track '%s' has already been setup", evt.control)
+					continue
+				}
+
+				t := &track{
+					rtpPort:     evt.rtpPort,
+					rtcpPort:    evt.rtcpPort,
+					rtpChannel:  evt.rtpChannel,
+					rtcpChannel: evt.rtcpChannel,
+				}
+
+				pconf := p.findConfForPath(evt.path)
+				if pconf != nil && pconf.ReadSRTP != evt.srtp {
+					evt.res <- errSrtpMismatch
+					continue
+				}
+				if evt.srtp {
+					// keys are sent to the reader in the DESCRIBE response
+					if len(evt.client.srtpKeys) != len(sdpParsed.Medias) {
+						evt.res <- newStatusError(gortsplib.StatusMethodNotValidInThisState,
+							"SRTP keys have not been exchanged, DESCRIBE the stream before SETUP")
+						continue
+					}
+
+					t.srtp, err = newSrtpContext(evt.client.srtpKeys[trackId])
+					if err != nil {
+						evt.res <- &statusError{gortsplib.StatusInternalServerError, err}
+						continue
+					}
+				}
+
+				evt.client.path = evt.path
+				evt.client.streamProtocol = evt.protocol
+				evt.client.udpDestination = evt.destination
+				evt.client.streamTracks[trackId] = t
+				evt.client.state = _CLIENT_STATE_PRE_PLAY
+				evt.res <- nil
+
+			case programEventClientSetupRecord:
+				if _, ok := p.protocols[evt.protocol]; !ok {
+					evt.res <- errProtocolDisabled
+					continue
+				}
+
+				evt.client.streamProtocol = evt.protocol
+				// tracks of publishers are setup in the same order of the SDP
+				evt.client.streamTracks[len(evt.client.streamTracks)] = &track{
+					rtpPort:     evt.rtpPort,
+					rtcpPort:    evt.rtcpPort,
+					rtpChannel:  evt.rtpChannel,
+					rtcpChannel: evt.rtcpChannel,
+				}
+				evt.client.state = _CLIENT_STATE_PRE_RECORD
+				evt.res <- nil
+
+			case programEventClientPlay1:
+				// the client stopped waiting for the first frame, either because
+				// it was received or because the timeout fired
+				p.removeFirstFrameWaiter(evt.client)
+
+				path := p.sourcePath(evt.client.path)
+				pub, ok := p.publishers[path]
+				if !ok || !pub.publisherIsReady() {
+					evt.res <- play1Res{err: newStatusError(gortsplib.StatusCode(p.conf.PathNotReadyStatus),
+						"no one is streaming on path '%s'", evt.client.path)}
+					continue
+				}
+
+				// readers can receive a subset of the tracks, i.e. only the audio one
+				if len(evt.client.streamTracks) == 0 {
+					evt.res <- play1Res{err: newStatusError(gortsplib.StatusMethodNotValidInThisState, "no tracks have been setup")}
+					continue
+				}
+
+				// TCP readers receive the packets since the last keyframe, if they
+				// fit into the write queue. UDP readers would lose most of them
+				evt.client.gopReplay = nil
+				if evt.client.streamProtocol == _STREAM_PROTOCOL_TCP {
+					if g := p.gopCaches[path]; g != nil {
+						evt.client.gopReplay = g.replay(cap(evt.client.writec) - len(evt.client.writec))
+					}
+				}
+
+				var rtpInfo []playRtpInfo
+				for id, info := range p.playRtpInfo(path) {
+					if _, ok := evt.client.streamTracks[id]; ok {
+						// the stream starts with the replayed packets
+						if seq, rtpTime, ok := gopReplayRtpInfo(evt.client.gopReplay, id); ok {
+							info.seq = seq
+							info.rtpTime = rtpTime
+						}
+						rtpInfo = append(rtpInfo, info)
+					}
+				}
+
+				evt.res <- play1Res{rtpInfo: rtpInfo}
+
+			case programEventClientWaitFirstFrame:
+				path := p.sourcePath(evt.client.path)
+				_, published := p.publishers[path]
+				_, ok := p.firstFramePaths[path]
+				if !published || ok {
+					close(evt.res)
+					continue
+				}
+				waiters, ok := p.firstFrameWaiters[path]
+				if !ok {
+					waiters = make(map[*serverClient]chan struct{})
+					p.firstFrameWaiters[path] = waiters
+				}
+				waiters[evt.client] = evt.res
+
+			case programEventClientPlay2:
+				if evt.client.state != _CLIENT_STATE_PLAY {
+					p.receiverCount += 1
+				}
+				evt.client.state = _CLIENT_STATE_PLAY
+				pconf := p.findConfForPath(evt.client.path)
+				if pconf != nil {
+					// the limiter is shared with the writer routine, therefore
+					// it is reset instead of being replaced
+					evt.client.readLimiter.reset(pconf.ReadRateLimit, p.clock.Now())
+				}
+				if pconf != nil && pconf.ReadWaitKeyframe {
+					if pub, ok := p.publishers[p.sourcePath(evt.client.path)]; ok && pub.publisherIsReady() {
+						evt.client.keyframeTrackId, evt.client.waitingKeyframe = h264TrackId(pub.publisherSdpParsed())
+
+						// readers that didn't setup the video track don't wait
+						if _, ok := evt.client.streamTracks[evt.client.keyframeTrackId]; !ok {
+							evt.client.waitingKeyframe = false
+						}
+					}
+				}
+
+				// the write queue is used only by TCP readers
+				evt.client.videoDropper = nil
+				if pconf != nil && pconf.ReadDropPolicy == "smart" &&
+					evt.client.streamProtocol == _STREAM_PROTOCOL_TCP {
+					if pub, ok := p.publishers[p.sourcePath(evt.client.path)]; ok && pub.publisherIsReady() {
+						if id, ok := h264TrackId(pub.publisherSdpParsed()); ok {
+							evt.client.videoDropper = newVideoDropper(id)
+						}
+					}
+				}
+
+				// the packets are the ones advertised in the RTP-Info header
+				for _, f := range evt.client.gopReplay {
+					p.writeClientTrack(evt.client, f.trackId, _TRACK_FLOW_RTP, f.buf, nil)
+				}
+				evt.client.gopReplay = nil
+				if evt.client.startedTime.IsZero() {
+					evt.client.startedTime = p.clock.Now()
+				}
+				evt.client.playTime = p.clock.Now()
+				if p.accessLog != nil && evt.client.readStartTime.IsZero() {
+					evt.client.readStartTime = p.clock.Now()
+				}
+				evt.client.udpLastFrameTime = p.clock.Now()
+				evt.res <- nil
+
+			case programEventClientPause:
+				if evt.client.state == _CLIENT_STATE_PLAY {
+					p.receiverCount -= 1
+					evt.client.state = _CLIENT_STATE_PRE_PLAY
+				}
+				evt.client.playTime = time.Time{}
+				evt.client.waitingKeyframe = false
+				evt.res <- nil
+
+			case programEventClientRecord:
+				p.publisherCount += 1
+				evt.client.state = _CLIENT_STATE_RECORD
+				if evt.client.startedTime.IsZero() {
+					evt.client.startedTime = p.clock.Now()
+				}
+				if pub, ok := p.publishers[evt.client.path]; ok && pub == evt.client {
+					p.setPathReady(evt.client.path, true)
+					p.startRecorder(evt.client.path)
+					p.startHlsMuxer(evt.client.path)
+				}
+				evt.res <- nil
+
+			case programEventClientFrameUdp:
+				// find publisher and track id from ip and port
+				cl, trackId := func() (*serverClient, int) {
+					findTrack := func(cl *serverClient) int {
+						if cl.streamProtocol != _STREAM_PROTOCOL_UDP ||
+							cl.state != _CLIENT_STATE_RECORD ||
+							!cl.hasUdpAddr(evt.addr) {
+							return -1
+						}
+
+						for i, t := range cl.streamTracks {
+							if evt.trackFlowType == _TRACK_FLOW_RTP {
+								if t.rtpPort == evt.addr.Port {
+									return i
+								}
+							} else {
+								if t.rtcpPort == evt.addr.Port {
+									return i
+								}
+							}
+						}
+						return -1
+					}
+
+					for _, pub := range p.publishers {
+						cl, ok := pub.(*serverClient)
+						if !ok {
+							continue
+						}
+
+						if i := findTrack(cl); i >= 0 {
+							return cl, i
+						}
+					}
+
+					for _, standbys := range p.standbyPublishers {
+						for _, cl := range standbys {
+							if i := findTrack(cl); i >= 0 {
+								return cl, i
+							}
+						}
+					}
+					return nil, -1
+				}()
+				if cl == nil {
+					// RTCP receiver reports of UDP readers are not forwarded,
+					// but they prove that the readers are still alive
+					if evt.trackFlowType == _TRACK_FLOW_RTCP {
+						for c := range p.clients {
+							if c.state != _CLIENT_STATE_PLAY ||
+								c.streamProtocol != _STREAM_PROTOCOL_UDP ||
+								!c.hasUdpAddr(evt.addr) {
+								continue
+							}
+
+							for _, t := range c.streamTracks {
+								if t.rtcpPort == evt.addr.Port {
+									c.udpLastFrameTime = p.clock.Now()
+								}
+							}
+						}
+					}
+					continue
+				}
+
+				cl.udpLastFrameTime = p.clock.Now()
+				if evt.trackFlowType == _TRACK_FLOW_RTP {
+					cl.streamTracks[trackId].addFrame(cl.udpLastFrameTime, len(evt.buf))
+				}
+
+				// frames of standby publishers are not forwarded
+				if pub := p.publishers[cl.path]; pub != cl {
+					continue
+				}
+
+				p.forwardTrack(cl.path, trackId, evt.trackFlowType, evt.buf)
+
+			case programEventClientFrameTcp:
+				if t, ok := evt.client.streamTracks[evt.trackId]; ok && evt.trackFlowType == _TRACK_FLOW_RTP {
+					t.addFrame(p.clock.Now(), len(evt.buf))
+				}
+
+				// frames of standby publishers are not forwarded
+				if pub, ok := p.publishers[evt.path]; !ok || pub != evt.client {
+					continue
+				}
+
+				p.forwardTrack(evt.path, evt.trackId, evt.trackFlowType, evt.buf)
+
+			case programEventStreamerReady:
+				// streamers replaced by a reload are ignored
+				if pub, ok := p.publishers[evt.streamer.path]; !ok || pub != evt.streamer {
+					continue
+				}
+
+				evt.streamer.ready = true
+				evt.streamer.failed = false
+				evt.streamer.publishedSdpText = evt.sdpText
+				evt.streamer.publishedSdpParsed = evt.sdpParsed
+				p.publisherCount += 1
+				evt.streamer.log("ready")
+				p.setPathReady(evt.streamer.path, true)
+				p.startRecorder(evt.streamer.path)
+				p.startHlsMuxer(evt.streamer.path)
+
+			case programEventStreamerNotReady:
+				if pub, ok := p.publishers[evt.streamer.path]; !ok || pub != evt.streamer {
+					continue
+				}
+
+				p.streamerNotReady(evt.streamer)
+
+			case programEventStreamerFailed:
+				evt.streamer.failed = true
+
+			case programEventStreamerFrame:
+				if pub, ok := p.publishers[evt.streamer.path]; !ok || pub != evt.streamer {
+					continue
+				}
+
+				p.forwardTrack(evt.streamer.path, evt.trackId, evt.trackFlowType, evt.buf)
+
+			case programEventRtmpNew:
+				if p.conf.MaxConnections > 0 && p.connCount() >= p.conf.MaxConnections {
+					p.rejectConn(evt.nconn, false, "maximum number of connections reached")
+					continue
+				}
+
+				ip := evt.nconn.RemoteAddr().(*net.TCPAddr).IP.String()
+				if p.conf.MaxConnectionsPerIp > 0 && p.connsPerIp[ip] >= p.conf.MaxConnectionsPerIp {
+					p.rejectConn(evt.nconn, false, "maximum number of connections per IP reached by "+ip)
+					continue
+				}
+
+				s := newRtmpPublisher(p, evt.nconn)
+				p.rtmpPublishers[s] = struct{}{}
+				p.connsPerIp[ip] += 1
+
+			case programEventRtmpPublish:
+				if _, ok := p.drainedPaths[evt.path]; ok {
+					evt.res <- newStatusError(gortsplib.StatusServiceUnavailable, "path '%s' is being drained", evt.path)
+					continue
+				}
+
+				if src := p.sourcePath(evt.path); src != evt.path {
+					evt.res <- newStatusError(gortsplib.StatusBadRequest, "path '%s' is a mirror of '%s' and can't be published", evt.path, src)
+					continue
+				}
+
+				if pconf := p.findConfForPath(evt.path); pconf != nil && pconf.DisablePublish {
+					evt.res <- newStatusError(gortsplib.StatusForbidden, "publishing on path '%s' is disabled", evt.path)
+					continue
+				}
+
+				if _, ok := p.publishers[evt.path]; ok {
+					evt.res <- newStatusError(gortsplib.StatusMethodNotValidInThisState,
+						"someone is already publishing on path '%s'", evt.path)
+					continue
+				}
+
+				evt.publisher.path = evt.path
+				p.publishers[evt.path] = evt.publisher
+				evt.res <- nil
+
+			case programEventRtmpReady:
+				evt.publisher.ready = true
+				p.publisherCount += 1
+				p.setPathReady(evt.publisher.path, true)
+				p.startRecorder(evt.publisher.path)
+				p.startHlsMuxer(evt.publisher.path)
+
+			case programEventRtmpFrame:
+				p.forwardTrack(evt.publisher.path, evt.trackId, _TRACK_FLOW_RTP, evt.buf)
+
+			case programEventRtmpClose:
+				// already deleted
+				if _, ok := p.rtmpPublishers[evt.publisher]; !ok {
+					close(evt.done)
+					continue
+				}
+
+				delete(p.rtmpPublishers, evt.publisher)
+				p.releaseRtmpPublisher(evt.publisher)
+
+				evt.publisher.log("disconnected")
+				close(evt.done)
+
+			case programEventApiHealth:
+				ready := true
+				for _, s := range p.streamers {
+					if !s.ready {
+						ready = false
+						break
+					}
+				}
+				evt.res <- apiHealthRes{live: true, ready: ready}
+
+			case programEventApiSdp:
+				pub, ok := p.publishers[p.sourcePath(evt.path)]
+				if !ok {
+					evt.res <- apiSdpRes{}
+					continue
+				}
+
+				// redirects don't have a stream
+				if _, ok := pub.(*sourceRedirect); ok {
+					evt.res <- apiSdpRes{}
+					continue
+				}
+
+				if !pub.publisherIsReady() {
+					evt.res <- apiSdpRes{found: true}
+					continue
+				}
+
+				evt.res <- apiSdpRes{found: true, sdp: pub.publisherSdpText()}
+
+			case programEventApiState:
+				evt.res <- p.apiState()
+
+			case programEventReloadPath:
+				evt.res <- p.reloadPath(evt.path, evt.pconf, evt.force)
+
+			case programEventExportPaths:
+				evt.res <- p.exportPaths()
+
+			case programEventImportPaths:
+				evt.res <- p.importPaths(evt.paths)
+
+			case programEventSourcesReady:
+				states := make(map[string]sourceProbeState)
+				for _, s := range p.streamers {
+					switch {
+					case s.ready:
+						states[s.path] = _SOURCE_PROBE_READY
+					case s.failed:
+						states[s.path] = _SOURCE_PROBE_FAILED
+					default:
+						states[s.path] = _SOURCE_PROBE_WAITING
+					}
+				}
+				evt.res <- states
+
+			case programEventStartCapture:
+				// frames are forwarded with the path of the source
+				path := p.sourcePath(evt.path)
+				if _, ok := p.captures[path]; ok {
+					evt.res <- apiCaptureRes{err: errCaptureRunning}
+					continue
+				}
+
+				c, err := newCapture(p, path, evt.duration, evt.maxSize)
+				if err != nil {
+					evt.res <- apiCaptureRes{err: err}
+					continue
+				}
+				p.captures[path] = c
+				evt.res <- apiCaptureRes{fpath: c.fpath}
+
+			case programEventDrainPath:
+				if evt.drain {
+					p.drainedPaths[evt.path] = p.clock.Now().Add(evt.grace)
+					p.log("path '%s' is being drained, clients will be closed in %s", evt.path, evt.grace)
+				} else {
+					delete(p.drainedPaths, evt.path)
+					p.log("path '%s' is not drained anymore", evt.path)
+				}
+				evt.res <- nil
+
+			case programEventKickClient:
+				found := false
+				for c := range p.clients {
+					// the session id is filled before the first SETUP reaches the program
+					if (len(c.streamTracks) > 0 && c.sessionId == evt.id) ||
+						c.conn.NetConn().RemoteAddr().String() == evt.id {
+						c.log("kicked through the API")
+						go c.close()
+						found = true
+					}
+				}
+				evt.res <- found
+
+			case programEventAuthFailure:
+				p.addAuthFailure(evt.ip)
+
+			case programEventAuthLocked:
+				evt.res <- p.isLockedOut(evt.ip)
+
+			case programEventUpgrade:
+				p.upgrade()
+
+			case programEventUpgradeReady:
+				p.upgradeReady(evt.err)
+
+			case programEventTerminate:
+				break outer
+			}
+
+		case <-checkClientsTicker.C:
+			p.checkClients()
+			p.expireAuthFailures()
+			p.expireCaptures()
+
+			if p.handedOff && p.connCount() == 0 {
+				p.handedOff = false
+				p.log("all connections closed after the upgrade, exiting")
+				close(p.upgraded)
+			}
+
+		case <-rtcpReportTicker.C:
+			p.sendRtcpReports()
+
+		case <-packetLossTicker.C:
+			p.reportPacketLoss()
+
+		case <-logPathsC:
+			p.logPaths()
+		}
+	}
+
+	go func() {
+		for rawEvt := range p.events {
+			switch evt := rawEvt.(type) {
+			case programEventClientNew:
+				evt.nconn.Close()
+
+			case programEventClientClose:
+				close(evt.done)
+
+			case programEventClientTeardown:
+				close(evt.done)
+
+			case programEventClientDescribe:
+				evt.res <- describeRes{}
+
+			case programEventClientAnnounce:
+				evt.res <- errTerminated
+
+			case programEventClientSetupPlay:
+				evt.res <- errTerminated
+
+			case programEventClientSetupRecord:
+				evt.res <- errTerminated
+
+			case programEventClientPlay1:
+				evt.res <- play1Res{err: errTerminated}
+
+			case programEventClientWaitFirstFrame:
+				close(evt.res)
+
+			case programEventClientPlay2:
+				evt.res <- errTerminated
+
+			case programEventClientPause:
+				evt.res <- errTerminated
+
+			case programEventClientRecord:
+				evt.res <- errTerminated
+
+			case programEventRtmpNew:
+				evt.nconn.Close()
+
+			case programEventRtmpPublish:
+				evt.res <- errTerminated
+
+			case programEventRtmpClose:
+				close(evt.done)
+
+			case programEventApiHealth:
+				evt.res <- apiHealthRes{}
+
+			case programEventApiSdp:
+				evt.res <- apiSdpRes{}
+
+			case programEventApiState:
+				evt.res <- apiStateRes{}
+
+			case programEventReloadPath:
+				evt.res <- errTerminated
+
+			case programEventExportPaths:
+				evt.res <- nil
+
+			case programEventImportPaths:
+				evt.res <- apiImportRes{err: errTerminated}
+
+			case programEventSourcesReady:
+				evt.res <- nil
+
+			case programEventStartCapture:
+				evt.res <- apiCaptureRes{err: errTerminated}
+
+			case programEventDrainPath:
+				evt.res <- errTerminated
+
+			case programEventKickClient:
+				evt.res <- false
+
+			case programEventAuthLocked:
+				evt.res <- false
+			}
+		}
+	}()
+
+	for _, s := range p.streamers {
+		s.close()
+	}
+
+	for _, r := range p.recorders {
+		r.close()
+	}
+
+	for _, c := range p.captures {
+		c.close()
+	}
+
+	for _, m := range p.hlsMuxers {
+		m.close()
+	}
+
+	if p.webhook != nil {
+		p.webhook.close()
+	}
+
+	p.tcpl.close()
+	if p.rtmpl != nil {
+		p.rtmpl.close()
+	}
+	if p.hls != nil {
+		p.hls.close()
+	}
+	if p.udplRtp != nil {
+		for _, pacers := range p.udpPacers {
+			for _, pc := range pacers {
+				pc.close()
+			}
+		}
+
+		p.udplRtcp.close()
+		p.udplRtp.close()
+	}
+
+	if p.pprof != nil {
+		p.pprof.close()
+	}
+
+	if p.api != nil {
+		p.api.close()
+	}
+
+	for c := range p.clients {
+		c.close()
+	}
+
+	for s := range p.rtmpPublishers {
+		s.close()
+	}
+
+	p.pathLogs.close()
+
+	if p.accessLog != nil {
+		p.accessLog.close()
+	}
+
+	close(p.events)
+	close(p.done)
+}
+
+// releasePath frees the resources that are associated with the stream of a
+// path, when its publisher is gone.
+func (p *program) releasePath(path string) {
+	delete(p.publishMeters, path)
+	delete(p.rtcpSenders, path)
+	delete(p.lossMeters, path)
+	delete(p.rtpInfos, path)
+	delete(p.rtpRewriters, path)
+	delete(p.gopCaches, path)
+	delete(p.invalidRtp, path)
+	p.stopRecorder(path)
+	p.stopHlsMuxer(path)
+
+	for _, pc := range p.udpPacers[path] {
+		pc.close()
+	}
+	delete(p.udpPacers, path)
+}
+
+// logAccess writes the session of a reader to the access log, when the reader
+// disconnects or tears down the session. Only the bytes that were sent or
+// enqueued are counted, dropped frames are not.
+func (p *program) logAccess(c *serverClient) {
+	if p.accessLog == nil || c.readStartTime.IsZero() {
+		return
+	}
+
+	var bytes uint64
+	for _, t := range c.streamTracks {
+		bytes += t.bytes
+	}
+
+	p.accessLog.write(c.ip().String(), c.path, c.readStartTime,
+		p.clock.Now().Sub(c.readStartTime), bytes)
+	c.readStartTime = time.Time{}
+}
+
+// releaseClient removes the client from the publishers, if it was publishing,
+// from the readers that wait for the first frame and from the publisher and
+// receiver counts.
+func (p *program) releaseClient(c *serverClient) {
+	p.removeFirstFrameWaiter(c)
+
+	if c.path != "" {
+		if pub, ok := p.publishers[c.path]; ok && pub == c {
+			rewriters := p.rtpRewriters[c.path]
+
+			delete(p.publishers, c.path)
+			p.releasePath(c.path)
+
+			standby := p.promoteStandbyPublisher(c.path)
+			if standby == nil || !standby.publisherIsReady() {
+				p.setPathReady(c.path, false)
+			}
+
+			// if the publisher has disconnected and was ready
+			// close all readers that share the same path, unless
+			// a standby publisher with the same tracks took its place
+			if pub.publisherIsReady() {
+				if standby != nil && standby.publisherIsReady() &&
+					len(standby.streamSdpParsed.Medias) == len(c.streamSdpParsed.Medias) {
+					// the stream of the standby publisher continues
+					// the one of the previous publisher
+					for _, r := range rewriters {
+						r.resync = true
+					}
+					if rewriters != nil {
+						p.rtpRewriters[c.path] = rewriters
+					}
+
+				} else {
+					p.releaseReaders(c.path, len(c.streamSdpParsed.Medias), c)
+				}
+			}
+
+		} else {
+			p.removeStandbyPublisher(c)
+		}
+	}
+
+	switch c.state {
+	case _CLIENT_STATE_PLAY:
+		p.receiverCount -= 1
+
+	case _CLIENT_STATE_RECORD:
+		p.publisherCount -= 1
+	}
+}
+
+// releaseConnIp removes a closed connection from the connections of its IP.
+func (p *program) releaseConnIp(ip net.IP) {
+	key := ip.String()
+	p.connsPerIp[key] -= 1
+	if p.connsPerIp[key] == 0 {
+		delete(p.connsPerIp, key)
+	}
+}
+
+// releaseRtmpPublisher removes a RTMP publisher from the connections of its IP
+// and from the publishers, and closes the readers of its path.
+func (p *program) releaseRtmpPublisher(s *rtmpPublisher) {
+	p.releaseConnIp(s.ip())
+
+	if pub, ok := p.publishers[s.path]; !ok || pub != s {
+		return
+	}
+
+	delete(p.publishers, s.path)
+	p.releasePath(s.path)
+
+	if s.ready {
+		p.publisherCount -= 1
+		p.setPathReady(s.path, false)
+		p.releaseReaders(s.path, len(s.publisherSdpParsed().Medias), nil)
+	}
+}
+
+// releaseReaders closes the readers of a path whose publisher disconnected,
+// or keeps them waiting for a new publisher during the reconnect grace period.
+func (p *program) releaseReaders(path string, medias int, except *serverClient) {
+	if pconf := p.findConfForPath(path); pconf != nil && pconf.PublisherReconnectGrace > 0 {
+		p.orphanedPaths[path] = orphanedPath{p.clock.Now().Add(pconf.PublisherReconnectGrace), medias}
+		p.log("path '%s': publisher disconnected, readers are kept for %s",
+			path, pconf.PublisherReconnectGrace)
+		return
+	}
+
+	p.closeReaders(path, except)
+}
+
+// closeReaders closes the clients of a path, and of the paths that mirror
+// it, that are not publishing.
+func (p *program) closeReaders(path string, except *serverClient) {
+	for oc := range p.clients {
+		if oc != except && p.sourcePath(oc.path) == path && !p.isPublisher(oc) {
+			go oc.close()
+		}
+	}
+}
+
+// connCount returns the number of RTSP and RTMP connections.
+func (p *program) connCount() int {
+	return len(p.clients) + len(p.rtmpPublishers)
+}
+
+// isPublisher returns whether the client is the active or a standby
+// publisher of its path.
+func (p *program) isPublisher(c *serverClient) bool {
+	if pub, ok := p.publishers[c.path]; ok && pub == c {
+		return true
+	}
+	for _, sc := range p.standbyPublishers[c.path] {
+		if sc == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *program) removeStandbyPublisher(c *serverClient) {
+	standbys := p.standbyPublishers[c.path]
+	for i, sc := range standbys {
+		if sc == c {
+			standbys = append(standbys[:i], standbys[i+1:]...)
+			break
+		}
+	}
+
+	if len(standbys) == 0 {
+		delete(p.standbyPublishers, c.path)
+	} else {
+		p.standbyPublishers[c.path] = standbys
+	}
+}
+
+// promoteStandbyPublisher makes the oldest standby publisher of a path
+// the active one. It returns nil if there are no standby publishers.
+func (p *program) promoteStandbyPublisher(path string) *serverClient {
+	standbys := p.standbyPublishers[path]
+	if len(standbys) == 0 {
+		return nil
+	}
+
+	c := standbys[0]
+	p.removeStandbyPublisher(c)
+
+	p.publishers[path] = c
+	c.log("is now the active publisher on path '%s'", path)
+
+	if c.publisherIsReady() {
+		p.setPathReady(path, true)
+		p.startRecorder(path)
+		p.startHlsMuxer(path)
+	}
+	return c
+}
+
+// setPathReady keeps track of the paths that have a ready publisher, and
+// notifies the webhook when a path changes state.
+func (p *program) setPathReady(path string, ready bool) {
+	if _, ok := p.readyPaths[path]; ok == ready {
+		return
+	}
+
+	if ready {
+		p.readyPaths[path] = struct{}{}
+
+		// readers that were waiting can receive the new stream only if
+		// it has the same tracks of the previous one
+		if o, ok := p.orphanedPaths[path]; ok {
+			delete(p.orphanedPaths, path)
+			if len(p.publishers[path].publisherSdpParsed().Medias) == o.medias {
+				p.log("path '%s': publisher reconnected, readers resumed", path)
+			} else {
+				p.log("path '%s': publisher reconnected with different tracks", path)
+				p.closeReaders(path, nil)
+			}
+		}
+	} else {
+		delete(p.readyPaths, path)
+		delete(p.firstFramePaths, path)
+		p.releaseFirstFrameWaiters(path)
+	}
+
+	if p.webhook != nil {
+		p.webhook.push(path, ready)
+	}
+}
+
+// setFirstFrame marks that a path received a frame, releasing the readers
+// that are waiting for the first one.
+func (p *program) setFirstFrame(path string) {
+	if _, ok := p.firstFramePaths[path]; ok {
+		return
+	}
+	p.firstFramePaths[path] = struct{}{}
+	p.releaseFirstFrameWaiters(path)
+}
+
+func (p *program) releaseFirstFrameWaiters(path string) {
+	for _, res := range p.firstFrameWaiters[path] {
+		close(res)
+	}
+	delete(p.firstFrameWaiters, path)
+}
+
+func (p *program) removeFirstFrameWaiter(c *serverClient) {
+	path := p.sourcePath(c.path)
+	waiters, ok := p.firstFrameWaiters[path]
+	if !ok {
+		return
+	}
+
+	delete(waiters, c)
+	if len(waiters) == 0 {
+		delete(p.firstFrameWaiters, path)
+	}
+}
+
+// checkClients closes clients that did not start reading or publishing
+// within the connection timeout, UDP readers that stopped sending
+// RTCP receiver reports, sessions that timed out and clients of drained paths.
+// RTMP publishers are checked in the same way.
+func (p *program) checkClients() {
+	now := p.clock.Now()
+
+	for c := range p.clients {
+		if c.closing {
+			continue
+		}
+
+		if deadline, ok := p.drainedPaths[c.path]; ok && c.path != "" && !now.Before(deadline) {
+			c.log("ERR: path '%s' has been drained", c.path)
+			p.closeTimedOutClient(c)
+			continue
+		}
+
+		switch {
+		case c.startedTime.IsZero():
+			if now.Sub(c.connTime) >= p.conf.ConnectionTimeout {
+				c.log("ERR: no stream started within %s", p.conf.ConnectionTimeout)
+				p.closeTimedOutClient(c)
+			}
+
+		case c.state == _CLIENT_STATE_PLAY && c.streamProtocol == _STREAM_PROTOCOL_UDP:
+			if now.Sub(c.udpLastFrameTime) >= p.conf.ConnectionTimeout {
+				c.log("ERR: no RTCP packets received within %s", p.conf.ConnectionTimeout)
+				p.closeTimedOutClient(c)
+			}
+
+		// when streaming with TCP, the stream itself keeps the session alive
+		case c.sessionId != "" && !(c.streamProtocol == _STREAM_PROTOCOL_TCP &&
+			(c.state == _CLIENT_STATE_PLAY || c.state == _CLIENT_STATE_RECORD)):
+			lastActivity := c.sessionLastActivity
+			if c.udpLastFrameTime.After(lastActivity) {
+				lastActivity = c.udpLastFrameTime
+			}
+
+			if now.Sub(lastActivity) >= p.conf.SessionTimeout {
+				c.log("ERR: session timed out")
+				p.closeTimedOutClient(c)
+			}
+		}
+	}
+
+	for path, o := range p.orphanedPaths {
+		if !now.Before(o.deadline) {
+			p.log("path '%s': publisher did not reconnect in time", path)
+			delete(p.orphanedPaths, path)
+			p.closeReaders(path, nil)
+		}
+	}
+
+	for s := range p.rtmpPublishers {
+		if s.closing {
+			continue
+		}
+
+		if deadline, ok := p.drainedPaths[s.path]; ok && s.path != "" && !now.Before(deadline) {
+			s.log("ERR: path '%s' has been drained", s.path)
+			p.closeTimedOutRtmpPublisher(s)
+			continue
+		}
+
+		if !s.ready && now.Sub(s.connTime) >= p.conf.ConnectionTimeout {
+			s.log("ERR: no stream started within %s", p.conf.ConnectionTimeout)
+			p.closeTimedOutRtmpPublisher(s)
+		}
+	}
+}
+
+// closeTimedOutClient closes a client in the background and marks it, so that
+// the next checks don't close it again while it is still shutting down.
+func (p *program) closeTimedOutClient(c *serverClient) {
+	c.closing = true
+	go c.close()
+}
+
+func (p *program) closeTimedOutRtmpPublisher(s *rtmpPublisher) {
+	s.closing = true
+	go s.close()
+}
+
+func (p *program) findConfForPath(path string) *ConfPath {
+	p.confMutex.RLock()
+	defer p.confMutex.RUnlock()
+
+	if pconf, ok := p.conf.Paths[path]; ok {
+		return pconf
+	}
+
+	for _, pattern := range p.conf.pathPatterns {
+		pconf := p.conf.Paths[pattern]
+		if pconf.regexp.MatchString(path) {
+			return pconf
+		}
+	}
+
+	return nil
+}
+
+// sourceConfChanged checks whether two configurations of a path have different
+// sources, that require the source to be restarted.
+func sourceConfChanged(a *ConfPath, b *ConfPath) bool {
+	return a.Source != b.Source ||
+		a.SourceProtocol != b.SourceProtocol ||
+		a.SourceUser != b.SourceUser ||
+		a.SourcePass != b.SourcePass ||
+		a.SourceUserAgent != b.SourceUserAgent ||
+		a.SourceFingerprint != b.SourceFingerprint ||
+		a.SourceInsecureSkipVerify != b.SourceInsecureSkipVerify ||
+		a.SourceTranscode != b.SourceTranscode ||
+		a.SourceRedirect != b.SourceRedirect
+}
+
+// reloadPath replaces the configuration of a path. Clients that are already
+// connected keep the previous configuration. When the source changes, the
+// previous source is stopped and the new one is started, but a source that
+// is publishing is stopped only if force is set.
+func (p *program) reloadPath(path string, pconf *ConfPath, force bool) error {
+	prev, ok := p.conf.Paths[path]
+	if !ok {
+		return fmt.Errorf("path '%s' is not in the running configuration, new paths require a restart", path)
+	}
+
+	sourceChanged := sourceConfChanged(prev, pconf)
+	var s *streamer
+
+	if sourceChanged {
+		switch pub := p.publishers[path].(type) {
+		case *streamer:
+			if pub.ready && !force {
+				return fmt.Errorf("path '%s' is publishing, the source can be changed only with force", path)
+			}
+
+		case *sourceRedirect, nil:
+
+		default:
+			return fmt.Errorf("path '%s' has a connected publisher, the source can be changed only after it disconnects", path)
+		}
+
+		if pconf.Source != "record" && pconf.Source != "redirect" {
+			var err error
+			s, err = newStreamer(p, path, pconf.Source, pconf.SourceProtocol,
+				pconf.SourceUser, pconf.SourcePass, pconf.SourceUserAgent,
+				pconf.sourceFingerprint, pconf.SourceInsecureSkipVerify, pconf.SourceTranscode)
+			if err != nil {
+				return err
+			}
+		}
+
+		if pub, ok := p.publishers[path].(*streamer); ok {
+			p.stopStreamer(pub)
+		}
+		delete(p.publishers, path)
+	}
+
+	p.confMutex.Lock()
+	p.conf.Paths[path] = pconf
+	p.confMutex.Unlock()
+
+	if sourceChanged {
+		if pconf.Source == "redirect" {
+			p.publishers[path] = newSourceRedirect(pconf.SourceRedirect)
+
+		} else if s != nil {
+			p.streamers = append(p.streamers, s)
+			p.publishers[path] = s
+			go s.run()
+		}
+	}
+
+	p.log("path '%s': configuration reloaded", path)
+	return nil
+}
+
+// exportPaths returns the paths that have a source or a publisher, with
+// their configuration, in order to import them into another instance.
+// Credentials are redacted.
+func (p *program) exportPaths() []apiExportedPath {
+	var paths []string
+	for path := range p.publishers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	ret := []apiExportedPath{}
+	for _, path := range paths {
+		pconf := p.findConfForPath(path)
+		if pconf == nil {
+			continue
+		}
+
+		ret = append(ret, apiExportedPath{
+			Path:  path,
+			Ready: p.publishers[path].publisherIsReady(),
+			Conf:  redactConfPath(pconf),
+		})
+	}
+	return ret
+}
+
+// importPaths adds the paths exported by another instance to the running
+// configuration, and starts their sources, in order to have them ready
+// before the traffic is moved. Paths that are already in the running
+// configuration are left untouched. Either all the paths are imported or
+// none of them.
+func (p *program) importPaths(paths map[string]*ConfPath) apiImportRes {
+	var names []string
+	for path := range paths {
+		if _, ok := p.conf.Paths[path]; ok {
+			continue
+		}
+		names = append(names, path)
+	}
+	sort.Strings(names)
+
+	// create all the sources before touching the running configuration
+	streamers := make(map[string]*streamer)
+	for _, path := range names {
+		pconf := paths[path]
+		if pconf.Source == "record" || pconf.Source == "redirect" {
+			continue
+		}
+
+		s, err := newStreamer(p, path, pconf.Source, pconf.SourceProtocol,
+			pconf.SourceUser, pconf.SourcePass, pconf.SourceUserAgent,
+			pconf.sourceFingerprint, pconf.SourceInsecureSkipVerify, pconf.SourceTranscode)
+		if err != nil {
+			return apiImportRes{imported: []string{}, err: fmt.Errorf("path '%s': %s", path, err)}
+		}
+		streamers[path] = s
+	}
+
+	res := apiImportRes{imported: []string{}}
+	for _, path := range names {
+		p.addPath(path, paths[path], streamers[path])
+		res.imported = append(res.imported, path)
+	}
+	return res
+}
+
+// addPath adds a path to the running configuration and starts its source.
+func (p *program) addPath(path string, pconf *ConfPath, s *streamer) {
+	p.confMutex.Lock()
+	p.conf.Paths[path] = pconf
+	if pconf.regexp != nil {
+		// keep the patterns sorted, with 'all' as the last one
+		var patterns []string
+		for _, pattern := range p.conf.pathPatterns {
+			if pattern != "all" {
+				patterns = append(patterns, pattern)
+			}
+		}
+		if path != "all" {
+			patterns = append(patterns, path)
+		}
+		sort.Strings(patterns)
+		if _, ok := p.conf.Paths["all"]; ok {
+			patterns = append(patterns, "all")
+		}
+		p.conf.pathPatterns = patterns
+	}
+	p.confMutex.Unlock()
+
+	if pconf.Source == "redirect" {
+		p.publishers[path] = newSourceRedirect(pconf.SourceRedirect)
+
+	} else if s != nil {
+		p.streamers = append(p.streamers, s)
+		p.publishers[path] = s
+		go s.run()
+	}
+
+	p.log("path '%s': imported", path)
+}
+
+// streamerNotReady is called when a streamer stops publishing.
+func (p *program) streamerNotReady(s *streamer) {
+	s.ready = false
+	p.publisherCount -= 1
+	p.releasePath(s.path)
+	p.setPathReady(s.path, false)
+	s.log("not ready")
+
+	// readers wait for the source to reconnect like they wait for publishers
+	p.releaseReaders(s.path, len(s.publisherSdpParsed().Medias), nil)
+}
+
+// stopStreamer removes a streamer from the program and closes it in
+// background, since it can be sending events to the program.
+func (p *program) stopStreamer(s *streamer) {
+	for i, other := range p.streamers {
+		if other == s {
+			p.streamers = append(p.streamers[:i], p.streamers[i+1:]...)
+			break
+		}
+	}
+
+	if s.ready {
+		p.streamerNotReady(s)
+	}
+
+	go s.close()
+}
+
+// upgrade starts a new instance of the server, that inherits the RTSP
+// listener. This instance keeps accepting connections until the new one
+// signals that it is ready.
+func (p *program) upgrade() {
+	if p.upgrading || p.handedOff {
+		p.log("ERR: upgrade already in progress")
+		return
+	}
+
+	// the new instance would wait for the UDP ports, that are released
+	// only when this instance exits, and would never be ready
+	if _, ok := p.protocols[_STREAM_PROTOCOL_UDP]; ok {
+		p.log("ERR: upgrade failed: the UDP protocol must be disabled")
+		return
+	}
+
+	f, err := p.tcpl.file()
+	if err != nil {
+		p.log("ERR: upgrade failed: %s", err)
+		return
+	}
+	defer f.Close()
+
+	pid, ready, err := startUpgradedProcess(f)
+	if err != nil {
+		p.log("ERR: upgrade failed: %s", err)
+		return
+	}
+
+	p.upgrading = true
+	p.log("upgrade started, waiting for the new instance with pid %d to be ready", pid)
+
+	go func() {
+		p.events <- programEventUpgradeReady{<-ready}
+	}()
+}
+
+// upgradeReady is called when the new instance is ready, or has failed to
+// start. In the first case, new connections are left to the new instance,
+// while the existing ones are served by this instance until they are closed.
+func (p *program) upgradeReady(err error) {
+	p.upgrading = false
+
+	if err != nil {
+		p.log("ERR: upgrade failed: %s", err)
+		return
+	}
+
+	p.tcpl.stopAccepting()
+	p.handedOff = true
+	p.log("upgrade completed, waiting for %d connection(s) to close", p.connCount())
+}
+
+// addAuthFailure counts a failed authentication of an IP, and locks it out
+// when the threshold is reached within the window.
+func (p *program) addAuthFailure(ip net.IP) {
+	if p.conf.AuthFailureThreshold == 0 {
+		return
+	}
+
+	now := p.clock.Now()
+	key := ip.String()
+	f, ok := p.authFailures[key]
+	if !ok || now.Sub(f.first) >= p.conf.AuthFailureWindow {
+		f = &authFailures{first: now}
+		p.authFailures[key] = f
+	}
+
+	f.count += 1
+	if f.count >= p.conf.AuthFailureThreshold && f.lockedUntil.IsZero() {
+		f.lockedUntil = now.Add(p.conf.AuthFailureWindow)
+		p.log("ip '%s' is locked out for %s after %d failed authentications",
+			key, p.conf.AuthFailureWindow, f.count)
+	}
+}
+
+// authLockedOut returns whether an IP is locked out, after the delay that
+// slows down brute force. It is called by the routines of the clients of
+// every protocol.
+func (p *program) authLockedOut(ip net.IP) bool {
+	if p.conf.AuthFailureThreshold == 0 {
+		return false
+	}
+
+	res := make(chan bool)
+	p.events <- programEventAuthLocked{res, ip}
+	if !<-res {
+		return false
+	}
+
+	time.Sleep(_AUTH_LOCKOUT_DELAY)
+	return true
+}
+
+// isLockedOut returns whether an IP is locked out.
+func (p *program) isLockedOut(ip net.IP) bool {
+	f, ok := p.authFailures[ip.String()]
+	return ok && p.clock.Now().Before(f.lockedUntil)
+}
+
+// expireAuthFailures removes the failed authentications that are older
+// than the window, and the lockouts that ended.
+func (p *program) expireAuthFailures() {
+	now := p.clock.Now()
+	for ip, f := range p.authFailures {
+		if now.Sub(f.first) >= p.conf.AuthFailureWindow && !now.Before(f.lockedUntil) {
+			delete(p.authFailures, ip)
+		}
+	}
+}
+
+// sourcePath returns the path whose stream is read through the given path,
+// that is the mirrored path if the path has sourceOf.
+func (p *program) sourcePath(path string) string {
+	p.confMutex.RLock()
+	defer p.confMutex.RUnlock()
+
+	if pconf, ok := p.conf.Paths[path]; ok && pconf.SourceOf != "" {
+		return pconf.SourceOf
+	}
+	return path
+}
+
+func (p *program) close() {
+	p.events <- programEventTerminate{}
+	<-p.done
+}
+
+// checkPublishBitrate measures the bitrate of the publisher of a path and
+// reports or disconnects it when it exceeds the maximum allowed.
+func (p *program) checkPublishBitrate(path string, n int) {
+	pconf := p.findConfForPath(path)
+	if pconf == nil || pconf.PublishBitrateMax == 0 {
+		return
+	}
+
+	now := p.clock.Now()
+
+	m, ok := p.publishMeters[path]
+	if !ok {
+		m = newBitrateMeter(now)
+		p.publishMeters[path] = m
+	}
+
+	bitrate := m.add(now, n)
+	if bitrate <= pconf.PublishBitrateMax ||
+		now.Sub(m.lastReport) < _BITRATE_REPORT_INTERVAL {
+		return
+	}
+	m.lastReport = now
+
+	switch pub := p.publishers[path].(type) {
+	case *serverClient:
+		pub.log("ERR: bitrate of %d kbit/s exceeds the maximum of %d kbit/s",
+			bitrate, pconf.PublishBitrateMax)
+		if pconf.PublishBitrateAction == "disconnect" {
+			go pub.close()
+		}
+
+	case *rtmpPublisher:
+		pub.log("ERR: bitrate of %d kbit/s exceeds the maximum of %d kbit/s",
+			bitrate, pconf.PublishBitrateMax)
+		if pconf.PublishBitrateAction == "disconnect" {
+			go pub.close()
+		}
+
+	// sources can't be disconnected, since they would reconnect anyway
+	case *streamer:
+		pub.log("ERR: bitrate of %d kbit/s exceeds the maximum of %d kbit/s",
+			bitrate, pconf.PublishBitrateMax)
+	}
+}
+
+// rtcpSenderForTrack returns the RTCP sender report generator of a track,
+// or nil if the generation is disabled for the path.
+func (p *program) rtcpSenderForTrack(path string, id int) *rtcpSender {
+	senders, ok := p.rtcpSenders[path]
+	if !ok {
+		pconf := p.findConfForPath(path)
+		if pconf == nil || !pconf.GenerateRTCP {
+			return nil
+		}
+
+		pub, ok := p.publishers[path]
+		if !ok || !pub.publisherIsReady() {
+			return nil
+		}
+
+		for _, media := range pub.publisherSdpParsed().Medias {
+			senders = append(senders, newRtcpSender(mediaClockRate(&media)))
+		}
+		p.rtcpSenders[path] = senders
+	}
+
+	if id >= len(senders) {
+		return nil
+	}
+	return senders[id]
+}
+
+// rtpRewriterForTrack returns the rewriter of a track, if the path has
+// failover publishers.
+func (p *program) rtpRewriterForTrack(path string, id int) *rtpRewriter {
+	rewriters, ok := p.rtpRewriters[path]
+	if !ok {
+		pconf := p.findConfForPath(path)
+		if pconf == nil || pconf.PublishMode != "failover" {
+			return nil
+		}
+
+		pub, ok := p.publishers[path]
+		if !ok || !pub.publisherIsReady() {
+			return nil
+		}
+
+		// the SSRC is picked once per path, so that it doesn't change when
+		// publishers are replaced
+		var buf [4]byte
+		rand.Read(buf[:])
+		ssrc := binary.BigEndian.Uint32(buf[:])
+
+		for _, media := range pub.publisherSdpParsed().Medias {
+			rewriters = append(rewriters, newRtpRewriter(mediaClockRate(&media), ssrc))
+		}
+		p.rtpRewriters[path] = rewriters
+	}
+
+	if id >= len(rewriters) {
+		return nil
+	}
+	return rewriters[id]
+}
+
+func (p *program) sendRtcpReports() {
+	now := p.clock.Now()
+
+	for path, senders := range p.rtcpSenders {
+		for id, s := range senders {
+			report := s.report(now)
+			if report != nil {
+				p.writeTrack(path, id, _TRACK_FLOW_RTCP, report)
+			}
+		}
+	}
+}
+
+func (p *program) processPacketLoss(path string, id int, frame []byte) {
+	meters := p.lossMeters[path]
+	for len(meters) <= id {
+		meters = append(meters, &packetLossMeter{})
+	}
+	p.lossMeters[path] = meters
+
+	meters[id].processFrame(frame)
+}
+
+func (p *program) processRtpInfo(path string, id int, frame []byte) {
+	infos, ok := p.rtpInfos[path]
+	if !ok {
+		pub, ok := p.publishers[path]
+		if !ok || !pub.publisherIsReady() {
+			return
+		}
+
+		for _, media := range pub.publisherSdpParsed().Medias {
+			infos = append(infos, newTrackRtpInfo(mediaClockRate(&media)))
+		}
+		p.rtpInfos[path] = infos
+	}
+
+	if id >= len(infos) {
+		return
+	}
+	infos[id].processFrame(p.clock.Now(), frame)
+}
+
+// playRtpInfo returns the data needed to fill the RTP-Info header, or nil
+// if some tracks didn't receive any packet yet.
+func (p *program) playRtpInfo(path string) []playRtpInfo {
+	infos, ok := p.rtpInfos[path]
+	if !ok {
+		return nil
+	}
+
+	medias := p.publishers[path].publisherSdpParsed().Medias
+	if len(infos) != len(medias) {
+		return nil
+	}
+
+	now := p.clock.Now()
+	var ret []playRtpInfo
+
+	for i, info := range infos {
+		if !info.initialized {
+			return nil
+		}
+
+		seq, rtpTime := info.next(now)
+		ret = append(ret, playRtpInfo{
+			control: medias[i].Attributes.Value("control"),
+			seq:     seq,
+			rtpTime: rtpTime,
+		})
+	}
+	return ret
+}
+
+// reportPacketLoss logs the packet loss of the tracks that lost packets
+// since the last report.
+func (p *program) reportPacketLoss() {
+	for path, meters := range p.lossMeters {
+		for id, m := range meters {
+			perc, lost := m.reset()
+			if lost > 0 {
+				p.log("path '%s', track %d: %d packets lost (%.2f%%)", path, id, lost, perc)
+			}
+		}
+	}
+}
+
+// apiState returns the publishers and the readers that set up at least a
+// track, with the statistics of their tracks.
+func (p *program) apiState() apiStateRes {
+	res := apiStateRes{
+		Clients: []apiClientState{},
+	}
+
+	for c := range p.clients {
+		if len(c.streamTracks) == 0 {
+			continue
+		}
+
+		cs := apiClientState{
+			Id:         c.sessionId,
+			RemoteAddr: c.conn.NetConn().RemoteAddr().String(),
+			Path:       c.path,
+			State:      c.state.String(),
+			Protocol:   c.streamProtocol.String(),
+			Tracks:     []apiTrackState{},
+		}
+		if pconf := p.findConfForPath(c.path); pconf != nil {
+			cs.Labels = pconf.Labels
+		}
+
+		for id, t := range c.streamTracks {
+			ts := apiTrackState{
+				Id:      id,
+				Bytes:   t.bytes,
+				Packets: t.packets,
+			}
+			if !t.lastFrameTime.IsZero() {
+				lastFrameTime := t.lastFrameTime
+				ts.LastFrameTime = &lastFrameTime
+			}
+			cs.Tracks = append(cs.Tracks, ts)
+		}
+		sort.Slice(cs.Tracks, func(i, j int) bool {
+			return cs.Tracks[i].Id < cs.Tracks[j].Id
+		})
+
+		res.Clients = append(res.Clients, cs)
+	}
+
+	// in order to make the output stable
+	sort.Slice(res.Clients, func(i, j int) bool {
+		if res.Clients[i].Path != res.Clients[j].Path {
+			return res.Clients[i].Path < res.Clients[j].Path
+		}
+		return res.Clients[i].RemoteAddr < res.Clients[j].RemoteAddr
+	})
+
+	return res
+}
+
+// logPaths prints, for each path that has a publisher or readers, the number
+// of readers and the state of the publisher.
+func (p *program) logPaths() {
+	readers := make(map[string]int)
+	for c := range p.clients {
+		if c.state == _CLIENT_STATE_PLAY {
+			readers[c.path] += 1
+		}
+	}
+
+	var paths []string
+	for path := range p.publishers {
+		paths = append(paths, path)
+	}
+	for path := range readers {
+		if _, ok := p.publishers[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		publisher := "no publisher"
+		if pub, ok := p.publishers[path]; ok {
+			if pub.publisherIsReady() {
+				publisher = "publisher ready"
+			} else {
+				publisher = "publisher not ready"
+			}
+		}
+
+		var labels string
+		if pconf := p.findConfForPath(path); pconf != nil {
+			labels = formatLabels(pconf.Labels)
+		}
+
+		p.log("path '%s'%s: %s, %d %s", path, labels, publisher, readers[path], func() string {
+			if readers[path] == 1 {
+				return "reader"
+			}
+			return "readers"
+		}())
+	}
+}
+
+// formatLabels returns the labels of a path in the format of log lines,
+// sorted by key, or an empty string if there are no labels.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return " [" + strings.Join(pairs, " ") + "]"
+}
+
+func (p *program) startRecorder(path string) {
+	pconf := p.findConfForPath(path)
+	if pconf == nil || !pconf.Record {
+		return
+	}
+
+	// a recorder that is still running would leak its files
+	p.stopRecorder(path)
+
+	pub := p.publishers[path]
+	p.recorders[path] = newRecorder(p, path, pconf, pub.publisherSdpText(),
+		len(pub.publisherSdpParsed().Medias))
+}
+
+func (p *program) stopRecorder(path string) {
+	if r, ok := p.recorders[path]; ok {
+		r.close()
+		delete(p.recorders, path)
+	}
+}
+
+func (p *program) stopCapture(path string) {
+	if c, ok := p.captures[path]; ok {
+		// the queued packets are written in background, in order not to
+		// stall the streams
+		go c.close()
+		delete(p.captures, path)
+	}
+}
+
+// expireCaptures closes the captures whose time window has ended, that
+// would remain open if the path doesn't receive packets anymore.
+func (p *program) expireCaptures() {
+	now := p.clock.Now()
+	for path, c := range p.captures {
+		if !now.Before(c.deadline) {
+			p.stopCapture(path)
+		}
+	}
+}
+
+func (p *program) startHlsMuxer(path string) {
+	if p.hls == nil {
+		return
+	}
+
+	pconf := p.findConfForPath(path)
+	if pconf == nil {
+		return
+	}
+
+	// streams of SRTP paths must not be sent unencrypted
+	if pconf.ReadSRTP {
+		return
+	}
+
+	tracks := hlsTracksFromSdp(p.publishers[path].publisherSdpParsed())
+	if tracks.video == nil && tracks.audio == nil {
+		p.log("path '%s': HLS is disabled since the stream has no H264 or AAC track", path)
+		return
+	}
+
+	// a muxer that is still running would never be closed
+	p.stopHlsMuxer(path)
+
+	m := newHlsMuxer(p, path, tracks)
+	p.hlsMuxers[path] = m
+	p.hls.setMuxer(path, m)
+}
+
+func (p *program) stopHlsMuxer(path string) {
+	if m, ok := p.hlsMuxers[path]; ok {
+		p.hls.removeMuxer(path)
+		m.close()
+		delete(p.hlsMuxers, path)
+	}
+}
+
+// forwardTrack sends a frame of the publisher of a path to its readers and to
+// the recorder, the HLS muxer and the other consumers of the path. The frame
+// belongs to the publisher, that reuses its buffer once this function returns,
+// therefore consumers that keep the frame must copy it.
+func (p *program) forwardTrack(path string, id int, trackFlowType trackFlowType, frame []byte) {
+	// packets are captured as they are received, before being modified
+	if c, ok := p.captures[path]; ok && !c.write(p.clock.Now(), id, trackFlowType, frame) {
+		p.stopCapture(path)
+	}
+
+	if trackFlowType == _TRACK_FLOW_RTP && !p.validateRtp(path, frame) {
+		return
+	}
+
+	if r := p.rtpRewriterForTrack(path, id); r != nil {
+		if trackFlowType == _TRACK_FLOW_RTP {
+			r.processRtp(p.clock.Now(), frame)
+		} else if !r.processRtcp(frame) {
+			return
+		}
+	}
+
+	if trackFlowType == _TRACK_FLOW_RTP {
+		p.setFirstFrame(path)
+		p.checkPublishBitrate(path, len(frame))
+
+		if r, ok := p.recorders[path]; ok {
+			r.write(id, frame)
+		}
+
+		if m, ok := p.hlsMuxers[path]; ok {
+			m.write(id, frame)
+		}
+
+		p.processPacketLoss(path, id, frame)
+		p.processRtpInfo(path, id, frame)
+
+		pconf := p.findConfForPath(path)
+
+		// payload types are replaced after the frame has been recorded,
+		// since recordings use the SDP of the publisher
+		if pconf != nil && pconf.payloadTypeMap != nil {
+			remapRtpPayloadType(frame, pconf.payloadTypeMap)
+		}
+
+		if pconf != nil && pconf.UdpPacing && p.udplRtp != nil {
+			p.udpPacerForTrack(path, id).schedule(p.clock.Now(), frame)
+		}
+
+		if pconf != nil && pconf.GopCacheSize > 0 {
+			if g := p.gopCacheForPath(path, pconf); g != nil {
+				g.write(id, frame)
+			}
+		}
+	}
+
+	if s := p.rtcpSenderForTrack(path, id); s != nil {
+		// RTCP packets of the publisher are replaced by the generated ones
+		if trackFlowType == _TRACK_FLOW_RTCP {
+			return
+		}
+		s.processFrame(p.clock.Now(), frame)
+	}
+
+	p.writeTrack(path, id, trackFlowType, frame)
+}
+
+type invalidRtpCount struct {
+	count   int
+	lastLog time.Time
+}
+
+// validateRtp returns whether a RTP packet can be forwarded, when the path
+// has validateRTP enabled. Invalid packets are counted and the count is
+// logged periodically.
+func (p *program) validateRtp(path string, frame []byte) bool {
+	pconf := p.findConfForPath(path)
+	if pconf == nil || !pconf.ValidateRTP {
+		return true
+	}
+
+	err := rtpValidate(frame)
+	if err == nil {
+		return true
+	}
+
+	ic, ok := p.invalidRtp[path]
+	if !ok {
+		ic = &invalidRtpCount{}
+		p.invalidRtp[path] = ic
+	}
+
+	ic.count++
+	if time.Since(ic.lastLog) >= _INVALID_RTP_LOG_INTERVAL {
+		p.log("ERR: path '%s': %d invalid RTP packets dropped (%s)", path, ic.count, err)
+		ic.count = 0
+		ic.lastLog = time.Now()
+	}
+	return false
+}
+
+func (p *program) udpPacerForTrack(path string, id int) *udpPacer {
+	pacers := p.udpPacers[path]
+	for len(pacers) <= id {
+		pacers = append(pacers, newUdpPacer(p.udplRtp))
+	}
+	p.udpPacers[path] = pacers
+
+	return pacers[id]
+}
+
+func (p *program) gopCacheForPath(path string, pconf *ConfPath) *gopCache {
+	g, ok := p.gopCaches[path]
+	if !ok {
+		pub, ok := p.publishers[path]
+		if !ok || !pub.publisherIsReady() {
+			return nil
+		}
+
+		if id, ok := h264TrackId(pub.publisherSdpParsed()); ok {
+			g = newGopCache(pconf.GopCacheSize, id)
+		}
+		p.gopCaches[path] = g
+	}
+	return g
+}
+
+func (p *program) writeTrack(path string, id int, trackFlowType trackFlowType, frame []byte) {
+	// RTP packets sent to UDP readers are paced, when enabled
+	var pacer *udpPacer
+	if pacers := p.udpPacers[path]; trackFlowType == _TRACK_FLOW_RTP && id < len(pacers) {
+		pacer = pacers[id]
+	}
+
+	for c := range p.clients {
+		// readers of the paths that mirror the path receive the frames too
+		if (c.path == path || p.sourcePath(c.path) == path) && c.state == _CLIENT_STATE_PLAY {
+			p.writeClientTrack(c, id, trackFlowType, frame, pacer)
+		}
+	}
+}
+
+func (p *program) writeClientTrack(c *serverClient, id int, trackFlowType trackFlowType,
+	frame []byte, pacer *udpPacer) {
+	t, ok := c.streamTracks[id]
+	if !ok {
+		return
+	}
+
+	// all the tracks are withheld until the first keyframe,
+	// in order to keep them synchronized
+	if c.waitingKeyframe {
+		if id != c.keyframeTrackId || trackFlowType != _TRACK_FLOW_RTP ||
+			!rtpH264IsKeyframeStart(frame) {
+			return
+		}
+		c.waitingKeyframe = false
+	}
+
+	// when the write queue is filling up, H264 packets that are not part of
+	// keyframes are dropped first, leaving room for keyframes, audio and RTCP
+	if c.videoDropper != nil && trackFlowType == _TRACK_FLOW_RTP {
+		congested := len(c.writec) >= cap(c.writec)*_VIDEO_DROPPER_QUEUE_THRESHOLD/100
+		if c.videoDropper.drop(id, frame, congested) {
+			c.frameDropped()
+			return
+		}
+	}
+
+	// packets are encrypted with the keys of each reader
+	if s := t.srtp; s != nil {
+		var err error
+		if trackFlowType == _TRACK_FLOW_RTP {
+			frame, err = s.encryptRtp(frame)
+		} else {
+			frame, err = s.encryptRtcp(frame)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if c.streamProtocol == _STREAM_PROTOCOL_UDP {
+		// UDP frames that exceed the rate limit are dropped,
+		// TCP frames are paced by the client
+		if !c.readLimiter.allow(p.clock.Now(), len(frame)) {
+			return
+		}
+
+		ip, zone := c.udpDestinationIp()
+
+		if trackFlowType == _TRACK_FLOW_RTP {
+			addr := &net.UDPAddr{
+				IP:   ip,
+				Zone: zone,
+				Port: t.rtpPort,
+			}
+
+			if pacer != nil {
+				if !pacer.write(addr, frame) {
+					return
+				}
+			} else {
+				p.udplRtp.write(addr, frame)
+			}
+
+		} else {
+			p.udplRtcp.write(&net.UDPAddr{
+				IP:   ip,
+				Zone: zone,
+				Port: t.rtcpPort,
+			}, frame)
+		}
+
+	} else {
+		channel := t.rtpChannel
+		if trackFlowType == _TRACK_FLOW_RTCP {
+			channel = t.rtcpChannel
+		}
+
+		// dropped frames are not counted in the statistics
+		if !c.writeFrame(channel, frame) {
+			return
+		}
+	}
+
+	if trackFlowType == _TRACK_FLOW_RTP {
+		t.addFrame(p.clock.Now(), len(frame))
+	}
+
+	// the startup latency of players includes the time needed
+	// by the server to send the first frame
+	if !c.playTime.IsZero() && trackFlowType == _TRACK_FLOW_RTP {
+		c.log("first frame sent %s after PLAY", p.clock.Now().Sub(c.playTime))
+		c.playTime = time.Time{}
+	}
+}
+
+// Run is the command-line entry point: it parses the arguments, starts the
+// server and returns when the server has been replaced by a new instance.
+func Run(args []string, stdin io.Reader) error {
+	p, err := newProgram(args, stdin)
+	if err != nil {
+		return err
+	}
+
+	// the previous instance, if any, can stop accepting connections
+	notifyUpgradeReady()
+
+	upgradeC := upgradeSignal()
+	for {
+		select {
+		case <-upgradeC:
+			p.events <- programEventUpgrade{}
+
+		case <-p.upgraded:
+			p.close()
+			return nil
+		}
+	}
+}
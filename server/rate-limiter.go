@@ -0,0 +1,77 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that limits the rate of a stream, in bytes
+// per second. Bursts up to one second of data are allowed. A zero rate means
+// no limit. It is used by both the program and the writer routine of a
+// client, therefore it is protected by a mutex.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate uint64, now time.Time) *rateLimiter {
+	l := &rateLimiter{}
+	l.reset(rate, now)
+	return l
+}
+
+// reset sets a new rate and fills the bucket.
+func (l *rateLimiter) reset(rate uint64, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rate = float64(rate)
+	l.tokens = float64(rate)
+	l.last = now
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// allow returns whether n bytes can be sent now.
+func (l *rateLimiter) allow(now time.Time, n int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate == 0 {
+		return true
+	}
+
+	l.refill(now)
+
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// reserve reserves n bytes and returns how long to wait before sending them.
+func (l *rateLimiter) reserve(now time.Time, n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	l.refill(now)
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
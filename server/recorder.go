@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	_RECORDER_QUEUE_SIZE        = 1024
+	_RECORDER_DROP_LOG_INTERVAL = 5 * time.Second
+)
+
+type recorderFrame struct {
+	trackId int
+	buf     []byte
+}
+
+// recorder writes the RTP packets of a path to disk, in segments.
+// Each segment is made of a SDP file and of a file in the rtpdump format
+// for each track, that can be replayed with rtptools.
+type recorder struct {
+	p              *program
+	path           string
+	pconf          *ConfPath
+	sdpText        []byte
+	trackCount     int
+	segmentStart   time.Time
+	files          []*os.File
+	droppedCount   int
+	droppedLastLog time.Time
+
+	queue chan recorderFrame
+	done  chan struct{}
+}
+
+func newRecorder(p *program, path string, pconf *ConfPath, sdpText []byte, trackCount int) *recorder {
+	r := &recorder{
+		p:          p,
+		path:       path,
+		pconf:      pconf,
+		sdpText:    sdpText,
+		trackCount: trackCount,
+		queue:      make(chan recorderFrame, _RECORDER_QUEUE_SIZE),
+		done:       make(chan struct{}),
+	}
+
+	go r.run()
+	return r
+}
+
+func (r *recorder) log(format string, args ...interface{}) {
+	r.p.log("[recorder "+r.path+"] "+format, args...)
+}
+
+// write enqueues a RTP packet. It is called by the program event loop,
+// therefore it never blocks: packets are dropped if the disk is too slow.
+func (r *recorder) write(trackId int, buf []byte) {
+	frame := recorderFrame{trackId, append([]byte(nil), buf...)}
+
+	select {
+	case r.queue <- frame:
+	default:
+		r.droppedCount++
+		if time.Since(r.droppedLastLog) >= _RECORDER_DROP_LOG_INTERVAL {
+			r.droppedLastLog = time.Now()
+			r.log("ERR: disk is too slow, %d packets dropped", r.droppedCount)
+		}
+	}
+}
+
+func (r *recorder) close() {
+	close(r.queue)
+	<-r.done
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+	defer r.closeSegment()
+
+	for frame := range r.queue {
+		now := time.Now()
+
+		if r.files == nil || now.Sub(r.segmentStart) >= r.pconf.RecordSegmentDuration {
+			r.closeSegment()
+
+			err := r.openSegment(now)
+			if err != nil {
+				r.log("ERR: %s", err)
+				r.closeSegment()
+
+				// skip packets until the next segment
+				r.files = []*os.File{}
+				r.segmentStart = now
+				continue
+			}
+		}
+
+		if frame.trackId >= len(r.files) {
+			continue
+		}
+
+		// rtpdump packet header: length of the whole entry, length of the
+		// RTP packet, offset in milliseconds from the start of the file
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint16(header[0:2], uint16(8+len(frame.buf)))
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(frame.buf)))
+		binary.BigEndian.PutUint32(header[4:8], uint32(now.Sub(r.segmentStart)/time.Millisecond))
+
+		f := r.files[frame.trackId]
+		_, err := f.Write(append(header, frame.buf...))
+		if err != nil {
+			r.log("ERR: %s", err)
+		}
+	}
+}
+
+// sanitizePath removes the parent directory elements from a path name, that
+// is chosen by clients, in order to prevent it from escaping the directory of
+// a file path template.
+func sanitizePath(path string) string {
+	return strings.TrimPrefix(filepath.Clean("/"+path), string(filepath.Separator))
+}
+
+// formatFilePath replaces the variables of a file path template
+// (%path, %Y, %m, %d, %H, %M, %S) with the path and the time.
+func formatFilePath(tmpl string, path string, t time.Time) string {
+	return strings.NewReplacer(
+		"%path", sanitizePath(path),
+		"%Y", fmt.Sprintf("%04d", t.Year()),
+		"%m", fmt.Sprintf("%02d", t.Month()),
+		"%d", fmt.Sprintf("%02d", t.Day()),
+		"%H", fmt.Sprintf("%02d", t.Hour()),
+		"%M", fmt.Sprintf("%02d", t.Minute()),
+		"%S", fmt.Sprintf("%02d", t.Second()),
+	).Replace(tmpl)
+}
+
+// segmentBase returns the path of a segment, without extension.
+func (r *recorder) segmentBase(t time.Time) string {
+	return formatFilePath(r.pconf.RecordPath, r.path, t)
+}
+
+func (r *recorder) openSegment(now time.Time) error {
+	base := r.segmentBase(now)
+
+	err := os.MkdirAll(filepath.Dir(base), 0755)
+	if err != nil {
+		return err
+	}
+
+	r.deleteOldSegments(filepath.Dir(base), now)
+
+	err = ioutil.WriteFile(base+".sdp", r.sdpText, 0644)
+	if err != nil {
+		return err
+	}
+
+	r.segmentStart = now
+	r.files = make([]*os.File, r.trackCount)
+
+	for i := range r.files {
+		f, err := os.Create(base + "_track" + strconv.FormatInt(int64(i), 10) + ".rtpdump")
+		if err != nil {
+			return err
+		}
+		r.files[i] = f
+
+		// rtpdump file header: a text line, then the start time,
+		// the source address and port (unknown) and padding
+		header := make([]byte, 16)
+		binary.BigEndian.PutUint32(header[0:4], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(header[4:8], uint32(now.Nanosecond()/1000))
+
+		_, err = f.Write(append([]byte("#!rtpplay1.0 0.0.0.0/0\n"), header...))
+		if err != nil {
+			return err
+		}
+	}
+
+	r.log("recording to %s", base)
+	return nil
+}
+
+func (r *recorder) closeSegment() {
+	for _, f := range r.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	r.files = nil
+}
+
+// deleteOldSegments deletes the segments that are older than recordDeleteAfter.
+func (r *recorder) deleteOldSegments(dir string, now time.Time) {
+	if r.pconf.RecordDeleteAfter == 0 {
+		return
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		if info.IsDir() ||
+			(!strings.HasSuffix(info.Name(), ".rtpdump") && !strings.HasSuffix(info.Name(), ".sdp")) {
+			continue
+		}
+
+		if now.Sub(info.ModTime()) >= r.pconf.RecordDeleteAfter {
+			os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_REVERSE_DNS_TIMEOUT   = 2 * time.Second
+	_REVERSE_DNS_CACHE_TTL = 5 * time.Minute
+)
+
+type reverseDnsEntry struct {
+	hostname string
+	expire   time.Time
+}
+
+// reverseDnsCache resolves IPs into hostnames. It is used by client
+// goroutines, therefore it is protected by a mutex.
+type reverseDnsCache struct {
+	mutex   sync.Mutex
+	entries map[string]reverseDnsEntry
+}
+
+func newReverseDnsCache() *reverseDnsCache {
+	return &reverseDnsCache{
+		entries: make(map[string]reverseDnsEntry),
+	}
+}
+
+// lookup returns the hostname of an IP, or an empty string if it can't be
+// resolved. Failures are cached too, in order not to slow down reconnections.
+func (rc *reverseDnsCache) lookup(ip net.IP) string {
+	key := ip.String()
+	now := time.Now()
+
+	rc.mutex.Lock()
+	entry, ok := rc.entries[key]
+	rc.mutex.Unlock()
+	if ok && now.Before(entry.expire) {
+		return entry.hostname
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), _REVERSE_DNS_TIMEOUT)
+	defer cancel()
+
+	hostname := ""
+	names, err := net.DefaultResolver.LookupAddr(ctx, key)
+	if err == nil && len(names) > 0 {
+		hostname = strings.TrimSuffix(names[0], ".")
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	// remove expired entries, in order to limit memory usage
+	for k, e := range rc.entries {
+		if !now.Before(e.expire) {
+			delete(rc.entries, k)
+		}
+	}
+
+	rc.entries[key] = reverseDnsEntry{
+		hostname: hostname,
+		expire:   now.Add(_REVERSE_DNS_CACHE_TTL),
+	}
+	return hostname
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// rtcpReceiver generates RTCP receiver reports for a track of a RTSP source,
+// by observing the RTP packets and the RTCP sender reports received from it.
+// Some cameras stop sending the stream if they don't receive any report.
+// It is used by the listeners of the track and by the streamer.
+type rtcpReceiver struct {
+	mutex         sync.Mutex
+	clockRate     int
+	ssrc          uint32 // SSRC of the reports
+	initialized   bool
+	sourceSsrc    uint32
+	baseSeq       uint32
+	maxSeq        uint16
+	cycles        uint32 // number of wraps of the sequence number, shifted by 16 bits
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	timeBase      time.Time
+	lastTransit   int64
+	jitter        float64
+	lastSrNtp     uint32 // middle 32 bits of the NTP time of the last sender report
+	lastSrTime    time.Time
+}
+
+func newRtcpReceiver(clockRate int) *rtcpReceiver {
+	var buf [4]byte
+	rand.Read(buf[:])
+
+	return &rtcpReceiver{
+		clockRate: clockRate,
+		ssrc:      binary.BigEndian.Uint32(buf[:]),
+	}
+}
+
+func (r *rtcpReceiver) processRtp(now time.Time, frame []byte) {
+	if len(frame) < 12 {
+		return
+	}
+
+	seq := binary.BigEndian.Uint16(frame[2:4])
+	rtpTime := binary.BigEndian.Uint32(frame[4:8])
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.initialized {
+		r.initialized = true
+		r.sourceSsrc = binary.BigEndian.Uint32(frame[8:12])
+		r.baseSeq = uint32(seq)
+		r.maxSeq = seq
+		r.timeBase = now
+	} else if gap := seq - r.maxSeq; gap != 0 && gap < 0x8000 {
+		// late packets don't change the highest sequence number
+		if seq < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = seq
+	}
+	r.received++
+
+	// interarrival jitter, as described in RFC 3550, appendix A.8
+	arrival := int64(now.Sub(r.timeBase).Seconds() * float64(r.clockRate))
+	transit := arrival - int64(rtpTime)
+	if r.received > 1 {
+		d := transit - r.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+	}
+	r.lastTransit = transit
+}
+
+func (r *rtcpReceiver) processRtcp(now time.Time, frame []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// packets can be compound
+	for len(frame) >= 4 {
+		size := 4 * (int(binary.BigEndian.Uint16(frame[2:4])) + 1)
+		if size > len(frame) {
+			return
+		}
+
+		// sender report
+		if frame[1] == 200 && size >= 16 {
+			r.lastSrNtp = binary.BigEndian.Uint32(frame[10:14])
+			r.lastSrTime = now
+		}
+
+		frame = frame[size:]
+	}
+}
+
+// report returns a RTCP receiver report, or nil if no RTP packet has been
+// received yet.
+func (r *rtcpReceiver) report(now time.Time) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.initialized {
+		return nil
+	}
+
+	extMaxSeq := r.cycles + uint32(r.maxSeq)
+	expected := extMaxSeq - r.baseSeq + 1
+
+	lost := int64(expected) - int64(r.received)
+	if lost < 0 {
+		lost = 0
+	} else if lost > 0x7FFFFF {
+		lost = 0x7FFFFF
+	}
+
+	expectedInterval := expected - r.expectedPrior
+	receivedInterval := r.received - r.receivedPrior
+	r.expectedPrior = expected
+	r.receivedPrior = r.received
+
+	var fraction uint8
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+
+	// delay since the last sender report, in units of 1/65536 seconds
+	var dlsr uint32
+	if !r.lastSrTime.IsZero() {
+		dlsr = uint32(now.Sub(r.lastSrTime).Seconds() * 65536)
+	}
+
+	buf := make([]byte, 32)
+	buf[0] = 0x81                           // version 2, no padding, one reception report
+	buf[1] = 201                            // receiver report
+	binary.BigEndian.PutUint16(buf[2:4], 7) // length in 32-bit words, minus one
+	binary.BigEndian.PutUint32(buf[4:8], r.ssrc)
+	binary.BigEndian.PutUint32(buf[8:12], r.sourceSsrc)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(fraction)<<24|uint32(lost))
+	binary.BigEndian.PutUint32(buf[16:20], extMaxSeq)
+	binary.BigEndian.PutUint32(buf[20:24], uint32(r.jitter))
+	binary.BigEndian.PutUint32(buf[24:28], r.lastSrNtp)
+	binary.BigEndian.PutUint32(buf[28:32], dlsr)
+	return buf
+}
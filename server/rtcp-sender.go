@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"gortc.io/sdp"
+)
+
+const (
+	// seconds between 1900 (NTP epoch) and 1970 (UNIX epoch)
+	_NTP_EPOCH_OFFSET = 2208988800
+)
+
+// rtcpSender generates RTCP sender reports for a track, by observing the
+// RTP packets that are forwarded to readers.
+type rtcpSender struct {
+	clockRate     int
+	initialized   bool
+	ssrc          uint32
+	lastRtpTime   uint32
+	lastLocalTime time.Time
+	packetCount   uint32
+	octetCount    uint32
+}
+
+func newRtcpSender(clockRate int) *rtcpSender {
+	return &rtcpSender{
+		clockRate: clockRate,
+	}
+}
+
+// mediaClockRate returns the RTP clock rate of a media, that is read from
+// the rtpmap attribute or deduced from the static payload type.
+func mediaClockRate(media *sdp.Media) int {
+	// format is "<payload type> <encoding name>/<clock rate>[/<parameters>]"
+	rtpmap := strings.SplitN(media.Attributes.Value("rtpmap"), " ", 2)
+	if len(rtpmap) == 2 {
+		parts := strings.Split(rtpmap[1], "/")
+		if len(parts) >= 2 {
+			if rate, err := strconv.Atoi(parts[1]); err == nil && rate > 0 {
+				return rate
+			}
+		}
+	}
+
+	if len(media.Description.Formats) > 0 {
+		if pt, ok := staticPayloadTypes[media.Description.Formats[0]]; ok {
+			return pt.clockRate
+		}
+	}
+
+	return 90000
+}
+
+func (s *rtcpSender) processFrame(now time.Time, frame []byte) {
+	if len(frame) < 12 {
+		return
+	}
+
+	headerLen := 12 + 4*int(frame[0]&0x0F)
+	if len(frame) < headerLen {
+		return
+	}
+
+	s.initialized = true
+	s.ssrc = binary.BigEndian.Uint32(frame[8:12])
+	s.lastRtpTime = binary.BigEndian.Uint32(frame[4:8])
+	s.lastLocalTime = now
+	s.packetCount++
+	s.octetCount += uint32(len(frame) - headerLen)
+}
+
+// report returns a RTCP sender report, or nil if no RTP packet has been
+// received yet.
+func (s *rtcpSender) report(now time.Time) []byte {
+	if !s.initialized {
+		return nil
+	}
+
+	// the RTP time is estimated from the last received packet
+	rtpTime := s.lastRtpTime + uint32(now.Sub(s.lastLocalTime).Seconds()*float64(s.clockRate))
+
+	ntpSec := uint64(now.Unix()) + _NTP_EPOCH_OFFSET
+	ntpFrac := (uint64(now.Nanosecond()) << 32) / 1000000000
+
+	buf := make([]byte, 28)
+	buf[0] = 0x80                           // version 2, no padding, no reception reports
+	buf[1] = 200                            // sender report
+	binary.BigEndian.PutUint16(buf[2:4], 6) // length in 32-bit words, minus one
+	binary.BigEndian.PutUint32(buf[4:8], s.ssrc)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(ntpSec))
+	binary.BigEndian.PutUint32(buf[12:16], uint32(ntpFrac))
+	binary.BigEndian.PutUint32(buf[16:20], rtpTime)
+	binary.BigEndian.PutUint32(buf[20:24], s.packetCount)
+	binary.BigEndian.PutUint32(buf[24:28], s.octetCount)
+	return buf
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+)
+
+type rtmpListener struct {
+	p     *program
+	nconn *net.TCPListener
+
+	done chan struct{}
+}
+
+func newRtmpListener(p *program) (*rtmpListener, error) {
+	addr := &net.TCPAddr{
+		IP:   p.conf.listenIp,
+		Port: p.conf.RtmpPort,
+	}
+
+	nconn, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &rtmpListener{
+		p:     p,
+		nconn: nconn,
+		done:  make(chan struct{}),
+	}
+
+	l.log("opened on %s", addr)
+	return l, nil
+}
+
+func (l *rtmpListener) log(format string, args ...interface{}) {
+	l.p.log("[RTMP listener] "+format, args...)
+}
+
+func (l *rtmpListener) run() {
+	for {
+		nconn, err := l.nconn.AcceptTCP()
+		if err != nil {
+			break
+		}
+
+		l.p.events <- programEventRtmpNew{nconn}
+	}
+
+	close(l.done)
+}
+
+func (l *rtmpListener) close() {
+	l.nconn.Close()
+	<-l.done
+}
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"gortc.io/sdp"
+)
+
+const (
+	_RTMP_PUBLISH_STREAM_ID = 1
+
+	_FLV_CODEC_H264 = 7
+	_FLV_CODEC_AAC  = 10
+
+	_FLV_PACKET_SEQUENCE_HEADER = 0
+	_FLV_PACKET_DATA            = 1
+
+	_AAC_MAX_AU_SIZE = 8191 // maximum size that fits into an AU header
+)
+
+// rtmpPublisher is a publisher that receives a H264 / AAC stream with the
+// RTMP protocol, and remuxes it into RTP packets.
+type rtmpPublisher struct {
+	p         *program
+	nconn     net.Conn
+	conn      *rtmpConn
+	connTime  time.Time
+	app       string
+	path      string // filled by the program when the publish is accepted
+	ready     bool   // written by the program
+	closing   bool   // written by the program
+	sdpText   []byte
+	sdpParsed *sdp.Message
+
+	h264Sps        []byte
+	h264Pps        []byte
+	h264LengthSize int
+	aacConfigRaw   []byte
+	aacConfig      *aacConfig
+
+	// filled when the first frame is received
+	tracksReady     bool
+	videoTrackId    int
+	videoPacketizer *rtpPacketizer
+	audioTrackId    int
+	audioPacketizer *rtpPacketizer
+
+	done chan struct{}
+}
+
+func newRtmpPublisher(p *program, nconn net.Conn) *rtmpPublisher {
+	s := &rtmpPublisher{
+		p:        p,
+		nconn:    nconn,
+		conn:     newRtmpConn(nconn),
+		connTime: p.clock.Now(),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+func (s *rtmpPublisher) log(format string, args ...interface{}) {
+	format = "[RTMP client %s] " + format
+	args = append([]interface{}{s.nconn.RemoteAddr().String()}, args...)
+	s.p.log(format, args...)
+
+	if s.path != "" {
+		s.p.pathLogs.write(s.path, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *rtmpPublisher) ip() net.IP {
+	return s.nconn.RemoteAddr().(*net.TCPAddr).IP
+}
+
+func (s *rtmpPublisher) zone() string {
+	return s.nconn.RemoteAddr().(*net.TCPAddr).Zone
+}
+
+func (s *rtmpPublisher) publisherIsReady() bool {
+	return s.ready
+}
+
+func (s *rtmpPublisher) publisherSdpText() []byte {
+	return s.sdpText
+}
+
+func (s *rtmpPublisher) publisherSdpParsed() *sdp.Message {
+	return s.sdpParsed
+}
+
+func (s *rtmpPublisher) run() {
+	s.log("connected")
+
+	err := s.runInner()
+	if err != nil && err != io.EOF {
+		s.log("ERR: %s", err)
+	}
+
+	s.nconn.Close()
+
+	done := make(chan struct{})
+	s.p.events <- programEventRtmpClose{done, s}
+	<-done
+
+	close(s.done)
+}
+
+func (s *rtmpPublisher) close() {
+	s.nconn.Close()
+	<-s.done
+}
+
+func (s *rtmpPublisher) setDeadlines() {
+	s.nconn.SetReadDeadline(time.Now().Add(s.p.conf.ReadTimeout))
+	s.nconn.SetWriteDeadline(time.Now().Add(s.p.conf.WriteTimeout))
+}
+
+func (s *rtmpPublisher) runInner() error {
+	s.setDeadlines()
+	err := s.conn.handshake()
+	if err != nil {
+		return err
+	}
+
+	for {
+		s.setDeadlines()
+		msg, err := s.conn.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch msg.typ {
+		case _RTMP_MSG_COMMAND_AMF0, _RTMP_MSG_COMMAND_AMF3:
+			err := s.handleCommand(msg)
+			if err != nil {
+				return err
+			}
+
+		case _RTMP_MSG_VIDEO:
+			if s.path == "" {
+				continue
+			}
+
+			err := s.processVideo(msg)
+			if err != nil {
+				return err
+			}
+
+		case _RTMP_MSG_AUDIO:
+			if s.path == "" {
+				continue
+			}
+
+			err := s.processAudio(msg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *rtmpPublisher) handleCommand(msg *rtmpMessage) error {
+	payload := msg.payload
+
+	// AMF3 commands start with a format selector, followed by AMF0 values
+	if msg.typ == _RTMP_MSG_COMMAND_AMF3 {
+		if len(payload) < 1 {
+			return fmt.Errorf("invalid AMF3 command")
+		}
+		payload = payload[1:]
+	}
+
+	vals, err := amf0Decode(payload)
+	if err != nil {
+		return err
+	}
+
+	if len(vals) < 2 {
+		return fmt.Errorf("invalid command")
+	}
+
+	name, _ := vals[0].(string)
+	txId, _ := vals[1].(float64)
+
+	switch name {
+	case "connect":
+		if len(vals) >= 3 {
+			if obj, ok := vals[2].(amf0Object); ok {
+				s.app = strings.Trim(strings.Split(obj.getString("app"), "?")[0], "/")
+			}
+		}
+		return s.handleConnect(txId)
+
+	case "createStream":
+		return s.conn.writeCommand(0, "_result", txId, nil, float64(_RTMP_PUBLISH_STREAM_ID))
+
+	case "publish":
+		if s.path != "" {
+			return fmt.Errorf("stream is already being published")
+		}
+
+		raw := ""
+		if len(vals) >= 4 {
+			raw, _ = vals[3].(string)
+		}
+		return s.handlePublish(raw)
+
+	case "play":
+		s.writeStatus("error", "NetStream.Play.Failed", "reading with RTMP is not supported")
+		return fmt.Errorf("reading with RTMP is not supported")
+
+	case "deleteStream", "closeStream", "FCUnpublish":
+		return io.EOF
+	}
+
+	// other commands, like releaseStream and FCPublish, don't require
+	// a response
+	return nil
+}
+
+func (s *rtmpPublisher) handleConnect(txId float64) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, _RTMP_WINDOW_ACK_SIZE)
+	err := s.conn.writeMessage(_RTMP_CSID_CONTROL, &rtmpMessage{
+		typ:     _RTMP_MSG_WINDOW_ACK_SIZE,
+		payload: buf,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the limit type is dynamic
+	buf = make([]byte, 5)
+	binary.BigEndian.PutUint32(buf, _RTMP_WINDOW_ACK_SIZE)
+	buf[4] = 2
+	err = s.conn.writeMessage(_RTMP_CSID_CONTROL, &rtmpMessage{
+		typ:     _RTMP_MSG_SET_PEER_BANDWIDTH,
+		payload: buf,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.conn.writeSetChunkSize(_RTMP_WRITE_CHUNK_SIZE)
+	if err != nil {
+		return err
+	}
+
+	return s.conn.writeCommand(0, "_result", txId,
+		amf0Object{
+			{"fmsVer", "FMS/3,0,1,123"},
+			{"capabilities", float64(31)},
+		},
+		amf0Object{
+			{"level", "status"},
+			{"code", "NetConnection.Connect.Success"},
+			{"description", "Connection succeeded."},
+			{"objectEncoding", float64(0)},
+		})
+}
+
+func (s *rtmpPublisher) writeStatus(level string, code string, description string) error {
+	return s.conn.writeCommand(_RTMP_PUBLISH_STREAM_ID, "onStatus", float64(0), nil,
+		amf0Object{
+			{"level", level},
+			{"code", code},
+			{"description", description},
+		})
+}
+
+// handlePublish validates the publish request. The path is the application
+// followed by the stream name, while credentials can be passed in the query
+// of the stream name (i.e. "mystream?user=myuser&pass=mypass").
+func (s *rtmpPublisher) handlePublish(raw string) error {
+	err := func() error {
+		name := raw
+		var query url.Values
+		if i := strings.Index(raw, "?"); i >= 0 {
+			name = raw[:i]
+
+			var err error
+			query, err = url.ParseQuery(raw[i+1:])
+			if err != nil {
+				return fmt.Errorf("invalid stream name '%s'", raw)
+			}
+		}
+
+		path := strings.Trim(s.app+"/"+name, "/")
+		if path == "" {
+			return fmt.Errorf("path can't be empty")
+		}
+
+		pconf := s.p.findConfForPath(path)
+		if pconf == nil {
+			return fmt.Errorf("unable to find a valid configuration for path '%s'", path)
+		}
+
+		if pconf.publishIps != nil && !ipEqualOrInRange(s.ip(), s.zone(), pconf.publishIps) {
+			return fmt.Errorf("ip '%s' not allowed", s.ip())
+		}
+
+		if (pconf.PublishUser != "" || pconf.ExternalAuthURL != "") && s.p.authLockedOut(s.ip()) {
+			return fmt.Errorf("ip '%s' is locked out after too many failed authentications", s.ip())
+		}
+
+		user := query.Get("user")
+		pass := query.Get("pass")
+
+		if pconf.PublishUser != "" && !credentialsMatch(user, pass, pconf.PublishUser, pconf.PublishPass) {
+			s.p.events <- programEventAuthFailure{s.ip()}
+			return fmt.Errorf("unauthorized")
+		}
+
+		if pconf.ExternalAuthURL != "" {
+			err := externalAuth(pconf.ExternalAuthURL, externalAuthReq{
+				Ip:       s.ip().String(),
+				User:     user,
+				Password: pass,
+				Path:     path,
+				Action:   "publish",
+			})
+			if err != nil {
+				if user != "" {
+					s.p.events <- programEventAuthFailure{s.ip()}
+				}
+				return fmt.Errorf("unauthorized: %s", err)
+			}
+		}
+
+		res := make(chan error)
+		s.p.events <- programEventRtmpPublish{res, s, path}
+		return <-res
+	}()
+	if err != nil {
+		s.writeStatus("error", "NetStream.Publish.BadName", err.Error())
+		return err
+	}
+
+	// stream begin
+	err = s.conn.writeMessage(_RTMP_CSID_CONTROL, &rtmpMessage{
+		typ:     _RTMP_MSG_USER_CONTROL,
+		payload: []byte{0x00, 0x00, 0x00, 0x00, 0x00, _RTMP_PUBLISH_STREAM_ID},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.writeStatus("status", "NetStream.Publish.Start", "publishing")
+	if err != nil {
+		return err
+	}
+
+	s.log("is publishing on path '%s'", s.path)
+	return nil
+}
+
+// parseAvcConfig reads the SPS and the PPS from an AVCDecoderConfigurationRecord.
+func (s *rtmpPublisher) parseAvcConfig(buf []byte) error {
+	if len(buf) < 6 {
+		return fmt.Errorf("invalid H264 configuration")
+	}
+
+	lengthSize := int(buf[4]&0x03) + 1
+	if lengthSize == 3 {
+		return fmt.Errorf("invalid H264 NALU length size")
+	}
+
+	readParams := func(count int, pos int) ([]byte, int, error) {
+		var first []byte
+		for i := 0; i < count; i++ {
+			if len(buf) < pos+2 {
+				return nil, 0, fmt.Errorf("invalid H264 configuration")
+			}
+			n := int(binary.BigEndian.Uint16(buf[pos:]))
+			pos += 2
+
+			if len(buf) < pos+n {
+				return nil, 0, fmt.Errorf("invalid H264 configuration")
+			}
+			if first == nil {
+				first = append([]byte(nil), buf[pos:pos+n]...)
+			}
+			pos += n
+		}
+		return first, pos, nil
+	}
+
+	sps, pos, err := readParams(int(buf[5]&0x1F), 6)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) < pos+1 {
+		return fmt.Errorf("invalid H264 configuration")
+	}
+	pps, _, err := readParams(int(buf[pos]), pos+1)
+	if err != nil {
+		return err
+	}
+
+	if len(sps) < 4 || len(pps) == 0 {
+		return fmt.Errorf("H264 configuration doesn't contain SPS and PPS")
+	}
+
+	s.h264Sps = sps
+	s.h264Pps = pps
+	s.h264LengthSize = lengthSize
+	return nil
+}
+
+// parseAacConfig reads the sample rate and the channel count from an
+// AudioSpecificConfig.
+func (s *rtmpPublisher) parseAacConfig(buf []byte) error {
+	conf, err := aacParseConfig(buf)
+	if err != nil {
+		return err
+	}
+
+	s.aacConfigRaw = append([]byte(nil), buf...)
+	s.aacConfig = conf
+	return nil
+}
+
+// setupTracks generates the SDP and makes the stream ready. It is called when
+// the first frame is received, since at that point the configurations of all
+// the tracks have been sent by the publisher.
+func (s *rtmpPublisher) setupTracks() error {
+	if s.tracksReady || (s.h264Sps == nil && s.aacConfig == nil) {
+		return nil
+	}
+
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=Stream",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+	}
+	trackId := 0
+
+	s.videoTrackId = -1
+	if s.h264Sps != nil {
+		s.videoTrackId = trackId
+		s.videoPacketizer = newRtpPacketizer(96)
+		lines = append(lines,
+			"m=video 0 RTP/AVP 96",
+			"a=rtpmap:96 H264/90000",
+			"a=fmtp:96 packetization-mode=1; sprop-parameter-sets="+
+				base64.StdEncoding.EncodeToString(s.h264Sps)+","+
+				base64.StdEncoding.EncodeToString(s.h264Pps)+
+				"; profile-level-id="+strings.ToUpper(hex.EncodeToString(s.h264Sps[1:4])),
+			"a=control:trackID="+strconv.Itoa(trackId))
+		trackId++
+	}
+
+	s.audioTrackId = -1
+	if s.aacConfig != nil {
+		s.audioTrackId = trackId
+		s.audioPacketizer = newRtpPacketizer(97)
+		lines = append(lines,
+			"m=audio 0 RTP/AVP 97",
+			"a=rtpmap:97 mpeg4-generic/"+strconv.Itoa(s.aacConfig.sampleRate)+"/"+strconv.Itoa(s.aacConfig.channelCount),
+			"a=fmtp:97 profile-level-id=1; mode=AAC-hbr; sizelength=13; indexlength=3; indexdeltalength=3; config="+
+				hex.EncodeToString(s.aacConfigRaw),
+			"a=control:trackID="+strconv.Itoa(trackId))
+	}
+
+	sdpText := []byte(strings.Join(lines, "\r\n") + "\r\n")
+	sdpParsed, err := gortsplib.SDPParse(sdpText)
+	if err != nil {
+		return err
+	}
+
+	if pconf := s.p.findConfForPath(s.path); pconf != nil && len(pconf.AllowedCodecs) > 0 {
+		for _, media := range sdpParsed.Medias {
+			for _, codec := range mediaCodecs(&media) {
+				if !func() bool {
+					for _, allowed := range pconf.AllowedCodecs {
+						if strings.EqualFold(codec, allowed) {
+							return true
+						}
+					}
+					return false
+				}() {
+					return fmt.Errorf("codec '%s' is not allowed", codec)
+				}
+			}
+		}
+	}
+
+	s.sdpText = sdpText
+	s.sdpParsed = sdpParsed
+	s.tracksReady = true
+
+	s.p.events <- programEventRtmpReady{s}
+	return nil
+}
+
+func (s *rtmpPublisher) writeFrames(trackId int, pkts [][]byte) {
+	for _, pkt := range pkts {
+		s.p.events <- programEventRtmpFrame{s, trackId, pkt}
+	}
+}
+
+func (s *rtmpPublisher) processVideo(msg *rtmpMessage) error {
+	// frame type and codec, packet type, composition time
+	if len(msg.payload) < 5 {
+		return fmt.Errorf("invalid video message")
+	}
+
+	if codec := msg.payload[0] & 0x0F; codec != _FLV_CODEC_H264 {
+		return fmt.Errorf("unsupported video codec %d, only H264 is supported", codec)
+	}
+
+	switch msg.payload[1] {
+	case _FLV_PACKET_SEQUENCE_HEADER:
+		// the SDP can't be changed after the stream is ready
+		if s.tracksReady {
+			return nil
+		}
+		return s.parseAvcConfig(msg.payload[5:])
+
+	case _FLV_PACKET_DATA:
+		err := s.setupTracks()
+		if err != nil {
+			return err
+		}
+
+		if s.videoPacketizer == nil {
+			return nil
+		}
+
+		var nalus [][]byte
+		buf := msg.payload[5:]
+		for len(buf) > 0 {
+			if len(buf) < s.h264LengthSize {
+				return fmt.Errorf("invalid H264 NALU")
+			}
+
+			n := 0
+			for i := 0; i < s.h264LengthSize; i++ {
+				n = n<<8 | int(buf[i])
+			}
+			buf = buf[s.h264LengthSize:]
+
+			if n > len(buf) {
+				return fmt.Errorf("invalid H264 NALU size")
+			}
+			nalus = append(nalus, buf[:n])
+			buf = buf[n:]
+		}
+
+		// the composition time is a signed 24 bit integer
+		cts := int32(rtmpUint24(msg.payload[2:])<<8) >> 8
+		ts := uint32((int64(msg.timestamp) + int64(cts)) * 90)
+
+		s.writeFrames(s.videoTrackId, s.videoPacketizer.packetizeH264(nalus, ts))
+	}
+
+	return nil
+}
+
+func (s *rtmpPublisher) processAudio(msg *rtmpMessage) error {
+	// format, rate, size and type, packet type
+	if len(msg.payload) < 2 {
+		return fmt.Errorf("invalid audio message")
+	}
+
+	if codec := msg.payload[0] >> 4; codec != _FLV_CODEC_AAC {
+		return fmt.Errorf("unsupported audio codec %d, only AAC is supported", codec)
+	}
+
+	switch msg.payload[1] {
+	case _FLV_PACKET_SEQUENCE_HEADER:
+		if s.tracksReady {
+			return nil
+		}
+		return s.parseAacConfig(msg.payload[2:])
+
+	case _FLV_PACKET_DATA:
+		err := s.setupTracks()
+		if err != nil {
+			return err
+		}
+
+		au := msg.payload[2:]
+		if s.audioPacketizer == nil || len(au) == 0 || len(au) > _AAC_MAX_AU_SIZE {
+			return nil
+		}
+
+		ts := uint32(int64(msg.timestamp) * int64(s.aacConfig.sampleRate) / 1000)
+
+		s.writeFrames(s.audioTrackId, s.audioPacketizer.packetizeAac(au, ts))
+	}
+
+	return nil
+}
@@ -0,0 +1,631 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+)
+
+const (
+	_RTMP_VERSION            = 3
+	_RTMP_HANDSHAKE_SIZE     = 1536
+	_RTMP_DEFAULT_CHUNK_SIZE = 128
+	_RTMP_WRITE_CHUNK_SIZE   = 4096
+	_RTMP_WINDOW_ACK_SIZE    = 2500000
+	_RTMP_MAX_MESSAGE_SIZE   = 4 * 1024 * 1024
+	_RTMP_MAX_CHUNK_STREAMS  = 64
+)
+
+// message types
+const (
+	_RTMP_MSG_SET_CHUNK_SIZE     = 1
+	_RTMP_MSG_ABORT              = 2
+	_RTMP_MSG_ACK                = 3
+	_RTMP_MSG_USER_CONTROL       = 4
+	_RTMP_MSG_WINDOW_ACK_SIZE    = 5
+	_RTMP_MSG_SET_PEER_BANDWIDTH = 6
+	_RTMP_MSG_AUDIO              = 8
+	_RTMP_MSG_VIDEO              = 9
+	_RTMP_MSG_DATA_AMF3          = 15
+	_RTMP_MSG_COMMAND_AMF3       = 17
+	_RTMP_MSG_DATA_AMF0          = 18
+	_RTMP_MSG_COMMAND_AMF0       = 20
+)
+
+// chunk stream ids of the messages sent by the server
+const (
+	_RTMP_CSID_CONTROL = 2
+	_RTMP_CSID_COMMAND = 3
+)
+
+// AMF0 markers
+const (
+	_AMF0_NUMBER       = 0x00
+	_AMF0_BOOLEAN      = 0x01
+	_AMF0_STRING       = 0x02
+	_AMF0_OBJECT       = 0x03
+	_AMF0_NULL         = 0x05
+	_AMF0_UNDEFINED    = 0x06
+	_AMF0_ECMA_ARRAY   = 0x08
+	_AMF0_OBJECT_END   = 0x09
+	_AMF0_STRICT_ARRAY = 0x0A
+	_AMF0_DATE         = 0x0B
+	_AMF0_LONG_STRING  = 0x0C
+
+	_AMF0_MAX_DEPTH = 16
+)
+
+type rtmpMessage struct {
+	typ       uint8
+	streamId  uint32
+	timestamp uint32 // in milliseconds
+	payload   []byte
+}
+
+// rtmpChunkStream contains the state of a chunk stream, since chunk headers
+// can omit the fields that didn't change since the previous chunk.
+type rtmpChunkStream struct {
+	timestamp       uint32
+	delta           uint32
+	length          uint32
+	typ             uint8
+	streamId        uint32
+	hasExtTimestamp bool
+	buf             []byte // message being received
+}
+
+// rtmpCountReader counts the bytes read from a connection, in order to send
+// acknowledgements.
+type rtmpCountReader struct {
+	r io.Reader
+	n uint32
+}
+
+func (r *rtmpCountReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += uint32(n)
+	return n, err
+}
+
+// rtmpConn implements the chunk stream of the RTMP protocol, on the server
+// side. It is used by a single routine.
+type rtmpConn struct {
+	nconn          net.Conn
+	cr             *rtmpCountReader
+	br             *bufio.Reader
+	bw             *bufio.Writer
+	readChunkSize  uint32
+	writeChunkSize uint32
+	chunkStreams   map[uint32]*rtmpChunkStream
+	windowAckSize  uint32
+	lastAck        uint32
+}
+
+func newRtmpConn(nconn net.Conn) *rtmpConn {
+	cr := &rtmpCountReader{r: nconn}
+
+	return &rtmpConn{
+		nconn:          nconn,
+		cr:             cr,
+		br:             bufio.NewReaderSize(cr, 4096),
+		bw:             bufio.NewWriterSize(nconn, 4096),
+		readChunkSize:  _RTMP_DEFAULT_CHUNK_SIZE,
+		writeChunkSize: _RTMP_DEFAULT_CHUNK_SIZE,
+		chunkStreams:   make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+// handshake performs the simple handshake, that doesn't involve any digest.
+func (c *rtmpConn) handshake() error {
+	c0c1 := make([]byte, 1+_RTMP_HANDSHAKE_SIZE)
+	_, err := io.ReadFull(c.br, c0c1)
+	if err != nil {
+		return err
+	}
+
+	if c0c1[0] != _RTMP_VERSION {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+
+	// S1 contains a zero time, a zero field and random data,
+	// while S2 is a copy of C1
+	s0s1s2 := make([]byte, 1+2*_RTMP_HANDSHAKE_SIZE)
+	s0s1s2[0] = _RTMP_VERSION
+	rand.Read(s0s1s2[9 : 1+_RTMP_HANDSHAKE_SIZE])
+	copy(s0s1s2[1+_RTMP_HANDSHAKE_SIZE:], c0c1[1:])
+
+	_, err = c.nconn.Write(s0s1s2)
+	if err != nil {
+		return err
+	}
+
+	c2 := make([]byte, _RTMP_HANDSHAKE_SIZE)
+	_, err = io.ReadFull(c.br, c2)
+	return err
+}
+
+func rtmpUint24(buf []byte) uint32 {
+	return uint32(buf[0])<<16 | uint32(buf[1])<<8 | uint32(buf[2])
+}
+
+func rtmpPutUint24(buf []byte, v uint32) {
+	buf[0] = byte(v >> 16)
+	buf[1] = byte(v >> 8)
+	buf[2] = byte(v)
+}
+
+// readMessage reads the next message. Protocol control messages are
+// processed here and are not returned.
+func (c *rtmpConn) readMessage() (*rtmpMessage, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.writeAckIfNeeded()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.typ {
+		case _RTMP_MSG_SET_CHUNK_SIZE:
+			if len(msg.payload) != 4 {
+				return nil, fmt.Errorf("invalid set chunk size message")
+			}
+
+			size := binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF
+			if size == 0 {
+				return nil, fmt.Errorf("invalid chunk size %d", size)
+			}
+			c.readChunkSize = size
+
+		case _RTMP_MSG_ABORT:
+			if len(msg.payload) != 4 {
+				return nil, fmt.Errorf("invalid abort message")
+			}
+
+			if cs, ok := c.chunkStreams[binary.BigEndian.Uint32(msg.payload)]; ok {
+				cs.buf = nil
+			}
+
+		case _RTMP_MSG_WINDOW_ACK_SIZE:
+			if len(msg.payload) != 4 {
+				return nil, fmt.Errorf("invalid window acknowledgement size message")
+			}
+			c.windowAckSize = binary.BigEndian.Uint32(msg.payload)
+
+		case _RTMP_MSG_ACK, _RTMP_MSG_USER_CONTROL, _RTMP_MSG_SET_PEER_BANDWIDTH:
+
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// readChunk reads a chunk. It returns a message when the chunk is the last
+// one of the message, otherwise nil.
+func (c *rtmpConn) readChunk() (*rtmpMessage, error) {
+	b0, err := c.br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	typ := b0 >> 6
+	csid := uint32(b0 & 0x3F)
+
+	switch csid {
+	case 0:
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b)
+
+	case 1:
+		var buf [2]byte
+		_, err := io.ReadFull(c.br, buf[:])
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(buf[0]) + uint32(buf[1])*256
+	}
+
+	cs, ok := c.chunkStreams[csid]
+	if !ok {
+		if len(c.chunkStreams) >= _RTMP_MAX_CHUNK_STREAMS {
+			return nil, fmt.Errorf("too many chunk streams")
+		}
+		cs = &rtmpChunkStream{}
+		c.chunkStreams[csid] = cs
+	}
+
+	readTimestamp := func(v uint32) (uint32, error) {
+		cs.hasExtTimestamp = (v == 0xFFFFFF)
+		if !cs.hasExtTimestamp {
+			return v, nil
+		}
+
+		var buf [4]byte
+		_, err := io.ReadFull(c.br, buf[:])
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint32(buf[:]), nil
+	}
+
+	var header [11]byte
+
+	switch typ {
+	case 0:
+		_, err := io.ReadFull(c.br, header[:11])
+		if err != nil {
+			return nil, err
+		}
+
+		cs.length = rtmpUint24(header[3:])
+		cs.typ = header[6]
+		cs.streamId = binary.LittleEndian.Uint32(header[7:])
+
+		ts, err := readTimestamp(rtmpUint24(header[:]))
+		if err != nil {
+			return nil, err
+		}
+
+		// the following chunks of type 3 use the timestamp as delta
+		cs.timestamp = ts
+		cs.delta = ts
+		cs.buf = nil
+
+	case 1:
+		_, err := io.ReadFull(c.br, header[:7])
+		if err != nil {
+			return nil, err
+		}
+
+		cs.length = rtmpUint24(header[3:])
+		cs.typ = header[6]
+
+		cs.delta, err = readTimestamp(rtmpUint24(header[:]))
+		if err != nil {
+			return nil, err
+		}
+		cs.timestamp += cs.delta
+		cs.buf = nil
+
+	case 2:
+		_, err := io.ReadFull(c.br, header[:3])
+		if err != nil {
+			return nil, err
+		}
+
+		cs.delta, err = readTimestamp(rtmpUint24(header[:]))
+		if err != nil {
+			return nil, err
+		}
+		cs.timestamp += cs.delta
+		cs.buf = nil
+
+	default:
+		// the extended timestamp is repeated in all the chunks
+		if cs.hasExtTimestamp {
+			var buf [4]byte
+			_, err := io.ReadFull(c.br, buf[:])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// a new message that reuses the header of the previous one
+		if cs.buf == nil {
+			cs.timestamp += cs.delta
+		}
+	}
+
+	if cs.length > _RTMP_MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("message size (%d) exceeds the maximum (%d)", cs.length, _RTMP_MAX_MESSAGE_SIZE)
+	}
+
+	if cs.buf == nil {
+		cs.buf = make([]byte, 0, cs.length)
+	}
+
+	n := cs.length - uint32(len(cs.buf))
+	if n > c.readChunkSize {
+		n = c.readChunkSize
+	}
+
+	pos := len(cs.buf)
+	cs.buf = cs.buf[:pos+int(n)]
+	_, err = io.ReadFull(c.br, cs.buf[pos:])
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32(len(cs.buf)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &rtmpMessage{
+		typ:       cs.typ,
+		streamId:  cs.streamId,
+		timestamp: cs.timestamp,
+		payload:   cs.buf,
+	}
+	cs.buf = nil
+	return msg, nil
+}
+
+func (c *rtmpConn) writeAckIfNeeded() error {
+	if c.windowAckSize == 0 || (c.cr.n-c.lastAck) < c.windowAckSize {
+		return nil
+	}
+	c.lastAck = c.cr.n
+
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, c.cr.n)
+	return c.writeMessage(_RTMP_CSID_CONTROL, &rtmpMessage{
+		typ:     _RTMP_MSG_ACK,
+		payload: buf,
+	})
+}
+
+// writeMessage writes a message, splitting it into chunks.
+func (c *rtmpConn) writeMessage(csid uint8, msg *rtmpMessage) error {
+	var header [12]byte
+	header[0] = csid
+	rtmpPutUint24(header[1:], msg.timestamp)
+	rtmpPutUint24(header[4:], uint32(len(msg.payload)))
+	header[7] = msg.typ
+	binary.LittleEndian.PutUint32(header[8:], msg.streamId)
+	c.bw.Write(header[:])
+
+	pos := 0
+	for {
+		n := len(msg.payload) - pos
+		if n > int(c.writeChunkSize) {
+			n = int(c.writeChunkSize)
+		}
+
+		c.bw.Write(msg.payload[pos : pos+n])
+		pos += n
+
+		if pos >= len(msg.payload) {
+			break
+		}
+
+		// continuation chunk
+		c.bw.WriteByte(0xC0 | csid)
+	}
+
+	return c.bw.Flush()
+}
+
+// writeSetChunkSize changes the chunk size of the messages sent by the server.
+func (c *rtmpConn) writeSetChunkSize(size uint32) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, size)
+	err := c.writeMessage(_RTMP_CSID_CONTROL, &rtmpMessage{
+		typ:     _RTMP_MSG_SET_CHUNK_SIZE,
+		payload: buf,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.writeChunkSize = size
+	return nil
+}
+
+func (c *rtmpConn) writeCommand(streamId uint32, values ...interface{}) error {
+	return c.writeMessage(_RTMP_CSID_COMMAND, &rtmpMessage{
+		typ:      _RTMP_MSG_COMMAND_AMF0,
+		streamId: streamId,
+		payload:  amf0Encode(values...),
+	})
+}
+
+// amf0Object is an AMF0 object, whose properties are kept in order.
+type amf0Object []amf0Property
+
+type amf0Property struct {
+	key   string
+	value interface{}
+}
+
+func (o amf0Object) get(key string) interface{} {
+	for _, prop := range o {
+		if prop.key == key {
+			return prop.value
+		}
+	}
+	return nil
+}
+
+func (o amf0Object) getString(key string) string {
+	v, _ := o.get(key).(string)
+	return v
+}
+
+// amf0Decode decodes all the values contained in a buffer. Numbers are
+// decoded as float64, objects and ECMA arrays as amf0Object, strict arrays
+// as []interface{}, null and undefined as nil.
+func amf0Decode(buf []byte) ([]interface{}, error) {
+	var ret []interface{}
+
+	for len(buf) > 0 {
+		v, rest, err := amf0DecodeValue(buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+		buf = rest
+	}
+
+	return ret, nil
+}
+
+func amf0DecodeString(buf []byte, lenSize int) (string, []byte, error) {
+	if len(buf) < lenSize {
+		return "", nil, fmt.Errorf("AMF0 string is too short")
+	}
+
+	var n int
+	if lenSize == 2 {
+		n = int(binary.BigEndian.Uint16(buf))
+	} else {
+		n = int(binary.BigEndian.Uint32(buf))
+	}
+	buf = buf[lenSize:]
+
+	if n < 0 || len(buf) < n {
+		return "", nil, fmt.Errorf("AMF0 string is too short")
+	}
+	return string(buf[:n]), buf[n:], nil
+}
+
+func amf0DecodeProperties(buf []byte, depth int) (amf0Object, []byte, error) {
+	var obj amf0Object
+
+	for {
+		if len(buf) >= 3 && buf[0] == 0 && buf[1] == 0 && buf[2] == _AMF0_OBJECT_END {
+			return obj, buf[3:], nil
+		}
+
+		key, rest, err := amf0DecodeString(buf, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value, rest, err := amf0DecodeValue(rest, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		obj = append(obj, amf0Property{key, value})
+		buf = rest
+	}
+}
+
+func amf0DecodeValue(buf []byte, depth int) (interface{}, []byte, error) {
+	if depth > _AMF0_MAX_DEPTH {
+		return nil, nil, fmt.Errorf("AMF0 value is too deep")
+	}
+
+	if len(buf) < 1 {
+		return nil, nil, fmt.Errorf("AMF0 value is missing")
+	}
+	marker := buf[0]
+	buf = buf[1:]
+
+	switch marker {
+	case _AMF0_NUMBER:
+		if len(buf) < 8 {
+			return nil, nil, fmt.Errorf("AMF0 number is too short")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), buf[8:], nil
+
+	case _AMF0_BOOLEAN:
+		if len(buf) < 1 {
+			return nil, nil, fmt.Errorf("AMF0 boolean is too short")
+		}
+		return buf[0] != 0, buf[1:], nil
+
+	case _AMF0_STRING:
+		return amf0DecodeString(buf, 2)
+
+	case _AMF0_LONG_STRING:
+		return amf0DecodeString(buf, 4)
+
+	case _AMF0_OBJECT:
+		return amf0DecodeProperties(buf, depth)
+
+	case _AMF0_ECMA_ARRAY:
+		// the count is not reliable, the array ends with the object end marker
+		if len(buf) < 4 {
+			return nil, nil, fmt.Errorf("AMF0 ECMA array is too short")
+		}
+		return amf0DecodeProperties(buf[4:], depth)
+
+	case _AMF0_STRICT_ARRAY:
+		if len(buf) < 4 {
+			return nil, nil, fmt.Errorf("AMF0 strict array is too short")
+		}
+		count := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+
+		var arr []interface{}
+		for i := uint32(0); i < count; i++ {
+			v, rest, err := amf0DecodeValue(buf, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+			buf = rest
+		}
+		return arr, buf, nil
+
+	case _AMF0_DATE:
+		if len(buf) < 10 {
+			return nil, nil, fmt.Errorf("AMF0 date is too short")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), buf[10:], nil
+
+	case _AMF0_NULL, _AMF0_UNDEFINED:
+		return nil, buf, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported AMF0 marker 0x%.2x", marker)
+}
+
+// amf0Encode encodes values of type float64, bool, string, amf0Object
+// and nil.
+func amf0Encode(values ...interface{}) []byte {
+	var buf []byte
+
+	var encode func(v interface{})
+	encode = func(v interface{}) {
+		switch v := v.(type) {
+		case float64:
+			buf = append(buf, _AMF0_NUMBER)
+			buf = append(buf, make([]byte, 8)...)
+			binary.BigEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(v))
+
+		case bool:
+			if v {
+				buf = append(buf, _AMF0_BOOLEAN, 1)
+			} else {
+				buf = append(buf, _AMF0_BOOLEAN, 0)
+			}
+
+		case string:
+			buf = append(buf, _AMF0_STRING, byte(len(v)>>8), byte(len(v)))
+			buf = append(buf, v...)
+
+		case amf0Object:
+			buf = append(buf, _AMF0_OBJECT)
+			for _, prop := range v {
+				buf = append(buf, byte(len(prop.key)>>8), byte(len(prop.key)))
+				buf = append(buf, prop.key...)
+				encode(prop.value)
+			}
+			buf = append(buf, 0, 0, _AMF0_OBJECT_END)
+
+		default:
+			buf = append(buf, _AMF0_NULL)
+		}
+	}
+
+	for _, v := range values {
+		encode(v)
+	}
+	return buf
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// rtpPacket is a parsed RTP packet.
+type rtpPacket struct {
+	marker    bool
+	seq       uint16
+	timestamp uint32
+	payload   []byte
+}
+
+func rtpParse(buf []byte) (*rtpPacket, error) {
+	headerLen, err := rtpHeaderLen(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if (buf[0] >> 6) != 2 {
+		return nil, fmt.Errorf("unsupported RTP version %d", buf[0]>>6)
+	}
+
+	payload := buf[headerLen:]
+
+	// padding
+	if (buf[0] & 0x20) != 0 {
+		if len(payload) < 1 || int(payload[len(payload)-1]) > len(payload) {
+			return nil, fmt.Errorf("invalid RTP padding")
+		}
+		payload = payload[:len(payload)-int(payload[len(payload)-1])]
+	}
+
+	return &rtpPacket{
+		marker:    (buf[1] & 0x80) != 0,
+		seq:       binary.BigEndian.Uint16(buf[2:]),
+		timestamp: binary.BigEndian.Uint32(buf[4:]),
+		payload:   payload,
+	}, nil
+}
+
+// rtpValidate checks that a RTP packet is well formed: the version must be 2,
+// the CSRCs and the extension must fit into the packet, and the padding can't
+// exceed the payload. Payload types that collide with RTCP packet types
+// (RFC 5761) are rejected too.
+func rtpValidate(buf []byte) error {
+	_, err := rtpParse(buf)
+	if err != nil {
+		return err
+	}
+
+	if pt := buf[1] & 0x7F; pt >= 72 && pt <= 76 {
+		return fmt.Errorf("invalid payload type %d", pt)
+	}
+	return nil
+}
+
+// rtpH264Depacketizer rebuilds H264 access units from RTP packets
+// (RFC 6184). Single NALU, STAP-A and FU-A packets are supported.
+type rtpH264Depacketizer struct {
+	initialized bool
+	lastSeq     uint16
+	timestamp   uint32
+	nalus       [][]byte
+	fragments   []byte // FU-A being received
+}
+
+// process returns the NALUs of an access unit and its timestamp, when the
+// last packet of the access unit is received. Incomplete access units
+// are discarded.
+func (d *rtpH264Depacketizer) process(buf []byte) ([][]byte, uint32, bool) {
+	pkt, err := rtpParse(buf)
+	if err != nil || len(pkt.payload) == 0 {
+		return nil, 0, false
+	}
+
+	if d.initialized && pkt.seq != d.lastSeq+1 {
+		// a packet has been lost, the FU-A can't be rebuilt
+		d.fragments = nil
+	}
+	d.initialized = true
+	d.lastSeq = pkt.seq
+
+	if len(d.nalus) > 0 && pkt.timestamp != d.timestamp {
+		// the marker of the previous access unit has been lost
+		d.nalus = nil
+		d.fragments = nil
+	}
+	d.timestamp = pkt.timestamp
+
+	switch typ := pkt.payload[0] & 0x1F; {
+	case typ >= 1 && typ <= 23:
+		d.nalus = append(d.nalus, append([]byte(nil), pkt.payload...))
+
+	case typ == 24: // STAP-A
+		payload := pkt.payload[1:]
+		for len(payload) >= 2 {
+			n := int(binary.BigEndian.Uint16(payload))
+			payload = payload[2:]
+			if n == 0 || n > len(payload) {
+				break
+			}
+
+			d.nalus = append(d.nalus, append([]byte(nil), payload[:n]...))
+			payload = payload[n:]
+		}
+
+	case typ == 28: // FU-A
+		if len(pkt.payload) < 2 {
+			break
+		}
+		header := pkt.payload[1]
+
+		if (header & 0x80) != 0 {
+			d.fragments = []byte{(pkt.payload[0] & 0xE0) | (header & 0x1F)}
+		} else if d.fragments == nil {
+			break
+		}
+		d.fragments = append(d.fragments, pkt.payload[2:]...)
+
+		if (header & 0x40) != 0 {
+			d.nalus = append(d.nalus, d.fragments)
+			d.fragments = nil
+		}
+	}
+
+	if !pkt.marker || len(d.nalus) == 0 {
+		return nil, 0, false
+	}
+
+	nalus := d.nalus
+	d.nalus = nil
+	return nalus, pkt.timestamp, true
+}
+
+// rtpH264IsKeyframeStart returns whether a RTP packet begins a H264 keyframe,
+// that is, whether it contains a SPS or the beginning of an IDR NALU.
+func rtpH264IsKeyframeStart(buf []byte) bool {
+	pkt, err := rtpParse(buf)
+	if err != nil || len(pkt.payload) == 0 {
+		return false
+	}
+
+	isKeyframe := func(typ byte) bool {
+		return typ == 5 || typ == 7
+	}
+
+	switch typ := pkt.payload[0] & 0x1F; {
+	case typ >= 1 && typ <= 23:
+		return isKeyframe(typ)
+
+	case typ == 24: // STAP-A
+		payload := pkt.payload[1:]
+		for len(payload) >= 2 {
+			n := int(binary.BigEndian.Uint16(payload))
+			payload = payload[2:]
+			if n == 0 || n > len(payload) {
+				break
+			}
+
+			if isKeyframe(payload[0] & 0x1F) {
+				return true
+			}
+			payload = payload[n:]
+		}
+
+	case typ == 28: // FU-A
+		return len(pkt.payload) >= 2 && (pkt.payload[1]&0x80) != 0 &&
+			isKeyframe(pkt.payload[1]&0x1F)
+	}
+
+	return false
+}
+
+// rtpAacDepacketizer extracts AAC access units from RTP packets with the
+// AAC-hbr mode of RFC 3640.
+type rtpAacDepacketizer struct {
+	initialized bool
+	lastSeq     uint16
+	fragments   []byte // access unit being received
+	fragSize    int
+}
+
+// process returns the access units contained in a packet and the
+// timestamp of the first one.
+func (d *rtpAacDepacketizer) process(buf []byte) ([][]byte, uint32, bool) {
+	pkt, err := rtpParse(buf)
+	if err != nil || len(pkt.payload) < 2 {
+		return nil, 0, false
+	}
+
+	if d.initialized && pkt.seq != d.lastSeq+1 {
+		d.fragments = nil
+	}
+	d.initialized = true
+	d.lastSeq = pkt.seq
+
+	// each AU header is made of AU-size (13 bits) and AU-index (3 bits)
+	headersLen := int(binary.BigEndian.Uint16(pkt.payload)) / 8
+	payload := pkt.payload[2:]
+	if headersLen == 0 || (headersLen%2) != 0 || headersLen > len(payload) {
+		return nil, 0, false
+	}
+
+	var sizes []int
+	for i := 0; i < headersLen; i += 2 {
+		sizes = append(sizes, int(binary.BigEndian.Uint16(payload[i:])>>3))
+	}
+	payload = payload[headersLen:]
+
+	// fragment of an access unit
+	if len(sizes) == 1 && sizes[0] > len(payload) {
+		if d.fragments == nil {
+			d.fragSize = sizes[0]
+		} else if d.fragSize != sizes[0] {
+			d.fragments = nil
+			return nil, 0, false
+		}
+		d.fragments = append(d.fragments, payload...)
+
+		if !pkt.marker {
+			return nil, 0, false
+		}
+
+		au := d.fragments
+		d.fragments = nil
+		if len(au) != d.fragSize {
+			return nil, 0, false
+		}
+		return [][]byte{au}, pkt.timestamp, true
+	}
+	d.fragments = nil
+
+	var aus [][]byte
+	for _, size := range sizes {
+		if size > len(payload) {
+			return nil, 0, false
+		}
+		aus = append(aus, append([]byte(nil), payload[:size]...))
+		payload = payload[size:]
+	}
+
+	return aus, pkt.timestamp, true
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// trackRtpInfo keeps track of the last RTP packet of a track, in order to
+// fill the RTP-Info header of PLAY responses.
+type trackRtpInfo struct {
+	clockRate   int
+	initialized bool
+	lastSeq     uint16
+	lastRtpTime uint32
+	lastTime    time.Time
+}
+
+func newTrackRtpInfo(clockRate int) *trackRtpInfo {
+	return &trackRtpInfo{
+		clockRate: clockRate,
+	}
+}
+
+func (i *trackRtpInfo) processFrame(now time.Time, frame []byte) {
+	if len(frame) < 12 {
+		return
+	}
+
+	i.initialized = true
+	i.lastSeq = binary.BigEndian.Uint16(frame[2:4])
+	i.lastRtpTime = binary.BigEndian.Uint32(frame[4:8])
+	i.lastTime = now
+}
+
+// next returns the sequence number and the estimated RTP time
+// of the next packet.
+func (i *trackRtpInfo) next(now time.Time) (uint16, uint32) {
+	return i.lastSeq + 1,
+		i.lastRtpTime + uint32(now.Sub(i.lastTime).Seconds()*float64(i.clockRate))
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+const (
+	// packets fit into an UDP datagram with a MTU of 1500 bytes
+	_RTP_MAX_PAYLOAD_SIZE = 1460
+)
+
+// rtpPacketizer generates the RTP packets of a track.
+type rtpPacketizer struct {
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16
+	tsBase      uint32
+}
+
+// newRtpPacketizer allocates a packetizer with random SSRC, initial sequence
+// number and initial timestamp, as suggested by RFC 3550.
+func newRtpPacketizer(payloadType uint8) *rtpPacketizer {
+	var buf [10]byte
+	rand.Read(buf[:])
+
+	return &rtpPacketizer{
+		payloadType: payloadType,
+		ssrc:        binary.BigEndian.Uint32(buf[0:]),
+		seq:         binary.BigEndian.Uint16(buf[4:]),
+		tsBase:      binary.BigEndian.Uint32(buf[6:]),
+	}
+}
+
+func (e *rtpPacketizer) packet(marker bool, ts uint32, payload ...[]byte) []byte {
+	n := 12
+	for _, p := range payload {
+		n += len(p)
+	}
+
+	pkt := make([]byte, 12, n)
+	pkt[0] = 0x80
+	pkt[1] = e.payloadType
+	if marker {
+		pkt[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(pkt[2:], e.seq)
+	binary.BigEndian.PutUint32(pkt[4:], e.tsBase+ts)
+	binary.BigEndian.PutUint32(pkt[8:], e.ssrc)
+
+	for _, p := range payload {
+		pkt = append(pkt, p...)
+	}
+
+	e.seq++
+	return pkt
+}
+
+// packetizeH264 generates the packets of an access unit (RFC 6184). NALUs
+// that don't fit into a packet are split into FU-A fragments. The marker is
+// set on the last packet of the access unit.
+func (e *rtpPacketizer) packetizeH264(nalus [][]byte, ts uint32) [][]byte {
+	var ret [][]byte
+
+	for i, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		last := (i == len(nalus)-1)
+
+		if len(nalu) <= _RTP_MAX_PAYLOAD_SIZE {
+			ret = append(ret, e.packet(last, ts, nalu))
+			continue
+		}
+
+		indicator := (nalu[0] & 0xE0) | 28
+		naluType := nalu[0] & 0x1F
+		data := nalu[1:]
+
+		for first := true; len(data) > 0; first = false {
+			n := len(data)
+			if n > _RTP_MAX_PAYLOAD_SIZE-2 {
+				n = _RTP_MAX_PAYLOAD_SIZE - 2
+			}
+
+			header := naluType
+			if first {
+				header |= 0x80
+			}
+			end := (n == len(data))
+			if end {
+				header |= 0x40
+			}
+
+			ret = append(ret, e.packet(last && end, ts, []byte{indicator, header}, data[:n]))
+			data = data[n:]
+		}
+	}
+
+	return ret
+}
+
+// packetizeAac generates the packets of an AAC access unit, with the
+// AAC-hbr mode of RFC 3640. Access units that don't fit into a packet are
+// fragmented, and all the fragments carry the size of the whole unit.
+func (e *rtpPacketizer) packetizeAac(au []byte, ts uint32) [][]byte {
+	// AU-headers-length (16 bits), AU-size (13 bits), AU-index (3 bits)
+	header := []byte{0x00, 0x10, byte(len(au) >> 5), byte(len(au)<<3) & 0xF8}
+
+	var ret [][]byte
+
+	for len(au) > 0 {
+		n := len(au)
+		if n > _RTP_MAX_PAYLOAD_SIZE-len(header) {
+			n = _RTP_MAX_PAYLOAD_SIZE - len(header)
+		}
+
+		ret = append(ret, e.packet(n == len(au), ts, header, au[:n]))
+		au = au[n:]
+	}
+
+	return ret
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// rtpRewriter rewrites the sequence numbers and the timestamps of the RTP
+// packets of a track, in order to make them continue monotonically when the
+// publisher of a path is replaced by a standby publisher. The SSRC is replaced
+// with a fixed one, since every publisher picks its own and players would
+// otherwise discard the packets of the new publisher. The timestamps and the
+// SSRC of the RTCP sender reports are rewritten too, in order to keep players
+// synchronized.
+type rtpRewriter struct {
+	clockRate   int
+	ssrc        uint32
+	initialized bool
+	resync      bool // the next packet comes from a new publisher
+	seqOffset   uint16
+	tsOffset    uint32
+	lastSeq     uint16
+	lastTs      uint32
+	lastTime    time.Time
+}
+
+func newRtpRewriter(clockRate int, ssrc uint32) *rtpRewriter {
+	return &rtpRewriter{
+		clockRate: clockRate,
+		ssrc:      ssrc,
+	}
+}
+
+// processRtp rewrites a RTP packet in place.
+func (r *rtpRewriter) processRtp(now time.Time, buf []byte) {
+	if len(buf) < 12 {
+		return
+	}
+
+	seq := binary.BigEndian.Uint16(buf[2:4])
+	ts := binary.BigEndian.Uint32(buf[4:8])
+
+	if !r.initialized {
+		r.initialized = true
+
+	} else if r.resync {
+		r.resync = false
+
+		// the first packet of the new publisher follows the last packet of
+		// the previous one, with a timestamp that takes into account the
+		// time elapsed between them
+		tsDelta := uint32(now.Sub(r.lastTime).Seconds() * float64(r.clockRate))
+		if tsDelta == 0 {
+			tsDelta = 1
+		}
+		r.seqOffset = r.lastSeq + 1 - seq
+		r.tsOffset = r.lastTs + tsDelta - ts
+	}
+
+	r.lastSeq = seq + r.seqOffset
+	r.lastTs = ts + r.tsOffset
+	r.lastTime = now
+
+	binary.BigEndian.PutUint16(buf[2:4], r.lastSeq)
+	binary.BigEndian.PutUint32(buf[4:8], r.lastTs)
+	binary.BigEndian.PutUint32(buf[8:12], r.ssrc)
+}
+
+// processRtcp rewrites the SSRC and the RTP timestamp of a RTCP sender report
+// in place.
+// Only the first packet of a compound packet is considered, since it's the
+// one that contains the sender report. It returns false when the packet must
+// be dropped, since the offset of the new publisher is not known yet.
+func (r *rtpRewriter) processRtcp(buf []byte) bool {
+	// packet type 200 is the sender report
+	if len(buf) < 20 || buf[1] != 200 {
+		return true
+	}
+
+	if r.resync {
+		return false
+	}
+
+	binary.BigEndian.PutUint32(buf[4:8], r.ssrc)
+	ts := binary.BigEndian.Uint32(buf[16:20])
+	binary.BigEndian.PutUint32(buf[16:20], ts+r.tsOffset)
+	return true
+}
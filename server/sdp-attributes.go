@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseSdpAttributes parses the attributes that are added to, or replaced
+// in, the SDP sent to readers. Attributes are grouped by section, that is
+// either "session" or the type of a media.
+func parseSdpAttributes(in map[string][]string) (map[string][]string, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+
+	ret := make(map[string][]string)
+
+	for section, attrs := range in {
+		switch section {
+		case "session", "video", "audio", "application":
+		default:
+			return nil, fmt.Errorf("invalid SDP section '%s'", section)
+		}
+
+		for _, attr := range attrs {
+			attr = strings.TrimPrefix(strings.TrimSpace(attr), "a=")
+			if attr == "" || strings.ContainsAny(attr, "\r\n") {
+				return nil, fmt.Errorf("invalid SDP attribute '%s'", attr)
+			}
+
+			// the control attribute of medias is used to find tracks
+			// in SETUP requests
+			if section != "session" && sdpAttributeKey(attr) == "control" {
+				return nil, fmt.Errorf("the control attribute of medias can't be overridden")
+			}
+
+			ret[section] = append(ret[section], attr)
+		}
+	}
+
+	return ret, nil
+}
+
+// sdpAttributeKey returns the part of an attribute that identifies it: the
+// name, followed by the payload type for the attributes of a format.
+// Feedback attributes can be repeated, therefore they are identified by
+// their whole value.
+func sdpAttributeKey(attr string) string {
+	parts := strings.SplitN(attr, ":", 2)
+	if len(parts) == 1 {
+		return attr
+	}
+
+	switch parts[0] {
+	case "rtpmap", "fmtp":
+		return parts[0] + ":" + strings.SplitN(parts[1], " ", 2)[0]
+
+	case "rtcp-fb":
+		return attr
+	}
+
+	return parts[0]
+}
+
+// applySdpAttributes replaces the attributes of each section that have the
+// same key of a configured one, and adds the others at the end of the section.
+func applySdpAttributes(sdpText []byte, attrs map[string][]string) []byte {
+	lines := strings.Split(strings.TrimRight(string(sdpText), "\r\n"), "\n")
+
+	var out []string
+	var pending []string // attributes of the current section that are not applied yet
+
+	startSection := func(section string) {
+		for _, attr := range pending {
+			out = append(out, "a="+attr)
+		}
+		pending = append([]string(nil), attrs[section]...)
+	}
+
+	startSection("session")
+
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			// format is "m=<media> <port> <proto> <fmt> ..."
+			startSection(strings.SplitN(strings.TrimPrefix(line, "m="), " ", 2)[0])
+
+		case strings.HasPrefix(line, "a="):
+			key := sdpAttributeKey(strings.TrimPrefix(line, "a="))
+			for i, attr := range pending {
+				if sdpAttributeKey(attr) == key {
+					line = "a=" + attr
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+		}
+
+		out = append(out, line)
+	}
+
+	startSection("")
+
+	return []byte(strings.Join(out, "\r\n") + "\r\n")
+}
@@ -0,0 +1,1755 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"gortc.io/sdp"
+)
+
+const (
+	_UDP_CHECK_STREAM_INTERVAL  = 5 * time.Second
+	_UDP_STREAM_DEAD_AFTER      = 10 * time.Second
+	_WRITE_DROPPED_LOG_INTERVAL = 5 * time.Second
+
+	// fill level of the write queue, in percent, beyond which the smart
+	// drop policy starts dropping video packets
+	_VIDEO_DROPPER_QUEUE_THRESHOLD = 75
+
+	// delay before the response to a locked out IP, that slows down brute force
+	_AUTH_LOCKOUT_DELAY = 2 * time.Second
+)
+
+func interleavedChannelToTrack(channel uint8) (int, trackFlowType) {
+	if (channel % 2) == 0 {
+		return int(channel / 2), _TRACK_FLOW_RTP
+	}
+	return int((channel - 1) / 2), _TRACK_FLOW_RTCP
+}
+
+func newSessionId() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// parseInterleaved parses the interleaved field of a transport header, that
+// contains the channels of RTP and RTCP packets (i.e. "0-1").
+func parseInterleaved(value string) (uint8, uint8, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid interleaved value '%s'", value)
+	}
+
+	rtpChannel, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid interleaved value '%s'", value)
+	}
+
+	rtcpChannel, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil || rtcpChannel == rtpChannel {
+		return 0, 0, fmt.Errorf("invalid interleaved value '%s'", value)
+	}
+
+	return uint8(rtpChannel), uint8(rtcpChannel), nil
+}
+
+type clientState int
+
+const (
+	_CLIENT_STATE_STARTING clientState = iota
+	_CLIENT_STATE_ANNOUNCE
+	_CLIENT_STATE_PRE_PLAY
+	_CLIENT_STATE_PLAY
+	_CLIENT_STATE_PRE_RECORD
+	_CLIENT_STATE_RECORD
+)
+
+func (cs clientState) String() string {
+	switch cs {
+	case _CLIENT_STATE_STARTING:
+		return "STARTING"
+
+	case _CLIENT_STATE_ANNOUNCE:
+		return "ANNOUNCE"
+
+	case _CLIENT_STATE_PRE_PLAY:
+		return "PRE_PLAY"
+
+	case _CLIENT_STATE_PLAY:
+		return "PLAY"
+
+	case _CLIENT_STATE_PRE_RECORD:
+		return "PRE_RECORD"
+
+	case _CLIENT_STATE_RECORD:
+		return "RECORD"
+	}
+	return "UNKNOWN"
+}
+
+type serverClient struct {
+	p                    *program
+	lconn                *limitedConn
+	conn                 *gortsplib.ConnServer
+	hostname             atomic.Value // filled only if logReverseDNS is enabled
+	state                clientState
+	path                 string
+	publishAuth          *gortsplib.AuthServer
+	readAuth             *gortsplib.AuthServer
+	externalAuthDone     map[string]struct{}
+	streamSdpText        []byte       // filled only if publisher
+	streamSdpParsed      *sdp.Message // filled only if publisher
+	streamProtocol       streamProtocol
+	streamTracks         map[int]*track // track id -> track
+	readLimiter          *rateLimiter   // unlimited if readRateLimit is not set
+	srtpKeys             [][]byte       // filled only if readSRTP is set
+	sessionId            string
+	sessionLastActivity  time.Time
+	connTime             time.Time
+	startedTime          time.Time // time of the first PLAY or RECORD
+	playTime             time.Time // time of PLAY, cleared when the first frame is sent
+	readStartTime        time.Time // time of the first PLAY of the session, filled only if accessLog is set
+	waitingKeyframe      bool      // filled only if readWaitKeyframe is set
+	keyframeTrackId      int
+	videoDropper         *videoDropper   // filled only if readDropPolicy is smart
+	gopReplay            []gopCacheFrame // packets sent when the reader starts playing
+	udpLastFrameTime     time.Time
+	udpDestination       net.IP // filled only if the reader requested another destination
+	udpCheckStreamTicker *time.Ticker
+	maxDurationTimer     *time.Timer // filled only if maxSessionDuration is set
+	readBuf1             []byte
+	readBuf2             []byte
+	readCurBuf           bool
+	writeMutex           sync.Mutex
+	writerStarted        bool
+	writeQueueFull       bool
+	writeDroppedCount    int
+	writeDroppedLastLog  time.Time
+	closing              bool // written by the program
+
+	writec chan *gortsplib.InterleavedFrame
+	done   chan struct{}
+}
+
+func newServerClient(p *program, nconn net.Conn) *serverClient {
+	lconn := &limitedConn{Conn: nconn}
+
+	c := &serverClient{
+		p:     p,
+		lconn: lconn,
+		conn: gortsplib.NewConnServer(gortsplib.ConnServerConf{
+			NConn:        lconn,
+			ReadTimeout:  p.conf.ReadTimeout,
+			WriteTimeout: p.conf.WriteTimeout,
+		}),
+		state:            _CLIENT_STATE_STARTING,
+		externalAuthDone: make(map[string]struct{}),
+		streamTracks:     make(map[int]*track),
+		connTime:         p.clock.Now(),
+		readBuf1:         make([]byte, 0, 512*1024),
+		readBuf2:         make([]byte, 0, 512*1024),
+		readLimiter:      newRateLimiter(0, p.clock.Now()),
+		writec:           make(chan *gortsplib.InterleavedFrame, p.conf.WriteQueueSize),
+		done:             make(chan struct{}),
+	}
+
+	go c.run()
+	return c
+}
+
+func (c *serverClient) log(format string, args ...interface{}) {
+	addr := c.conn.NetConn().RemoteAddr().String()
+	if hostname, _ := c.hostname.Load().(string); hostname != "" {
+		addr += " (" + hostname + ")"
+	}
+	format = "[client %s] " + format
+	args = append([]interface{}{addr}, args...)
+	c.p.log(format, args...)
+
+	// lines written before the path is known go only to the global log
+	if c.path != "" {
+		c.p.pathLogs.write(c.path, fmt.Sprintf(format, args...))
+	}
+}
+
+// logHeader logs the headers of a request or a response, when the log level
+// is debug. Credentials are redacted.
+func (c *serverClient) logHeader(prefix string, header gortsplib.Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, v := range header[key] {
+			if key == "Authorization" {
+				// keep the method only
+				v = strings.SplitN(v, " ", 2)[0] + " xxxxx"
+			}
+			c.log("%s %s: %s", prefix, key, v)
+		}
+	}
+}
+
+func (c *serverClient) logRequest(req *gortsplib.Request) {
+	if c.p.conf.LogLevel != "debug" {
+		return
+	}
+
+	c.log("[debug] -> %s %s", req.Method, redactUrl(req.Url))
+	c.logHeader("[debug] ->", req.Header)
+}
+
+func (c *serverClient) logResponse(res *gortsplib.Response) {
+	if c.p.conf.LogLevel != "debug" {
+		return
+	}
+
+	c.log("[debug] <- %d %s", res.StatusCode, res.StatusMessage)
+	c.logHeader("[debug] <-", res.Header)
+}
+
+func (c *serverClient) ip() net.IP {
+	return c.conn.NetConn().RemoteAddr().(*net.TCPAddr).IP
+}
+
+func (c *serverClient) zone() string {
+	return c.conn.NetConn().RemoteAddr().(*net.TCPAddr).Zone
+}
+
+// hasUdpAddr returns whether an UDP packet has been sent from the host of
+// the client. Link-local IPv6 addresses are unique only inside a network
+// interface, therefore zones are compared too.
+func (c *serverClient) hasUdpAddr(addr *net.UDPAddr) bool {
+	ip, zone := c.udpDestinationIp()
+	return ip.Equal(addr.IP) && zone == addr.Zone
+}
+
+// udpDestinationIp returns the ip that receives the UDP stream of a reader,
+// and that sends its RTCP receiver reports.
+func (c *serverClient) udpDestinationIp() (net.IP, string) {
+	if c.udpDestination != nil {
+		return c.udpDestination, ""
+	}
+	return c.ip(), c.zone()
+}
+
+// parseUdpDestination parses the destination field of a transport header.
+// Other hosts can receive the stream only if they are allowed by the
+// configuration, otherwise the server could be used to flood them.
+func (c *serverClient) parseUdpDestination(value string) (net.IP, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, newStatusError(gortsplib.StatusBadRequest, "invalid destination '%s'", value)
+	}
+
+	// clients behind a NAT usually send their local ip, that is ignored
+	// when destinations are disabled
+	if ip.Equal(c.ip()) || !c.p.conf.AllowUdpDestination {
+		return nil, nil
+	}
+
+	if c.p.conf.udpDestinationIps != nil && !ipEqualOrInRange(ip, "", c.p.conf.udpDestinationIps) {
+		return nil, newStatusError(gortsplib.StatusForbidden, "destination '%s' not allowed", ip)
+	}
+
+	return ip, nil
+}
+
+// sessionHeader returns the value of the Session header. In SETUP responses,
+// the timeout is included, in order to let clients know how often they have
+// to send keepalives.
+func (c *serverClient) sessionHeader(withTimeout bool) []string {
+	if withTimeout {
+		return []string{c.sessionId + ";timeout=" +
+			strconv.FormatInt(int64(c.p.conf.SessionTimeout.Seconds()), 10)}
+	}
+	return []string{c.sessionId}
+}
+
+func (c *serverClient) publisherIsReady() bool {
+	return c.state == _CLIENT_STATE_RECORD
+}
+
+func (c *serverClient) publisherSdpText() []byte {
+	return c.streamSdpText
+}
+
+func (c *serverClient) publisherSdpParsed() *sdp.Message {
+	return c.streamSdpParsed
+}
+
+func (c *serverClient) run() {
+	// the lookup is performed here in order not to block the program
+	if c.p.conf.LogReverseDNS {
+		c.hostname.Store(c.p.reverseDns.lookup(c.ip()))
+	}
+	c.log("connected")
+
+	if c.p.conf.PreScript != "" {
+		preScript := exec.Command(c.p.conf.PreScript)
+		err := preScript.Run()
+		if err != nil {
+			c.log("ERR: %s", err)
+		}
+	}
+
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if c.lconn.exceeded {
+				c.log("ERR: request is bigger than %d bytes", c.p.conf.MaxRequestSize)
+				c.writeResponse(&gortsplib.Response{
+					StatusCode: gortsplib.StatusBadRequest,
+				})
+			} else if err != io.EOF {
+				c.log("ERR: %s", err)
+			}
+			break
+		}
+
+		ok := c.handleRequest(req)
+		if !ok {
+			break
+		}
+	}
+
+	if c.udpCheckStreamTicker != nil {
+		c.udpCheckStreamTicker.Stop()
+	}
+
+	if c.maxDurationTimer != nil {
+		c.maxDurationTimer.Stop()
+	}
+
+	go func() {
+		for range c.writec {
+		}
+	}()
+
+	func() {
+		if c.p.conf.PostScript != "" {
+			postScript := exec.Command(c.p.conf.PostScript)
+			err := postScript.Run()
+			if err != nil {
+				c.log("ERR: %s", err)
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	c.p.events <- programEventClientClose{done, c}
+	<-done
+
+	close(c.writec)
+
+	close(c.done)
+}
+
+// readRequest reads the next request. Readers that use TCP can send RTCP
+// receiver reports at any time after PLAY, therefore frames are read too
+// and discarded.
+func (c *serverClient) readRequest() (*gortsplib.Request, error) {
+	defer c.lconn.setLimit(0)
+
+	if c.streamProtocol != _STREAM_PROTOCOL_TCP || c.streamSdpParsed != nil {
+		c.lconn.setLimit(c.p.conf.MaxRequestSize)
+		return c.conn.ReadRequest()
+	}
+
+	frame := &gortsplib.InterleavedFrame{}
+	for {
+		c.lconn.setLimit(c.p.conf.MaxRequestSize)
+		frame.Content = c.readBuf1[:cap(c.readBuf1)]
+
+		recv, err := c.conn.ReadInterleavedFrameOrRequest(frame)
+		if err != nil {
+			// readers are not required to send anything while playing,
+			// the session is kept alive by the stream itself. When part of
+			// a frame or of a request was received, the parser can't resume
+			// from the middle of it, therefore the connection is closed
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && c.lconn.count == 0 {
+				continue
+			}
+			return nil, err
+		}
+
+		if req, ok := recv.(*gortsplib.Request); ok {
+			return req, nil
+		}
+	}
+}
+
+func (c *serverClient) close() {
+	c.conn.NetConn().Close()
+	<-c.done
+}
+
+// startMaxDurationTimer closes the client when the maximum session duration
+// of the path expires. The timer is started once, at the first PLAY or RECORD,
+// and is not reset by PAUSE.
+func (c *serverClient) startMaxDurationTimer() {
+	if c.maxDurationTimer != nil {
+		return
+	}
+
+	pconf := c.p.findConfForPath(c.path)
+	if pconf == nil || pconf.MaxSessionDuration == 0 {
+		return
+	}
+
+	d := pconf.MaxSessionDuration
+	c.maxDurationTimer = time.AfterFunc(d, func() {
+		c.log("ERR: maximum session duration of %s reached", d)
+		go c.close()
+	})
+}
+
+// trackForInterleavedChannel returns the track that uses an interleaved
+// channel.
+func (c *serverClient) trackForInterleavedChannel(channel uint8) (int, trackFlowType, bool) {
+	for id, t := range c.streamTracks {
+		if t.rtpChannel == channel {
+			return id, _TRACK_FLOW_RTP, true
+		}
+		if t.rtcpChannel == channel {
+			return id, _TRACK_FLOW_RTCP, true
+		}
+	}
+	return 0, 0, false
+}
+
+// interleavedChannels returns the channels of a track that is being setup
+// with TCP. Channels requested by the client are used if they are not used
+// by other tracks, otherwise the first available ones are picked.
+func (c *serverClient) interleavedChannels(value string) (uint8, uint8, error) {
+	if value == "" {
+		for ch := 0; ch < 256; ch += 2 {
+			_, _, used1 := c.trackForInterleavedChannel(uint8(ch))
+			_, _, used2 := c.trackForInterleavedChannel(uint8(ch + 1))
+			if !used1 && !used2 {
+				return uint8(ch), uint8(ch + 1), nil
+			}
+		}
+		return 0, 0, fmt.Errorf("all the interleaved channels are in use")
+	}
+
+	rtpChannel, rtcpChannel, err := parseInterleaved(value)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, _, used1 := c.trackForInterleavedChannel(rtpChannel)
+	_, _, used2 := c.trackForInterleavedChannel(rtcpChannel)
+	if used1 || used2 {
+		return 0, 0, fmt.Errorf("interleaved channels '%s' are already in use", value)
+	}
+
+	return rtpChannel, rtcpChannel, nil
+}
+
+// writeFrame enqueues a frame, that is written by the writer goroutine.
+// It is called by the program and never blocks: when the queue is full,
+// the oldest frame is dropped or the client is disconnected. It returns
+// false when the frame was not enqueued.
+func (c *serverClient) writeFrame(channel uint8, inbuf []byte) bool {
+	if c.writeQueueFull {
+		return false
+	}
+
+	frame := &gortsplib.InterleavedFrame{
+		Channel: channel,
+		Content: append([]byte(nil), inbuf...),
+	}
+
+	select {
+	case c.writec <- frame:
+		return true
+	default:
+	}
+
+	if c.p.conf.WriteQueueFullAction == "disconnect" {
+		c.writeQueueFull = true
+		c.log("ERR: client is too slow, disconnecting")
+		go c.close()
+		return false
+	}
+
+	c.frameDropped()
+
+	// the newest frames are the most useful for a live stream. With the smart
+	// drop policy, the queued frames are kept since they can be keyframes
+	if c.videoDropper == nil {
+		select {
+		case <-c.writec:
+		default:
+		}
+
+		select {
+		case c.writec <- frame:
+			return true
+		default:
+		}
+	}
+
+	return false
+}
+
+// frameDropped counts a frame that was not written because the client is too
+// slow, and logs the count periodically.
+func (c *serverClient) frameDropped() {
+	c.writeDroppedCount++
+	if time.Since(c.writeDroppedLastLog) >= _WRITE_DROPPED_LOG_INTERVAL {
+		c.log("ERR: client is too slow, %d frames dropped", c.writeDroppedCount)
+		c.writeDroppedCount = 0
+		c.writeDroppedLastLog = time.Now()
+	}
+}
+
+// appendInterleavedFrame appends a frame to a buffer, in the format used to
+// interleave frames with RTSP messages ('$', channel, 16-bit size, content).
+func appendInterleavedFrame(buf []byte, channel uint8, content []byte) []byte {
+	buf = append(buf, '$', channel, byte(len(content)>>8), byte(len(content)))
+	return append(buf, content...)
+}
+
+// runBatchWriter writes the frames of the write queue, coalescing the frames
+// that are enqueued within window after the first one, up to maxSize bytes,
+// into a single write. The ratio between frames and writes is logged when
+// the client is closed.
+func (c *serverClient) runBatchWriter(window time.Duration, maxSize int) {
+	buf := make([]byte, 0, maxSize)
+	frameCount := 0
+	writeCount := 0
+
+	defer func() {
+		if writeCount > 0 {
+			c.log("TCP batching: %d frames sent with %d writes (%.1f frames per write)",
+				frameCount, writeCount, float64(frameCount)/float64(writeCount))
+		}
+	}()
+
+	// the timer is allocated once and reset for every batch
+	timer := time.NewTimer(window)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		frame, ok := <-c.writec
+		if !ok {
+			return
+		}
+
+		buf = appendInterleavedFrame(buf[:0], frame.Channel, frame.Content)
+		frameCount++
+
+		timer.Reset(window)
+	outer:
+		for len(buf) < maxSize {
+			select {
+			case frame, ok = <-c.writec:
+				if !ok {
+					break outer
+				}
+				buf = appendInterleavedFrame(buf, frame.Channel, frame.Content)
+				frameCount++
+
+			case <-timer.C:
+				break outer
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if d := c.readLimiter.reserve(c.p.clock.Now(), len(buf)); d > 0 {
+			time.Sleep(d)
+		}
+
+		// responses are flushed by the connection after being written,
+		// therefore the batch can be written directly into the socket
+		c.writeMutex.Lock()
+		c.conn.NetConn().SetWriteDeadline(time.Now().Add(c.p.conf.WriteTimeout))
+		_, err := c.conn.NetConn().Write(buf)
+		c.writeMutex.Unlock()
+		writeCount++
+
+		// the connection is broken and its reader closes the client
+		if err != nil || !ok {
+			return
+		}
+	}
+}
+
+// writeResponse writes a response, adding the headers that are shared
+// by all responses.
+func (c *serverClient) writeResponse(res *gortsplib.Response) {
+	if res.Header == nil {
+		res.Header = gortsplib.Header{}
+	}
+	res.Header["Server"] = []string{c.p.conf.ServerHeader}
+	c.logResponse(res)
+
+	// responses can be written while the writer goroutine is sending frames
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.WriteResponse(res)
+}
+
+// writeResError replies to a request with an error. The status code of
+// errors returned by the program replaces the default one.
+func (c *serverClient) writeResError(req *gortsplib.Request, code gortsplib.StatusCode, err error) {
+	c.log("ERR: %s", err)
+
+	if serr, ok := err.(*statusError); ok {
+		code = serr.code
+	}
+
+	header := gortsplib.Header{}
+	if cseq, ok := req.Header["CSeq"]; ok && len(cseq) == 1 {
+		header["CSeq"] = cseq
+	}
+
+	c.writeResponse(&gortsplib.Response{
+		StatusCode: code,
+		Header:     header,
+	})
+}
+
+var errAuthCritical = errors.New("auth critical")
+var errAuthNotCritical = errors.New("auth not critical")
+var errTrackNotFound = errors.New("track not found")
+var errProtocolDisabled = errors.New("protocol disabled")
+var errSrtpMismatch = errors.New("SRTP mismatch")
+var errTerminated = &statusError{gortsplib.StatusServiceUnavailable, errors.New("terminated")}
+
+// statusError is an error that must be sent to the client with a specific
+// status code.
+type statusError struct {
+	code gortsplib.StatusCode
+	err  error
+}
+
+func newStatusError(code gortsplib.StatusCode, format string, args ...interface{}) error {
+	return &statusError{code, fmt.Errorf(format, args...)}
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// checkAuthLockout rejects clients whose IP has been locked out after too
+// many failed authentications, before sending any challenge.
+func (c *serverClient) checkAuthLockout(req *gortsplib.Request) error {
+	if !c.p.authLockedOut(c.ip()) {
+		return nil
+	}
+
+	c.writeResError(req, gortsplib.StatusForbidden,
+		fmt.Errorf("ip '%s' is locked out after too many failed authentications", c.ip()))
+	return errAuthCritical
+}
+
+func (c *serverClient) validateAuth(req *gortsplib.Request, user string, pass string, auth **gortsplib.AuthServer, ips []interface{}) error {
+	err := func() error {
+		if ips == nil {
+			return nil
+		}
+
+		if ipEqualOrInRange(c.ip(), c.zone(), ips) {
+			return nil
+		}
+
+		c.log("ERR: ip '%s' not allowed", c.ip())
+		return errAuthCritical
+	}()
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		if user == "" {
+			return nil
+		}
+
+		err := c.checkAuthLockout(req)
+		if err != nil {
+			return err
+		}
+
+		initialRequest := false
+		if *auth == nil {
+			initialRequest = true
+			*auth = gortsplib.NewAuthServer(user, pass, nil)
+		}
+
+		err = (*auth).ValidateHeader(req.Header["Authorization"], req.Method, req.Url)
+		if err != nil {
+			if !initialRequest {
+				c.log("ERR: unauthorized: %s", err)
+				c.p.events <- programEventAuthFailure{c.ip()}
+			}
+
+			c.writeResponse(&gortsplib.Response{
+				StatusCode: gortsplib.StatusUnauthorized,
+				Header: gortsplib.Header{
+					"CSeq":             req.Header["CSeq"],
+					"WWW-Authenticate": (*auth).GenerateHeader(),
+				},
+			})
+
+			if !initialRequest {
+				return errAuthCritical
+			}
+
+			return errAuthNotCritical
+		}
+
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateExternalAuth validates the client through the external
+// authentication server. It is called by the client goroutine, in order
+// not to block the program while waiting for a response.
+func (c *serverClient) validateExternalAuth(req *gortsplib.Request, pconf *ConfPath, path string, action string) error {
+	if pconf.ExternalAuthURL == "" {
+		return nil
+	}
+
+	// SETUP is called once for each track, avoid repeating the request
+	key := action + " " + path
+	if _, ok := c.externalAuthDone[key]; ok {
+		return nil
+	}
+
+	err := c.checkAuthLockout(req)
+	if err != nil {
+		return err
+	}
+
+	user, pass, hasCredentials := parseBasicAuth(req.Header["Authorization"])
+
+	err = externalAuth(pconf.ExternalAuthURL, externalAuthReq{
+		Ip:       c.ip().String(),
+		User:     user,
+		Password: pass,
+		Path:     path,
+		Action:   action,
+	})
+	if err != nil {
+		if hasCredentials {
+			c.log("ERR: unauthorized: %s", err)
+			c.p.events <- programEventAuthFailure{c.ip()}
+		}
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusUnauthorized,
+			Header: gortsplib.Header{
+				"CSeq":             req.Header["CSeq"],
+				"WWW-Authenticate": []string{"Basic realm=\"rtsp-simple-server\""},
+			},
+		})
+
+		if hasCredentials {
+			return errAuthCritical
+		}
+		return errAuthNotCritical
+	}
+
+	c.externalAuthDone[key] = struct{}{}
+	return nil
+}
+
+// writeOptionsResponse replies to OPTIONS, that can also be used as keepalive.
+func (c *serverClient) writeOptionsResponse(cseq []string, path string) {
+	// ANNOUNCE and RECORD are advertised only if the path can
+	// be published
+	canPublish := false
+	if pconf := c.p.findConfForPath(path); pconf != nil && pconf.Source == "record" {
+		canPublish = true
+	}
+
+	methods := []string{string(gortsplib.DESCRIBE)}
+	if canPublish {
+		methods = append(methods, string(gortsplib.ANNOUNCE))
+	}
+	methods = append(methods,
+		string(gortsplib.SETUP),
+		string(gortsplib.PLAY),
+		string(gortsplib.PAUSE))
+	if canPublish {
+		methods = append(methods, string(gortsplib.RECORD))
+	}
+	methods = append(methods,
+		string(gortsplib.TEARDOWN),
+		string(gortsplib.GET_PARAMETER),
+		string(gortsplib.SET_PARAMETER))
+
+	header := gortsplib.Header{
+		"CSeq":   cseq,
+		"Public": []string{strings.Join(methods, ", ")},
+	}
+	if c.sessionId != "" {
+		header["Session"] = c.sessionHeader(false)
+	}
+
+	c.writeResponse(&gortsplib.Response{
+		StatusCode: gortsplib.StatusOK,
+		Header:     header,
+	})
+}
+
+func (c *serverClient) handleRequest(req *gortsplib.Request) bool {
+	c.log(string(req.Method))
+
+	if err := checkRequestHeader(req.Header, c.p.conf.MaxHeaderCount, c.p.conf.MaxHeaderSize); err != nil {
+		c.writeResError(req, gortsplib.StatusBadRequest, err)
+		return false
+	}
+
+	c.logRequest(req)
+
+	cseq, ok := req.Header["CSeq"]
+	if !ok || len(cseq) != 1 {
+		c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("cseq missing"))
+		return false
+	}
+
+	if sx, ok := req.Header["Session"]; ok && len(sx) == 1 && c.sessionId != "" {
+		// strip any parameter
+		if strings.TrimSpace(strings.Split(sx[0], ";")[0]) != c.sessionId {
+			c.writeResError(req, gortsplib.StatusSessionNotFound, fmt.Errorf("invalid session '%s'", sx[0]))
+			return false
+		}
+	}
+
+	// any request keeps the session alive
+	c.sessionLastActivity = c.p.clock.Now()
+
+	// control attribute of the track, filled only in SETUP requests
+	control := ""
+
+	path := func() string {
+		ret := req.Url.Path
+
+		// remove leading slash
+		if len(ret) > 1 {
+			ret = ret[1:]
+		}
+
+		// remove trailing slash, that is added by readers that use
+		// the Content-Base header
+		ret = strings.TrimSuffix(ret, "/")
+
+		// in SETUP requests, the last part of the path is the control
+		// attribute of the track, unless the path is already known
+		if req.Method == gortsplib.SETUP && ret != c.path {
+			if n := strings.LastIndex(ret, "/"); n >= 0 {
+				control = ret[n+1:]
+				ret = ret[:n]
+			}
+		}
+
+		return ret
+	}()
+
+	switch req.Method {
+	case gortsplib.OPTIONS:
+		// do not check state, since OPTIONS can be requested
+		// in any state
+		c.writeOptionsResponse(cseq, path)
+		return true
+
+	case gortsplib.DESCRIBE:
+		if c.state != _CLIENT_STATE_STARTING {
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
+				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, _CLIENT_STATE_STARTING))
+			return false
+		}
+
+		// the path is not configured at all: the URL is probably wrong
+		pconf := c.p.findConfForPath(path)
+		if pconf == nil {
+			c.writeResError(req, gortsplib.StatusNotFound,
+				fmt.Errorf("unable to find a valid configuration for path '%s'", path))
+			return false
+		}
+
+		err := c.validateAuth(req, pconf.ReadUser, pconf.ReadPass, &c.readAuth, pconf.readIps)
+		if err != nil {
+			if err == errAuthCritical {
+				return false
+			}
+			return true
+		}
+
+		res := make(chan describeRes)
+		c.p.events <- programEventClientDescribe{res, c, path}
+		dres := <-res
+
+		if dres.err != nil {
+			c.writeResError(req, gortsplib.StatusNotFound, dres.err)
+			return false
+		}
+
+		if dres.redirect != "" {
+			c.log("redirected to %s", dres.redirect)
+			c.writeResponse(&gortsplib.Response{
+				StatusCode: gortsplib.StatusFound,
+				Header: gortsplib.Header{
+					"CSeq":     cseq,
+					"Location": []string{dres.redirect},
+				},
+			})
+			return false
+		}
+
+		// the path is configured, but no one is publishing yet
+		if dres.sdp == nil {
+			c.writeResError(req, gortsplib.StatusCode(c.p.conf.PathNotReadyStatus),
+				fmt.Errorf("no one is streaming on path '%s'", path))
+			return false
+		}
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":         cseq,
+				"Content-Base": []string{req.Url.String() + "/"},
+				"Content-Type": []string{"application/sdp"},
+			},
+			Content: dres.sdp,
+		})
+		return true
+
+	case gortsplib.ANNOUNCE:
+		if c.state != _CLIENT_STATE_STARTING {
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
+				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, _CLIENT_STATE_STARTING))
+			return false
+		}
+
+		pconf := c.p.findConfForPath(path)
+		if pconf == nil {
+			c.writeResError(req, gortsplib.StatusBadRequest,
+				fmt.Errorf("unable to find a valid configuration for path '%s'", path))
+			return false
+		}
+
+		err := c.validateAuth(req, pconf.PublishUser, pconf.PublishPass, &c.publishAuth, pconf.publishIps)
+		if err != nil {
+			if err == errAuthCritical {
+				return false
+			}
+			return true
+		}
+
+		err = c.validateExternalAuth(req, pconf, path, "publish")
+		if err != nil {
+			if err == errAuthCritical {
+				return false
+			}
+			return true
+		}
+
+		ct, ok := req.Header["Content-Type"]
+		if !ok || len(ct) != 1 {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("Content-Type header missing"))
+			return false
+		}
+
+		if ct[0] != "application/sdp" {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("unsupported Content-Type '%s'", ct))
+			return false
+		}
+
+		if len(req.Content) > c.p.conf.MaxSdpSize {
+			c.writeResError(req, gortsplib.StatusRequestEntityTooLarge,
+				fmt.Errorf("SDP is too big (%d bytes, maximum is %d)", len(req.Content), c.p.conf.MaxSdpSize))
+			return false
+		}
+
+		sdpParsed, err := sdpParse(req.Content)
+		if err != nil {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("invalid SDP: %s", err))
+			return false
+		}
+		sdpParsed, req.Content = gortsplib.SDPFilter(sdpParsed, req.Content)
+
+		if len(pconf.AllowedCodecs) > 0 {
+			err := func() error {
+				for _, media := range sdpParsed.Medias {
+					for _, codec := range mediaCodecs(&media) {
+						if !func() bool {
+							for _, allowed := range pconf.AllowedCodecs {
+								if strings.EqualFold(codec, allowed) {
+									return true
+								}
+							}
+							return false
+						}() {
+							return fmt.Errorf("codec '%s' is not allowed", codec)
+						}
+					}
+				}
+				return nil
+			}()
+			if err != nil {
+				c.writeResError(req, gortsplib.StatusUnsupportedMediaType, err)
+				return false
+			}
+		}
+
+		if len(path) == 0 {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path can't be empty"))
+			return false
+		}
+
+		res := make(chan error)
+		c.p.events <- programEventClientAnnounce{res, c, path, req.Content, sdpParsed}
+		err = <-res
+		if err != nil {
+			c.writeResError(req, gortsplib.StatusBadRequest, err)
+			return false
+		}
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq": cseq,
+			},
+		})
+		return true
+
+	case gortsplib.SETUP:
+		if c.sessionId == "" {
+			c.sessionId = newSessionId()
+		}
+
+		tsRaw, ok := req.Header["Transport"]
+		if !ok || len(tsRaw) != 1 {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header missing"))
+			return false
+		}
+
+		th := gortsplib.ReadHeaderTransport(tsRaw[0])
+		if _, ok := th["multicast"]; ok {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("multicast is not supported"))
+			return false
+		}
+
+		switch c.state {
+		// play
+		case _CLIENT_STATE_STARTING, _CLIENT_STATE_PRE_PLAY:
+			pconf := c.p.findConfForPath(path)
+			if pconf == nil {
+				c.writeResError(req, gortsplib.StatusBadRequest,
+					fmt.Errorf("unable to find a valid configuration for path '%s'", path))
+				return false
+			}
+
+			err := c.validateAuth(req, pconf.ReadUser, pconf.ReadPass, &c.readAuth, pconf.readIps)
+			if err != nil {
+				if err == errAuthCritical {
+					return false
+				}
+				return true
+			}
+
+			err = c.validateExternalAuth(req, pconf, path, "read")
+			if err != nil {
+				if err == errAuthCritical {
+					return false
+				}
+				return true
+			}
+
+			// SRTP is requested with the RTP/SAVP profile
+			srtp := false
+			profile := "RTP/AVP"
+			for _, key := range []string{"RTP/SAVP", "RTP/SAVP/UDP", "RTP/SAVP/TCP"} {
+				if _, ok := th[key]; ok {
+					srtp = true
+					profile = "RTP/SAVP"
+				}
+			}
+
+			writeSrtpMismatch := func() {
+				if pconf.ReadSRTP {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport,
+						fmt.Errorf("path '%s' can be read only with SRTP (RTP/SAVP)", path))
+				} else {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport,
+						fmt.Errorf("SRTP is not enabled on path '%s'", path))
+				}
+			}
+
+			// play via UDP
+			if func() bool {
+				for _, key := range []string{"RTP/AVP", "RTP/AVP/UDP", "RTP/SAVP", "RTP/SAVP/UDP"} {
+					if _, ok := th[key]; ok {
+						return true
+					}
+				}
+				return false
+			}() {
+				if _, ok := c.p.protocols[_STREAM_PROTOCOL_UDP]; !ok {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("UDP streaming is disabled"))
+					return false
+				}
+
+				rtpPort, rtcpPort := th.GetPorts("client_port")
+				if rtpPort == 0 || rtcpPort == 0 {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not have valid client ports (%s)", tsRaw[0]))
+					return false
+				}
+
+				if c.path != "" && path != c.path {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+					return false
+				}
+
+				if len(c.streamTracks) > 0 && c.streamProtocol != _STREAM_PROTOCOL_UDP {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("can't receive tracks with different protocols"))
+					return false
+				}
+
+				destination, err := c.parseUdpDestination(th.GetValue("destination"))
+				if err != nil {
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				if len(c.streamTracks) > 0 && !destination.Equal(c.udpDestination) {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("can't receive tracks with different destinations"))
+					return false
+				}
+
+				res := make(chan error)
+				c.p.events <- programEventClientSetupPlay{res, c, path, control, _STREAM_PROTOCOL_UDP, srtp, rtpPort, rtcpPort, 0, 0, destination}
+				err = <-res
+				if err != nil {
+					if err == errProtocolDisabled {
+						c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("UDP streaming is disabled"))
+						return false
+					}
+					if err == errSrtpMismatch {
+						writeSrtpMismatch()
+						return false
+					}
+					if err == errTrackNotFound {
+						c.writeResError(req, gortsplib.StatusNotFound,
+							fmt.Errorf("track '%s' not found on path '%s'", control, path))
+						return false
+					}
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				transport := []string{
+					profile + "/UDP",
+					"unicast",
+				}
+				if destination != nil {
+					transport = append(transport, "destination="+destination.String())
+				}
+				transport = append(transport,
+					fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
+					fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort))
+
+				// behind a NAT, the address of the stream is not the one
+				// of the RTSP connection
+				if c.p.conf.externalIp != nil {
+					transport = append(transport, "source="+c.p.conf.externalIp.String())
+				}
+
+				c.writeResponse(&gortsplib.Response{
+					StatusCode: gortsplib.StatusOK,
+					Header: gortsplib.Header{
+						"CSeq":      cseq,
+						"Transport": []string{strings.Join(transport, ";")},
+						"Session":   c.sessionHeader(true),
+					},
+				})
+				return true
+
+				// play via TCP
+			} else if func() bool {
+				for _, key := range []string{"RTP/AVP/TCP", "RTP/SAVP/TCP"} {
+					if _, ok := th[key]; ok {
+						return true
+					}
+				}
+				return false
+			}() {
+				if _, ok := c.p.protocols[_STREAM_PROTOCOL_TCP]; !ok {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("TCP streaming is disabled"))
+					return false
+				}
+
+				if c.path != "" && path != c.path {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+					return false
+				}
+
+				if len(c.streamTracks) > 0 && c.streamProtocol != _STREAM_PROTOCOL_TCP {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("can't receive tracks with different protocols"))
+					return false
+				}
+
+				rtpChannel, rtcpChannel, err := c.interleavedChannels(th.GetValue("interleaved"))
+				if err != nil {
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				res := make(chan error)
+				c.p.events <- programEventClientSetupPlay{res, c, path, control, _STREAM_PROTOCOL_TCP, srtp, 0, 0, rtpChannel, rtcpChannel, nil}
+				err = <-res
+				if err != nil {
+					if err == errProtocolDisabled {
+						c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("TCP streaming is disabled"))
+						return false
+					}
+					if err == errSrtpMismatch {
+						writeSrtpMismatch()
+						return false
+					}
+					if err == errTrackNotFound {
+						c.writeResError(req, gortsplib.StatusNotFound,
+							fmt.Errorf("track '%s' not found on path '%s'", control, path))
+						return false
+					}
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				interleaved := fmt.Sprintf("%d-%d", rtpChannel, rtcpChannel)
+
+				c.writeResponse(&gortsplib.Response{
+					StatusCode: gortsplib.StatusOK,
+					Header: gortsplib.Header{
+						"CSeq": cseq,
+						"Transport": []string{strings.Join([]string{
+							profile + "/TCP",
+							"unicast",
+							fmt.Sprintf("interleaved=%s", interleaved),
+						}, ";")},
+						"Session": c.sessionHeader(true),
+					},
+				})
+				return true
+
+			} else {
+				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not contain a valid protocol (RTP/AVP, RTP/AVP/UDP, RTP/AVP/TCP or their RTP/SAVP variants) (%s)", tsRaw[0]))
+				return false
+			}
+
+		// record
+		case _CLIENT_STATE_ANNOUNCE, _CLIENT_STATE_PRE_RECORD:
+			if _, ok := th["mode=record"]; !ok {
+				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not contain mode=record"))
+				return false
+			}
+
+			// after ANNOUNCE, c.path is already set
+			if path != c.path {
+				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+				return false
+			}
+
+			// record via UDP
+			if func() bool {
+				_, ok := th["RTP/AVP"]
+				if ok {
+					return true
+				}
+				_, ok = th["RTP/AVP/UDP"]
+				if ok {
+					return true
+				}
+				return false
+			}() {
+				if _, ok := c.p.protocols[_STREAM_PROTOCOL_UDP]; !ok {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("UDP streaming is disabled"))
+					return false
+				}
+
+				rtpPort, rtcpPort := th.GetPorts("client_port")
+				if rtpPort == 0 || rtcpPort == 0 {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not have valid client ports (%s)", tsRaw[0]))
+					return false
+				}
+
+				if len(c.streamTracks) > 0 && c.streamProtocol != _STREAM_PROTOCOL_UDP {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("can't publish tracks with different protocols"))
+					return false
+				}
+
+				if len(c.streamTracks) >= len(c.streamSdpParsed.Medias) {
+					c.writeResError(req, gortsplib.StatusMethodNotValidInThisState, fmt.Errorf("all the tracks have already been setup"))
+					return false
+				}
+
+				res := make(chan error)
+				c.p.events <- programEventClientSetupRecord{res, c, _STREAM_PROTOCOL_UDP, rtpPort, rtcpPort, 0, 0}
+				err := <-res
+				if err != nil {
+					if err == errProtocolDisabled {
+						c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("UDP streaming is disabled"))
+						return false
+					}
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				transport := []string{
+					"RTP/AVP/UDP",
+					"unicast",
+					fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
+					fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort),
+				}
+
+				// the publisher sends the stream to the external address
+				if c.p.conf.externalIp != nil {
+					transport = append(transport, "destination="+c.p.conf.externalIp.String())
+				}
+
+				c.writeResponse(&gortsplib.Response{
+					StatusCode: gortsplib.StatusOK,
+					Header: gortsplib.Header{
+						"CSeq":      cseq,
+						"Transport": []string{strings.Join(transport, ";")},
+						"Session":   c.sessionHeader(true),
+					},
+				})
+				return true
+
+				// record via TCP
+			} else if _, ok := th["RTP/AVP/TCP"]; ok {
+				if _, ok := c.p.protocols[_STREAM_PROTOCOL_TCP]; !ok {
+					c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("TCP streaming is disabled"))
+					return false
+				}
+
+				if len(c.streamTracks) > 0 && c.streamProtocol != _STREAM_PROTOCOL_TCP {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("can't publish tracks with different protocols"))
+					return false
+				}
+
+				interleaved := th.GetValue("interleaved")
+				if interleaved == "" {
+					c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not contain the interleaved field"))
+					return false
+				}
+
+				rtpChannel, rtcpChannel, err := c.interleavedChannels(interleaved)
+				if err != nil {
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				if len(c.streamTracks) >= len(c.streamSdpParsed.Medias) {
+					c.writeResError(req, gortsplib.StatusMethodNotValidInThisState, fmt.Errorf("all the tracks have already been setup"))
+					return false
+				}
+
+				res := make(chan error)
+				c.p.events <- programEventClientSetupRecord{res, c, _STREAM_PROTOCOL_TCP, 0, 0, rtpChannel, rtcpChannel}
+				err = <-res
+				if err != nil {
+					if err == errProtocolDisabled {
+						c.writeResError(req, gortsplib.StatusUnsupportedTransport, fmt.Errorf("TCP streaming is disabled"))
+						return false
+					}
+					c.writeResError(req, gortsplib.StatusBadRequest, err)
+					return false
+				}
+
+				c.writeResponse(&gortsplib.Response{
+					StatusCode: gortsplib.StatusOK,
+					Header: gortsplib.Header{
+						"CSeq": cseq,
+						"Transport": []string{strings.Join([]string{
+							"RTP/AVP/TCP",
+							"unicast",
+							fmt.Sprintf("interleaved=%s", interleaved),
+						}, ";")},
+						"Session": c.sessionHeader(true),
+					},
+				})
+				return true
+
+			} else {
+				c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("transport header does not contain a valid protocol (RTP/AVP, RTP/AVP/UDP or RTP/AVP/TCP) (%s)", tsRaw[0]))
+				return false
+			}
+
+		default:
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState, fmt.Errorf("client is in state '%s'", c.state))
+			return false
+		}
+
+	case gortsplib.PLAY:
+		if c.state != _CLIENT_STATE_PRE_PLAY {
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
+				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, _CLIENT_STATE_PRE_PLAY))
+			return false
+		}
+
+		if path != c.path {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+			return false
+		}
+
+		// readers of a stream that didn't start yet would fail because
+		// of the lack of packets, therefore the response is delayed
+		if pconf := c.p.findConfForPath(c.path); pconf != nil && pconf.ReadWaitFirstFrame > 0 {
+			res := make(chan struct{})
+			c.p.events <- programEventClientWaitFirstFrame{res, c}
+
+			select {
+			case <-res:
+			case <-time.After(pconf.ReadWaitFirstFrame):
+				c.log("no frames received within %s, replying anyway", pconf.ReadWaitFirstFrame)
+			}
+		}
+
+		// check publisher existence
+		pres := make(chan play1Res)
+		c.p.events <- programEventClientPlay1{pres, c}
+		play1 := <-pres
+		if play1.err != nil {
+			c.writeResError(req, gortsplib.StatusBadRequest, play1.err)
+			return false
+		}
+
+		header := gortsplib.Header{
+			"CSeq":    cseq,
+			"Session": c.sessionHeader(false),
+			// the stream is live, therefore it can only be played from now on
+			"Range": []string{"npt=0.000-"},
+		}
+
+		if play1.rtpInfo != nil {
+			baseUrl := strings.TrimSuffix(req.Url.String(), "/")
+
+			var entries []string
+			for _, info := range play1.rtpInfo {
+				entries = append(entries, fmt.Sprintf("url=%s/%s;seq=%d;rtptime=%d",
+					baseUrl, info.control, info.seq, info.rtpTime))
+			}
+			header["RTP-Info"] = []string{strings.Join(entries, ",")}
+		}
+
+		// write response before setting state
+		// otherwise, in case of TCP connections, RTP packets could be sent
+		// before the response
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header:     header,
+		})
+
+		// set state
+		res := make(chan error)
+		c.p.events <- programEventClientPlay2{res, c}
+		<-res
+
+		c.startMaxDurationTimer()
+
+		c.log("is receiving on path '%s', %d %s via %s", c.path, len(c.streamTracks), func() string {
+			if len(c.streamTracks) == 1 {
+				return "track"
+			}
+			return "tracks"
+		}(), c.streamProtocol)
+
+		// when protocol is TCP, RTP frames are interleaved with responses.
+		// The writer is started once, since the client can PAUSE and PLAY again
+		if c.streamProtocol == _STREAM_PROTOCOL_TCP && !c.writerStarted {
+			c.writerStarted = true
+
+			// write RTP frames sequentially
+			go func() {
+				if pconf := c.p.findConfForPath(c.path); pconf != nil && pconf.ReadTcpBatchWindow > 0 {
+					c.runBatchWriter(pconf.ReadTcpBatchWindow, pconf.ReadTcpBatchSize)
+					return
+				}
+
+				for frame := range c.writec {
+					if d := c.readLimiter.reserve(c.p.clock.Now(), len(frame.Content)); d > 0 {
+						time.Sleep(d)
+					}
+
+					c.writeMutex.Lock()
+					c.conn.WriteInterleavedFrame(frame)
+					c.writeMutex.Unlock()
+				}
+			}()
+		}
+
+		return true
+
+	case gortsplib.PAUSE:
+		if c.state != _CLIENT_STATE_PLAY && c.state != _CLIENT_STATE_PRE_PLAY {
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
+				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, _CLIENT_STATE_PLAY))
+			return false
+		}
+
+		if path != c.path {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+			return false
+		}
+
+		// a PAUSE received before PLAY, or while already paused,
+		// doesn't change the state of the session
+		if c.state == _CLIENT_STATE_PLAY {
+			c.log("paused")
+
+			res := make(chan error)
+			c.p.events <- programEventClientPause{res, c}
+			<-res
+		}
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":    cseq,
+				"Session": c.sessionHeader(false),
+			},
+		})
+		return true
+
+	case gortsplib.RECORD:
+		if c.state != _CLIENT_STATE_PRE_RECORD {
+			c.writeResError(req, gortsplib.StatusMethodNotValidInThisState,
+				fmt.Errorf("client is in state '%s' instead of '%s'", c.state, _CLIENT_STATE_PRE_RECORD))
+			return false
+		}
+
+		if path != c.path {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("path has changed"))
+			return false
+		}
+
+		if len(c.streamTracks) != len(c.streamSdpParsed.Medias) {
+			c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("not all tracks have been setup"))
+			return false
+		}
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":    cseq,
+				"Session": c.sessionHeader(false),
+			},
+		})
+
+		res := make(chan error)
+		c.p.events <- programEventClientRecord{res, c}
+		<-res
+
+		c.startMaxDurationTimer()
+
+		c.log("is publishing on path '%s', %d %s via %s", c.path, len(c.streamTracks), func() string {
+			if len(c.streamTracks) == 1 {
+				return "track"
+			}
+			return "tracks"
+		}(), c.streamProtocol)
+
+		// when protocol is TCP, the RTSP connection becomes a RTP connection
+		// receive RTP data and parse it
+		if c.streamProtocol == _STREAM_PROTOCOL_TCP {
+			frame := &gortsplib.InterleavedFrame{}
+			for {
+				if !c.readCurBuf {
+					frame.Content = c.readBuf1
+				} else {
+					frame.Content = c.readBuf2
+				}
+
+				// frames bigger than the buffer are rejected before their content is read
+				frame.Content = frame.Content[:c.p.conf.maxTcpFrameSize]
+				c.readCurBuf = !c.readCurBuf
+
+				// the limit must allow frames of maximum size
+				limit := c.p.conf.MaxRequestSize
+				if limit < 4+_MAX_FRAME_SIZE {
+					limit = 4 + _MAX_FRAME_SIZE
+				}
+				c.lconn.setLimit(limit)
+
+				recv, err := c.conn.ReadInterleavedFrameOrRequest(frame)
+				if err != nil {
+					if c.lconn.exceeded {
+						c.log("ERR: request is bigger than %d bytes", limit)
+						c.writeResponse(&gortsplib.Response{
+							StatusCode: gortsplib.StatusBadRequest,
+						})
+					} else if err != io.EOF {
+						c.log("ERR: %s (frames can't be bigger than %d bytes)", err, c.p.conf.maxTcpFrameSize)
+					}
+					return false
+				}
+
+				switch recvt := recv.(type) {
+				case *gortsplib.InterleavedFrame:
+					trackId, trackFlowType, ok := c.trackForInterleavedChannel(frame.Channel)
+					if !ok {
+						c.log("ERR: invalid interleaved channel %d", frame.Channel)
+						return false
+					}
+
+					c.p.events <- programEventClientFrameTcp{
+						c,
+						c.path,
+						trackId,
+						trackFlowType,
+						frame.Content,
+					}
+
+				case *gortsplib.Request:
+					if err := checkRequestHeader(recvt.Header, c.p.conf.MaxHeaderCount, c.p.conf.MaxHeaderSize); err != nil {
+						c.writeResError(recvt, gortsplib.StatusBadRequest, err)
+						return false
+					}
+
+					c.logRequest(recvt)
+
+					cseq, ok := recvt.Header["CSeq"]
+					if !ok || len(cseq) != 1 {
+						c.writeResError(recvt, gortsplib.StatusBadRequest, fmt.Errorf("cseq missing"))
+						return false
+					}
+
+					switch recvt.Method {
+					case gortsplib.OPTIONS:
+						c.writeOptionsResponse(cseq, c.path)
+
+					case gortsplib.GET_PARAMETER, gortsplib.SET_PARAMETER:
+						c.writeResponse(&gortsplib.Response{
+							StatusCode: gortsplib.StatusOK,
+							Header: gortsplib.Header{
+								"CSeq":    cseq,
+								"Session": c.sessionHeader(false),
+							},
+						})
+
+					case gortsplib.TEARDOWN:
+						sessionId := c.sessionId
+						c.teardown()
+
+						c.writeResponse(&gortsplib.Response{
+							StatusCode: gortsplib.StatusOK,
+							Header: gortsplib.Header{
+								"CSeq":    cseq,
+								"Session": []string{sessionId},
+							},
+						})
+						return true
+
+					default:
+						c.writeResError(recvt, gortsplib.StatusBadRequest, fmt.Errorf("unhandled method '%s'", recvt.Method))
+						return false
+					}
+				}
+
+			}
+		} else {
+			c.udpLastFrameTime = c.p.clock.Now()
+			c.udpCheckStreamTicker = time.NewTicker(_UDP_CHECK_STREAM_INTERVAL)
+
+			go func() {
+				for range c.udpCheckStreamTicker.C {
+					if c.p.clock.Now().Sub(c.udpLastFrameTime) >= _UDP_STREAM_DEAD_AFTER {
+						c.log("ERR: stream is dead")
+						c.conn.NetConn().Close()
+						break
+					}
+				}
+			}()
+		}
+
+		return true
+
+	case gortsplib.GET_PARAMETER, gortsplib.SET_PARAMETER:
+		// GET_PARAMETER and SET_PARAMETER are used as keepalive, parameters
+		// are not supported and are ignored
+		header := gortsplib.Header{
+			"CSeq": cseq,
+		}
+		if c.sessionId != "" {
+			header["Session"] = c.sessionHeader(false)
+		}
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header:     header,
+		})
+		return true
+
+	case gortsplib.TEARDOWN:
+		if c.sessionId == "" {
+			// close connection silently
+			return false
+		}
+
+		sessionId := c.sessionId
+		c.teardown()
+
+		c.writeResponse(&gortsplib.Response{
+			StatusCode: gortsplib.StatusOK,
+			Header: gortsplib.Header{
+				"CSeq":    cseq,
+				"Session": []string{sessionId},
+			},
+		})
+		return true
+
+	default:
+		c.writeResError(req, gortsplib.StatusBadRequest, fmt.Errorf("unhandled method '%s'", req.Method))
+		return false
+	}
+}
+
+// teardown resets the client to its pre-setup state, without closing
+// the connection, in order to allow another session to be set up.
+func (c *serverClient) teardown() {
+	if c.udpCheckStreamTicker != nil {
+		c.udpCheckStreamTicker.Stop()
+		c.udpCheckStreamTicker = nil
+	}
+
+	done := make(chan struct{})
+	c.p.events <- programEventClientTeardown{done, c}
+	<-done
+}
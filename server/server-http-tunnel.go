@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"time"
+)
+
+// RTSP over HTTP tunneling, used by clients to cross firewalls and proxies.
+// The client opens two HTTP connections that share the same x-sessioncookie:
+// a GET connection, used to send data from the server to the client, and
+// a POST connection, whose body contains base64-encoded data sent
+// from the client to the server.
+
+// httpTunnelDecoder decodes the body of the POST connection. Clients can
+// encode each message separately, therefore padding can be found anywhere
+// and data is decoded in blocks of 4 characters.
+type httpTunnelDecoder struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (d *httpTunnelDecoder) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		var in [4]byte
+		for n := 0; n < len(in); {
+			b, err := d.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+
+			switch b {
+			case '\r', '\n', ' ', '\t':
+				continue
+			}
+
+			in[n] = b
+			n++
+		}
+
+		var out [3]byte
+		n, err := base64.StdEncoding.Decode(out[:], in[:])
+		if err != nil {
+			return 0, err
+		}
+		d.buf = append(d.buf[:0], out[:n]...)
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// httpTunnelConn joins the GET and POST connections of a tunnel
+// into a bidirectional connection.
+type httpTunnelConn struct {
+	get  net.Conn
+	post net.Conn
+	dec  *httpTunnelDecoder
+}
+
+func newHttpTunnelConn(get net.Conn, post net.Conn, postReader *bufio.Reader) *httpTunnelConn {
+	return &httpTunnelConn{
+		get:  get,
+		post: post,
+		dec:  &httpTunnelDecoder{r: postReader},
+	}
+}
+
+func (t *httpTunnelConn) Read(p []byte) (int, error) {
+	return t.dec.Read(p)
+}
+
+func (t *httpTunnelConn) Write(p []byte) (int, error) {
+	return t.get.Write(p)
+}
+
+func (t *httpTunnelConn) Close() error {
+	t.post.Close()
+	return t.get.Close()
+}
+
+func (t *httpTunnelConn) LocalAddr() net.Addr {
+	return t.get.LocalAddr()
+}
+
+func (t *httpTunnelConn) RemoteAddr() net.Addr {
+	return t.get.RemoteAddr()
+}
+
+func (t *httpTunnelConn) SetDeadline(tm time.Time) error {
+	t.post.SetDeadline(tm)
+	return t.get.SetDeadline(tm)
+}
+
+func (t *httpTunnelConn) SetReadDeadline(tm time.Time) error {
+	return t.post.SetReadDeadline(tm)
+}
+
+func (t *httpTunnelConn) SetWriteDeadline(tm time.Time) error {
+	return t.get.SetWriteDeadline(tm)
+}
+
+// bufferedConn is a connection whose first bytes have already been read
+// into a buffer, in order to detect the protocol.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
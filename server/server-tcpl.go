@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// environment variable that contains the file descriptor of the RTSP
+// listener, when it is inherited from a previous instance during an upgrade
+const _LISTENER_FD_ENV = "RTSP_LISTENER_FD"
+
+type serverTcpListener struct {
+	p     *program
+	nconn *net.TCPListener
+
+	// connections whose protocol is not known yet
+	mutex      sync.Mutex
+	handshakes map[net.Conn]struct{}
+	tunnels    map[string]net.Conn // GET connections waiting for the POST one
+	closed     bool
+	wg         sync.WaitGroup
+	bufferLog  sync.Once
+
+	done chan struct{}
+}
+
+func newServerTcpListener(p *program) (*serverTcpListener, error) {
+	addr := &net.TCPAddr{
+		IP:   p.conf.listenIp,
+		Port: p.conf.RtspPort,
+	}
+
+	nconn, err := inheritedTcpListener()
+	if err != nil {
+		return nil, err
+	}
+
+	inherited := nconn != nil
+	if !inherited {
+		nconn, err = net.ListenTCP("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.conf.ListenBacklog != 0 {
+		err := socketSetListenBacklog(nconn, p.conf.ListenBacklog)
+		if err != nil {
+			nconn.Close()
+			return nil, fmt.Errorf("unable to set the listen backlog: %s", err)
+		}
+	}
+
+	l := &serverTcpListener{
+		p:          p,
+		nconn:      nconn,
+		handshakes: make(map[net.Conn]struct{}),
+		tunnels:    make(map[string]net.Conn),
+		done:       make(chan struct{}),
+	}
+
+	if inherited {
+		l.log("inherited on %s", nconn.Addr())
+	} else {
+		l.log("opened on %s", addr)
+	}
+	return l, nil
+}
+
+// inheritedTcpListener returns the listener passed by a previous instance
+// during an upgrade, or nil if there's none.
+func inheritedTcpListener() (*net.TCPListener, error) {
+	val := os.Getenv(_LISTENER_FD_ENV)
+	if val == "" {
+		return nil, nil
+	}
+
+	// the listener can be adopted only once
+	os.Unsetenv(_LISTENER_FD_ENV)
+
+	fd, err := strconv.Atoi(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inherited listener '%s'", val)
+	}
+
+	f := os.NewFile(uintptr(fd), "rtsp-listener")
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+
+	tln, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, fmt.Errorf("inherited listener is not a TCP listener")
+	}
+
+	return tln, nil
+}
+
+func (l *serverTcpListener) log(format string, args ...interface{}) {
+	l.p.log("[TCP listener] "+format, args...)
+}
+
+func (l *serverTcpListener) run() {
+	// connections can be accepted by multiple routines, since they're
+	// serialized by the program when they're added to the clients
+	var acceptWg sync.WaitGroup
+	acceptWg.Add(l.p.conf.AcceptRoutines)
+
+	for i := 0; i < l.p.conf.AcceptRoutines; i++ {
+		go func() {
+			defer acceptWg.Done()
+			l.runAccept()
+		}()
+	}
+
+	acceptWg.Wait()
+	close(l.done)
+}
+
+func (l *serverTcpListener) runAccept() {
+	for {
+		nconn, err := l.nconn.AcceptTCP()
+		if err != nil {
+			break
+		}
+
+		l.setBufferSizes(nconn)
+
+		l.wg.Add(1)
+		go l.handleConn(nconn)
+	}
+}
+
+// file returns a copy of the underlying socket, that can be passed to
+// another process.
+func (l *serverTcpListener) file() (*os.File, error) {
+	return l.nconn.File()
+}
+
+// stopAccepting closes the socket, in order to leave new connections to
+// another process, without closing the connections that are being set up.
+func (l *serverTcpListener) stopAccepting() {
+	l.nconn.Close()
+}
+
+func (l *serverTcpListener) close() {
+	l.nconn.Close()
+	<-l.done
+
+	l.mutex.Lock()
+	l.closed = true
+	for nconn := range l.handshakes {
+		nconn.Close()
+	}
+	for _, nconn := range l.tunnels {
+		nconn.Close()
+	}
+	l.mutex.Unlock()
+
+	l.wg.Wait()
+}
+
+func (l *serverTcpListener) setBufferSizes(nconn *net.TCPConn) {
+	if l.p.conf.ReadBufferSize != 0 {
+		if err := nconn.SetReadBuffer(l.p.conf.ReadBufferSize); err != nil {
+			l.log("ERR: unable to set the read buffer size: %s", err)
+		}
+	}
+	if l.p.conf.WriteBufferSize != 0 {
+		if err := nconn.SetWriteBuffer(l.p.conf.WriteBufferSize); err != nil {
+			l.log("ERR: unable to set the write buffer size: %s", err)
+		}
+	}
+
+	// the granted sizes are the same for all connections,
+	// print them only once
+	l.bufferLog.Do(func() {
+		if l.p.conf.ReadBufferSize != 0 {
+			if size, err := socketReadBufferSize(nconn); err == nil {
+				l.log("read buffer size is %d", size)
+			}
+		}
+		if l.p.conf.WriteBufferSize != 0 {
+			if size, err := socketWriteBufferSize(nconn); err == nil {
+				l.log("write buffer size is %d", size)
+			}
+		}
+	})
+}
+
+// handleConn detects whether the connection is a plain RTSP connection
+// or part of a RTSP over HTTP tunnel.
+func (l *serverTcpListener) handleConn(nconn net.Conn) {
+	defer l.wg.Done()
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		nconn.Close()
+		return
+	}
+	l.handshakes[nconn] = struct{}{}
+	l.mutex.Unlock()
+
+	removeHandshake := func() {
+		l.mutex.Lock()
+		delete(l.handshakes, nconn)
+		l.mutex.Unlock()
+	}
+
+	nconn.SetReadDeadline(time.Now().Add(l.p.conf.ReadTimeout))
+	br := bufio.NewReaderSize(nconn, 4096)
+
+	// RTSP methods never start with "GET " or "POST"
+	// (GET_PARAMETER is followed by an underscore)
+	method, err := br.Peek(4)
+	if err != nil {
+		removeHandshake()
+		nconn.Close()
+		return
+	}
+
+	switch string(method) {
+	case "GET ", "POST":
+		req, err := http.ReadRequest(br)
+		removeHandshake()
+		if err != nil {
+			nconn.Close()
+			return
+		}
+
+		if req.Method == "GET" {
+			l.handleTunnelGet(nconn, req)
+		} else {
+			l.handleTunnelPost(nconn, br, req)
+		}
+
+	default:
+		removeHandshake()
+		nconn.SetReadDeadline(time.Time{})
+		l.p.events <- programEventClientNew{&bufferedConn{nconn, br}}
+	}
+}
+
+func (l *serverTcpListener) handleTunnelGet(nconn net.Conn, req *http.Request) {
+	cookie := req.Header.Get("X-Sessioncookie")
+	if cookie == "" || !strings.Contains(req.Header.Get("Accept"), "application/x-rtsp-tunnelled") {
+		nconn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+		nconn.Close()
+		return
+	}
+
+	nconn.SetReadDeadline(time.Time{})
+	_, err := nconn.Write([]byte("HTTP/1.0 200 OK\r\n" +
+		"Server: " + l.p.conf.ServerHeader + "\r\n" +
+		"Connection: close\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Content-Type: application/x-rtsp-tunnelled\r\n" +
+		"\r\n"))
+	if err != nil {
+		nconn.Close()
+		return
+	}
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		nconn.Close()
+		return
+	}
+	if old, ok := l.tunnels[cookie]; ok {
+		old.Close()
+	}
+	l.tunnels[cookie] = nconn
+	l.mutex.Unlock()
+
+	// close the GET connection if the POST one doesn't arrive in time
+	time.AfterFunc(l.p.conf.ReadTimeout, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		if cur, ok := l.tunnels[cookie]; ok && cur == nconn {
+			delete(l.tunnels, cookie)
+			nconn.Close()
+		}
+	})
+}
+
+func (l *serverTcpListener) handleTunnelPost(nconn net.Conn, br *bufio.Reader, req *http.Request) {
+	cookie := req.Header.Get("X-Sessioncookie")
+
+	l.mutex.Lock()
+	get, ok := l.tunnels[cookie]
+	if ok {
+		delete(l.tunnels, cookie)
+	}
+	l.mutex.Unlock()
+
+	if !ok {
+		nconn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+		nconn.Close()
+		return
+	}
+
+	// the POST connection doesn't receive any response
+	nconn.SetReadDeadline(time.Time{})
+	l.p.events <- programEventClientNew{newHttpTunnelConn(get, nconn, br)}
+}
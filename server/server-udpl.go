@@ -0,0 +1,212 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type udpWrite struct {
+	addr *net.UDPAddr
+	buf  []byte
+}
+
+type udpRead struct {
+	addr *net.UDPAddr
+	buf  []byte
+}
+
+type serverUdpListener struct {
+	p             *program
+	nconn         *net.UDPConn
+	trackFlowType trackFlowType
+	readBufs      chan []byte // buffers that can be filled by the reader
+	readc         chan udpRead
+	writeMutex    sync.Mutex // write is called by the program and by the pacers
+	writeBuf1     []byte
+	writeBuf2     []byte
+	writeCurBuf   bool
+	writeClosed   bool
+
+	oversizedCount   int
+	oversizedLastLog time.Time
+
+	writec chan *udpWrite
+	done   chan struct{}
+}
+
+func newServerUdpListener(p *program, port int, trackFlowType trackFlowType) (*serverUdpListener, error) {
+	addr := &net.UDPAddr{
+		IP:   p.conf.listenIp,
+		Port: port,
+	}
+
+	nconn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.conf.UdpReadBufferSize != 0 {
+		err := nconn.SetReadBuffer(p.conf.UdpReadBufferSize)
+		if err != nil {
+			nconn.Close()
+			return nil, err
+		}
+	}
+
+	if p.conf.WriteBufferSize != 0 {
+		err := nconn.SetWriteBuffer(p.conf.WriteBufferSize)
+		if err != nil {
+			nconn.Close()
+			return nil, err
+		}
+	}
+
+	l := &serverUdpListener{
+		p:             p,
+		nconn:         nconn,
+		trackFlowType: trackFlowType,
+		readBufs:      make(chan []byte, p.conf.ReadBufferCount),
+		readc:         make(chan udpRead, p.conf.ReadBufferCount),
+		writeBuf1:     make([]byte, _MAX_FRAME_SIZE),
+		writeBuf2:     make([]byte, _MAX_FRAME_SIZE),
+		writec:        make(chan *udpWrite),
+		done:          make(chan struct{}),
+	}
+
+	for i := 0; i < p.conf.ReadBufferCount; i++ {
+		// an additional byte allows to detect truncated frames
+		l.readBufs <- make([]byte, p.conf.MaxFrameSize+1)
+	}
+
+	l.log("opened on %s", addr)
+
+	if p.conf.UdpReadBufferSize != 0 {
+		if size, err := socketReadBufferSize(nconn); err == nil {
+			l.log("read buffer size is %d", size)
+		}
+	}
+	if p.conf.WriteBufferSize != 0 {
+		if size, err := socketWriteBufferSize(nconn); err == nil {
+			l.log("write buffer size is %d", size)
+		}
+	}
+
+	return l, nil
+}
+
+func (l *serverUdpListener) log(format string, args ...interface{}) {
+	var label string
+	if l.trackFlowType == _TRACK_FLOW_RTP {
+		label = "RTP"
+	} else {
+		label = "RTCP"
+	}
+	l.p.log("[UDP/"+label+" listener] "+format, args...)
+}
+
+func (l *serverUdpListener) run() {
+	go func() {
+		for w := range l.writec {
+			l.nconn.SetWriteDeadline(time.Now().Add(l.p.conf.WriteTimeout))
+			l.nconn.WriteTo(w.buf, w.addr)
+		}
+	}()
+
+	forwardDone := make(chan struct{})
+	go l.runForward(forwardDone)
+
+	// the socket is read by a single routine, in order to preserve the
+	// order of packets. When the program is slow, packets are queued
+	// instead of filling the kernel buffer; when all the buffers are
+	// in use, reading stops until one is released.
+	for {
+		buf := <-l.readBufs
+		buf = buf[:cap(buf)]
+
+		n, addr, err := l.nconn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		if n > l.p.conf.MaxFrameSize {
+			l.oversizedCount++
+			if time.Since(l.oversizedLastLog) >= _OVERSIZED_FRAME_LOG_INTERVAL {
+				l.oversizedLastLog = time.Now()
+				l.log("ERR: frames bigger than %d bytes, %d frames dropped",
+					l.p.conf.MaxFrameSize, l.oversizedCount)
+			}
+			l.readBufs <- buf
+			continue
+		}
+
+		l.readc <- udpRead{
+			addr: addr,
+			buf:  buf[:n],
+		}
+	}
+
+	close(l.readc)
+	<-forwardDone
+
+	l.writeMutex.Lock()
+	l.writeClosed = true
+	close(l.writec)
+	l.writeMutex.Unlock()
+
+	close(l.done)
+}
+
+func (l *serverUdpListener) runForward(done chan struct{}) {
+	defer close(done)
+
+	var prevBuf []byte
+
+	for r := range l.readc {
+		l.p.events <- programEventClientFrameUdp{
+			l.trackFlowType,
+			r.addr,
+			r.buf,
+		}
+
+		// the program accepts an event only after it has finished processing
+		// the previous one, therefore the previous buffer can be reused
+		if prevBuf != nil {
+			l.readBufs <- prevBuf
+		}
+		prevBuf = r.buf
+	}
+}
+
+func (l *serverUdpListener) close() {
+	l.nconn.Close()
+	<-l.done
+}
+
+func (l *serverUdpListener) write(addr *net.UDPAddr, inbuf []byte) {
+	// a buffer can be filled again only after the writer has received
+	// the other one, therefore the copy and the send are serialized
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+
+	// pacers can still be sending queued packets
+	if l.writeClosed {
+		return
+	}
+
+	var buf []byte
+	if !l.writeCurBuf {
+		buf = l.writeBuf1
+	} else {
+		buf = l.writeBuf2
+	}
+
+	buf = buf[:len(inbuf)]
+	copy(buf, inbuf)
+	l.writeCurBuf = !l.writeCurBuf
+
+	l.writec <- &udpWrite{
+		addr: addr,
+		buf:  buf,
+	}
+}
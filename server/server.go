@@ -0,0 +1,72 @@
+// Package server contains rtsp-simple-server, that can be run inside another
+// program through Server.
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Server is an RTSP server that can be run inside another program.
+// Unlike the command-line entry point, it doesn't read os.Args, doesn't
+// parse flags and never calls os.Exit.
+type Server struct {
+	p *program
+
+	mutex   sync.Mutex
+	started bool
+	closed  bool
+}
+
+// New validates a configuration and allocates a Server. Missing values of
+// the configuration are filled with their defaults. No socket is opened
+// until Start is called.
+func New(conf *Conf) (*Server, error) {
+	if conf == nil {
+		conf = &Conf{}
+	}
+
+	p, err := newProgramFromConf(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{p: p}, nil
+}
+
+// Start opens the listeners and starts serving clients.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started {
+		return fmt.Errorf("server has already been started")
+	}
+	if s.closed {
+		return fmt.Errorf("server has been closed")
+	}
+
+	err := s.p.start()
+	if err != nil {
+		return err
+	}
+
+	s.started = true
+	return nil
+}
+
+// Close disconnects all clients, closes the listeners and waits for all
+// the goroutines of the server to exit.
+func (s *Server) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	if s.started {
+		s.p.close()
+	}
+}
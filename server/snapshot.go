@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_SNAPSHOT_TIMEOUT = 10 * time.Second
+)
+
+type snapshotPath struct {
+	mutex sync.Mutex // held while the snapshot is generated
+	jpeg  []byte
+	time  time.Time
+}
+
+// snapshotter converts the last H264 keyframe of a path, buffered by its HLS
+// muxer, into a JPEG image, with the external process set with snapshotCommand.
+// The process receives the keyframe on standard input, as a H264 Annex-B
+// stream, and must write the image on standard output. Snapshots of a path
+// are generated at most once per snapshotInterval, requests received in the
+// meantime receive the last one.
+type snapshotter struct {
+	p       *program
+	command []string
+
+	mutex sync.Mutex
+	paths map[string]*snapshotPath
+}
+
+func newSnapshotter(p *program) *snapshotter {
+	return &snapshotter{
+		p:       p,
+		command: strings.Fields(p.conf.SnapshotCommand),
+		paths:   make(map[string]*snapshotPath),
+	}
+}
+
+func (s *snapshotter) get(path string, keyframe []byte) ([]byte, error) {
+	s.mutex.Lock()
+	sp, ok := s.paths[path]
+	if !ok {
+		sp = &snapshotPath{}
+		s.paths[path] = sp
+	}
+	s.mutex.Unlock()
+
+	// concurrent requests wait for the same snapshot
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	now := s.p.clock.Now()
+	if sp.jpeg != nil && now.Sub(sp.time) < s.p.conf.SnapshotInterval {
+		return sp.jpeg, nil
+	}
+
+	jpeg, err := s.decode(keyframe)
+	if err != nil {
+		return nil, err
+	}
+
+	sp.jpeg = jpeg
+	sp.time = now
+	return jpeg, nil
+}
+
+// remove deletes the last snapshot of a path, when its HLS muxer stops.
+func (s *snapshotter) remove(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.paths, path)
+}
+
+func (s *snapshotter) decode(keyframe []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), _SNAPSHOT_TIMEOUT)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stdin = bytes.NewReader(keyframe)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// JPEG images begin with the SOI marker
+	if !bytes.HasPrefix(stdout.Bytes(), []byte{0xFF, 0xD8}) {
+		return nil, fmt.Errorf("the output of the snapshot command is not a JPEG image")
+	}
+
+	return stdout.Bytes(), nil
+}
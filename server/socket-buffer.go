@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+func socketBufferSize(conn syscall.Conn, opt int) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		size, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, serr
+}
+
+// socketReadBufferSize returns the read buffer size granted by the kernel.
+func socketReadBufferSize(conn syscall.Conn) (int, error) {
+	return socketBufferSize(conn, syscall.SO_RCVBUF)
+}
+
+// socketWriteBufferSize returns the write buffer size granted by the kernel.
+func socketWriteBufferSize(conn syscall.Conn) (int, error) {
+	return socketBufferSize(conn, syscall.SO_SNDBUF)
+}
+
+// socketSetListenBacklog changes the size of the queue of the connections
+// that are waiting to be accepted, by calling listen() again.
+func socketSetListenBacklog(conn syscall.Conn, backlog int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// socketIsAddrInUse returns whether a listener can't be opened since its
+// address is in use.
+func socketIsAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
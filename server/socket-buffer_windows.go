@@ -0,0 +1,27 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// _WSAEADDRINUSE is the error of addresses in use, that is not mapped to
+// EADDRINUSE by the syscall package.
+const _WSAEADDRINUSE = syscall.Errno(10048)
+
+func socketReadBufferSize(conn syscall.Conn) (int, error) {
+	return 0, fmt.Errorf("not supported")
+}
+
+func socketWriteBufferSize(conn syscall.Conn) (int, error) {
+	return 0, fmt.Errorf("not supported")
+}
+
+func socketSetListenBacklog(conn syscall.Conn, backlog int) error {
+	return fmt.Errorf("not supported")
+}
+
+func socketIsAddrInUse(err error) bool {
+	return errors.Is(err, _WSAEADDRINUSE)
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"gortc.io/sdp"
+)
+
+// sourceRedirect is a publisher that does not provide any stream, and is used
+// to redirect readers to another RTSP server.
+type sourceRedirect struct {
+	url string
+}
+
+func newSourceRedirect(url string) *sourceRedirect {
+	return &sourceRedirect{
+		url: url,
+	}
+}
+
+// a redirect is never ready, since it can't be read
+func (r *sourceRedirect) publisherIsReady() bool {
+	return false
+}
+
+func (r *sourceRedirect) publisherSdpText() []byte {
+	return nil
+}
+
+func (r *sourceRedirect) publisherSdpParsed() *sdp.Message {
+	return nil
+}
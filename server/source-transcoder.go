@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib"
+)
+
+const (
+	_TRANSCODER_QUEUE_SIZE        = 1024
+	_TRANSCODER_DROP_LOG_INTERVAL = 5 * time.Second
+	_TRANSCODER_MAX_SDP_LINES     = 1024
+)
+
+// sourceTranscoder passes the stream of a source through an external process,
+// and publishes the output of the process in place of the source.
+//
+// The process receives on standard input the SDP of the source, followed by
+// an empty line, and then the frames of the source, encoded as interleaved
+// frames ('$', channel, 16-bit size, content), where the channel is 2*track
+// for RTP and 2*track+1 for RTCP. The process must write on standard output
+// its SDP, followed by an empty line, and then its frames, in the same format.
+// The process is restarted if it exits while the source is available.
+type sourceTranscoder struct {
+	s       *streamer
+	command []string
+
+	mutex          sync.Mutex
+	droppedCount   int
+	droppedLastLog time.Time
+
+	queue     chan []byte
+	terminate chan struct{}
+	done      chan struct{}
+}
+
+func newSourceTranscoder(s *streamer, command string) *sourceTranscoder {
+	return &sourceTranscoder{
+		s:       s,
+		command: strings.Fields(command),
+		queue:   make(chan []byte, _TRANSCODER_QUEUE_SIZE),
+	}
+}
+
+func (t *sourceTranscoder) log(format string, args ...interface{}) {
+	t.s.log("[transcoder] "+format, args...)
+}
+
+// start launches the process. It is called when the source becomes available.
+func (t *sourceTranscoder) start(sourceSdpText []byte) {
+	t.terminate = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.run(sourceSdpText, t.terminate, t.done)
+}
+
+// stop kills the process. It is called when the source is not available anymore.
+func (t *sourceTranscoder) stop() {
+	close(t.terminate)
+	<-t.done
+}
+
+// write enqueues a frame of the source. It is called by the streamer,
+// therefore it never blocks: frames are dropped if the process is too slow.
+func (t *sourceTranscoder) write(trackId int, trackFlowType trackFlowType, buf []byte) {
+	frame := make([]byte, 4+len(buf))
+	frame[0] = '$'
+	frame[1] = uint8(trackId*2) + uint8(trackFlowType)
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(buf)))
+	copy(frame[4:], buf)
+
+	select {
+	case t.queue <- frame:
+	default:
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		t.droppedCount++
+		if time.Since(t.droppedLastLog) >= _TRANSCODER_DROP_LOG_INTERVAL {
+			t.droppedLastLog = time.Now()
+			t.log("ERR: process is too slow, %d frames dropped", t.droppedCount)
+		}
+	}
+}
+
+func (t *sourceTranscoder) run(sourceSdpText []byte, terminate chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		ok := t.do(sourceSdpText, terminate)
+		if !ok {
+			return
+		}
+
+		select {
+		case <-terminate:
+			return
+		case <-time.After(_RETRY_INTERVAL):
+		}
+	}
+}
+
+func (t *sourceTranscoder) do(sourceSdpText []byte, terminate chan struct{}) bool {
+	t.log("starting process")
+
+	cmd := exec.Command(t.command[0], t.command[1:]...)
+	cmd.Env = append(os.Environ(), "RTSP_PATH="+t.s.path)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.log("ERR: %s", err)
+		return true
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		t.log("ERR: %s", err)
+		return true
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		stdin.Close()
+		stdout.Close()
+		t.log("ERR: %s", err)
+		return true
+	}
+
+	stopWriter := make(chan struct{})
+	writerDone := make(chan struct{})
+	go t.runWriter(stdin, sourceSdpText, stopWriter, writerDone)
+
+	readerDone := make(chan error)
+	go func() {
+		readerDone <- t.runReader(stdout)
+	}()
+
+	terminated := false
+	select {
+	case <-terminate:
+		cmd.Process.Kill()
+		<-readerDone
+		terminated = true
+
+	case err := <-readerDone:
+		t.log("ERR: %s", err)
+		cmd.Process.Kill()
+	}
+
+	close(stopWriter)
+	<-writerDone
+	cmd.Wait()
+
+	return !terminated
+}
+
+func (t *sourceTranscoder) runWriter(w io.WriteCloser, sourceSdpText []byte,
+	stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer w.Close()
+
+	// frames queued while the process was not running refer to a
+	// previous stream, or were sent before the SDP
+	t.drainQueue()
+
+	_, err := w.Write(append(append([]byte(nil), sourceSdpText...), "\r\n"...))
+	if err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case frame := <-t.queue:
+			_, err := w.Write(frame)
+			if err != nil {
+				// the reader stops too, since the process exited
+				<-stop
+				return
+			}
+		}
+	}
+}
+
+func (t *sourceTranscoder) drainQueue() {
+	for {
+		select {
+		case <-t.queue:
+		default:
+			return
+		}
+	}
+}
+
+func (t *sourceTranscoder) runReader(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 4096)
+
+	var sdpText []byte
+	for i := 0; ; i++ {
+		if i >= _TRANSCODER_MAX_SDP_LINES {
+			return fmt.Errorf("SDP is too long")
+		}
+
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		sdpText = append(append(sdpText, line...), "\r\n"...)
+	}
+
+	sdpParsed, err := sdpParse(sdpText)
+	if err != nil {
+		return fmt.Errorf("invalid SDP: %s", err)
+	}
+	if len(sdpParsed.Medias) == 0 {
+		return fmt.Errorf("SDP does not contain any media")
+	}
+
+	// the stream is published with the SDP of the process, that is passed to
+	// the program since the SDP of the streamer belongs to its routine
+	serverSdpParsed, serverSdpText := gortsplib.SDPFilter(sdpParsed, sdpText)
+	t.s.p.events <- programEventStreamerReady{t.s, serverSdpText, serverSdpParsed}
+
+	defer func() {
+		t.s.p.events <- programEventStreamerNotReady{t.s}
+	}()
+
+	// the buffers are alternated, since a frame is read while the
+	// previous one is being processed
+	bufs := [2][]byte{make([]byte, 65536), make([]byte, 65536)}
+	cur := 0
+
+	header := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(br, header)
+		if err != nil {
+			return err
+		}
+
+		if header[0] != '$' {
+			return fmt.Errorf("wrong frame magic byte 0x%.2x", header[0])
+		}
+
+		trackId, trackFlowType := interleavedChannelToTrack(header[1])
+		if trackId >= len(serverSdpParsed.Medias) {
+			return fmt.Errorf("frame refers to track %d, that does not exist", trackId)
+		}
+
+		buf := bufs[cur][:binary.BigEndian.Uint16(header[2:])]
+		cur = (cur + 1) % 2
+
+		_, err = io.ReadFull(br, buf)
+		if err != nil {
+			return err
+		}
+
+		t.s.p.events <- programEventStreamerFrame{t.s, trackId, trackFlowType, buf}
+	}
+}
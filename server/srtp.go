@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// SRTP with the AES_CM_128_HMAC_SHA1_80 crypto suite (RFC 3711), whose keys
+// are exchanged with SDES (RFC 4568).
+const (
+	_SRTP_CRYPTO_SUITE    = "AES_CM_128_HMAC_SHA1_80"
+	_SRTP_KEY_LEN         = 16
+	_SRTP_SALT_LEN        = 14
+	_SRTP_AUTH_KEY_LEN    = 20
+	_SRTP_AUTH_TAG_LEN    = 10
+	_SRTP_MAX_SRTCP_INDEX = 0x7FFFFFFF
+)
+
+// key derivation labels
+const (
+	_SRTP_LABEL_RTP_ENCRYPTION  = 0x00
+	_SRTP_LABEL_RTP_AUTH        = 0x01
+	_SRTP_LABEL_RTP_SALT        = 0x02
+	_SRTP_LABEL_RTCP_ENCRYPTION = 0x03
+	_SRTP_LABEL_RTCP_AUTH       = 0x04
+	_SRTP_LABEL_RTCP_SALT       = 0x05
+)
+
+// newSrtpMasterKey generates a random master key followed by a random
+// master salt.
+func newSrtpMasterKey() ([]byte, error) {
+	key := make([]byte, _SRTP_KEY_LEN+_SRTP_SALT_LEN)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type srtpSessionKeys struct {
+	block cipher.Block
+	salt  []byte
+	auth  hash.Hash
+}
+
+type srtpSsrcState struct {
+	roc     uint32
+	lastSeq uint16
+}
+
+// srtpContext encrypts and authenticates the RTP and RTCP packets sent to
+// a reader, for a single track. It is used only by the program routine.
+type srtpContext struct {
+	rtp        srtpSessionKeys
+	rtcp       srtpSessionKeys
+	ssrcs      map[uint32]*srtpSsrcState
+	srtcpIndex uint32
+}
+
+func newSrtpContext(masterKey []byte) (*srtpContext, error) {
+	if len(masterKey) != _SRTP_KEY_LEN+_SRTP_SALT_LEN {
+		return nil, fmt.Errorf("invalid SRTP master key length")
+	}
+
+	master, err := aes.NewCipher(masterKey[:_SRTP_KEY_LEN])
+	if err != nil {
+		return nil, err
+	}
+	masterSalt := masterKey[_SRTP_KEY_LEN:]
+
+	sessionKeys := func(encLabel byte, authLabel byte, saltLabel byte) (srtpSessionKeys, error) {
+		block, err := aes.NewCipher(srtpDeriveKey(master, masterSalt, encLabel, _SRTP_KEY_LEN))
+		if err != nil {
+			return srtpSessionKeys{}, err
+		}
+
+		return srtpSessionKeys{
+			block: block,
+			salt:  srtpDeriveKey(master, masterSalt, saltLabel, _SRTP_SALT_LEN),
+			auth:  hmac.New(sha1.New, srtpDeriveKey(master, masterSalt, authLabel, _SRTP_AUTH_KEY_LEN)),
+		}, nil
+	}
+
+	c := &srtpContext{
+		ssrcs: make(map[uint32]*srtpSsrcState),
+	}
+
+	c.rtp, err = sessionKeys(_SRTP_LABEL_RTP_ENCRYPTION, _SRTP_LABEL_RTP_AUTH, _SRTP_LABEL_RTP_SALT)
+	if err != nil {
+		return nil, err
+	}
+
+	c.rtcp, err = sessionKeys(_SRTP_LABEL_RTCP_ENCRYPTION, _SRTP_LABEL_RTCP_AUTH, _SRTP_LABEL_RTCP_SALT)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// srtpDeriveKey derives a session key from the master key, with a key
+// derivation rate of zero (RFC 3711, section 4.3).
+func srtpDeriveKey(master cipher.Block, masterSalt []byte, label byte, n int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, masterSalt)
+	iv[7] ^= label
+
+	out := make([]byte, n)
+	cipher.NewCTR(master, iv).XORKeyStream(out, out)
+	return out
+}
+
+// srtpIv computes the initialization vector of the AES counter mode
+// (RFC 3711, section 4.1.1).
+func srtpIv(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], ssrc)
+	for i := 0; i < 4; i++ {
+		iv[4+i] ^= buf[i]
+	}
+
+	binary.BigEndian.PutUint64(buf[:], index)
+	for i := 0; i < 8; i++ {
+		iv[6+i] ^= buf[i]
+	}
+
+	return iv
+}
+
+func (k *srtpSessionKeys) authTag(parts ...[]byte) []byte {
+	k.auth.Reset()
+	for _, p := range parts {
+		k.auth.Write(p)
+	}
+	return k.auth.Sum(nil)[:_SRTP_AUTH_TAG_LEN]
+}
+
+// rtpHeaderLen returns the length of the header of a RTP packet, including
+// CSRCs and extensions.
+func rtpHeaderLen(pkt []byte) (int, error) {
+	if len(pkt) < 12 {
+		return 0, fmt.Errorf("RTP packet is too short")
+	}
+
+	n := 12 + int(pkt[0]&0x0F)*4
+
+	// extension
+	if (pkt[0] & 0x10) != 0 {
+		if len(pkt) < n+4 {
+			return 0, fmt.Errorf("RTP packet is too short")
+		}
+		n += 4 + int(binary.BigEndian.Uint16(pkt[n+2:]))*4
+	}
+
+	if len(pkt) < n {
+		return 0, fmt.Errorf("RTP packet is too short")
+	}
+	return n, nil
+}
+
+// rolloverCounter returns the rollover counter of a packet, by estimating
+// it from the highest sequence number sent so far (RFC 3711, appendix A).
+func (c *srtpContext) rolloverCounter(ssrc uint32, seq uint16) uint32 {
+	state, ok := c.ssrcs[ssrc]
+	if !ok {
+		c.ssrcs[ssrc] = &srtpSsrcState{lastSeq: seq}
+		return 0
+	}
+
+	diff := int32(seq) - int32(state.lastSeq)
+
+	switch {
+	// the sequence number wrapped around
+	case diff < -0x8000:
+		state.roc++
+		state.lastSeq = seq
+		return state.roc
+
+	// late packet sent before a wrap around
+	case diff > 0x8000:
+		if state.roc == 0 {
+			return 0
+		}
+		return state.roc - 1
+
+	case diff > 0:
+		state.lastSeq = seq
+	}
+
+	return state.roc
+}
+
+// encryptRtp returns the SRTP version of a RTP packet.
+func (c *srtpContext) encryptRtp(pkt []byte) ([]byte, error) {
+	headerLen, err := rtpHeaderLen(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	ssrc := binary.BigEndian.Uint32(pkt[8:])
+	roc := c.rolloverCounter(ssrc, seq)
+
+	out := make([]byte, len(pkt), len(pkt)+_SRTP_AUTH_TAG_LEN)
+	copy(out, pkt[:headerLen])
+
+	iv := srtpIv(c.rtp.salt, ssrc, uint64(roc)<<16|uint64(seq))
+	cipher.NewCTR(c.rtp.block, iv).XORKeyStream(out[headerLen:], pkt[headerLen:])
+
+	var rocBuf [4]byte
+	binary.BigEndian.PutUint32(rocBuf[:], roc)
+	return append(out, c.rtp.authTag(out, rocBuf[:])...), nil
+}
+
+// encryptRtcp returns the SRTCP version of a RTCP compound packet.
+func (c *srtpContext) encryptRtcp(pkt []byte) ([]byte, error) {
+	if len(pkt) < 8 {
+		return nil, fmt.Errorf("RTCP packet is too short")
+	}
+
+	ssrc := binary.BigEndian.Uint32(pkt[4:])
+	index := c.srtcpIndex
+	c.srtcpIndex = (c.srtcpIndex + 1) & _SRTP_MAX_SRTCP_INDEX
+
+	out := make([]byte, len(pkt), len(pkt)+4+_SRTP_AUTH_TAG_LEN)
+	copy(out, pkt[:8])
+
+	iv := srtpIv(c.rtcp.salt, ssrc, uint64(index))
+	cipher.NewCTR(c.rtcp.block, iv).XORKeyStream(out[8:], pkt[8:])
+
+	// the E flag signals that the packet is encrypted
+	var indexBuf [4]byte
+	binary.BigEndian.PutUint32(indexBuf[:], index|0x80000000)
+	out = append(out, indexBuf[:]...)
+
+	return append(out, c.rtcp.authTag(out)...), nil
+}
+
+// srtpSdp returns a SDP in which all medias use the RTP/SAVP profile and
+// carry the crypto attribute with their master key.
+func srtpSdp(sdpText []byte, masterKeys [][]byte) []byte {
+	lines := strings.Split(strings.TrimRight(string(sdpText), "\r\n"), "\n")
+
+	var out []string
+	media := -1
+
+	// the crypto attribute is appended at the end of each media section
+	addCrypto := func() {
+		if media >= 0 && media < len(masterKeys) {
+			out = append(out, "a=crypto:1 "+_SRTP_CRYPTO_SUITE+" inline:"+
+				base64.StdEncoding.EncodeToString(masterKeys[media]))
+		}
+	}
+
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+
+		if strings.HasPrefix(line, "m=") {
+			addCrypto()
+			media++
+
+			// format is "m=<media> <port> <proto> <fmt> ..."
+			parts := strings.Split(line, " ")
+			if len(parts) >= 3 && parts[2] == "RTP/AVP" {
+				parts[2] = "RTP/SAVP"
+			}
+			line = strings.Join(parts, " ")
+		}
+
+		out = append(out, line)
+	}
+	addCrypto()
+
+	return []byte(strings.Join(out, "\r\n") + "\r\n")
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"net"
@@ -19,6 +19,7 @@ type streamerUdpListener struct {
 	trackFlowType trackFlowType
 	publisherIp   net.IP
 	publisherPort int
+	rtcpReceiver  *rtcpReceiver // filled only if receiver reports are generated
 	nconn         *net.UDPConn
 	running       bool
 	readBuf1      []byte
@@ -47,7 +48,7 @@ func newStreamerUdpListener(p *program, port int, streamer *streamer,
 		nconn:         nconn,
 		readBuf1:      make([]byte, 2048),
 		readBuf2:      make([]byte, 2048),
-		lastFrameTime: time.Now(),
+		lastFrameTime: p.clock.Now(),
 		done:          make(chan struct{}),
 	}
 
@@ -62,6 +63,14 @@ func (l *streamerUdpListener) close() {
 	}
 }
 
+// write sends a packet to the port of the publisher.
+func (l *streamerUdpListener) write(buf []byte) {
+	l.nconn.WriteTo(buf, &net.UDPAddr{
+		IP:   l.publisherIp,
+		Port: l.publisherPort,
+	})
+}
+
 func (l *streamerUdpListener) start() {
 	l.running = true
 	go l.run()
@@ -86,9 +95,17 @@ func (l *streamerUdpListener) run() {
 			continue
 		}
 
-		l.lastFrameTime = time.Now()
+		l.lastFrameTime = l.p.clock.Now()
+
+		if l.rtcpReceiver != nil {
+			if l.trackFlowType == _TRACK_FLOW_RTP {
+				l.rtcpReceiver.processRtp(l.lastFrameTime, buf[:n])
+			} else {
+				l.rtcpReceiver.processRtcp(l.lastFrameTime, buf[:n])
+			}
+		}
 
-		l.p.events <- programEventStreamerFrame{l.streamer, l.trackId, l.trackFlowType, buf[:n]}
+		l.streamer.onFrame(l.trackId, l.trackFlowType, buf[:n])
 	}
 
 	close(l.done)
@@ -1,6 +1,11 @@
-package main
+package server
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"net"
@@ -19,54 +24,132 @@ const (
 	_CHECK_STREAM_INTERVAL = 6 * time.Second
 	_STREAM_DEAD_AFTER     = 5 * time.Second
 	_KEEPALIVE_INTERVAL    = 60 * time.Second
+
+	// in auto mode, time to wait for the first UDP packet before
+	// switching to TCP
+	_UDP_FIRST_FRAME_TIMEOUT = 5 * time.Second
 )
 
 type streamerUdpListenerPair struct {
-	udplRtp  *streamerUdpListener
-	udplRtcp *streamerUdpListener
+	udplRtp      *streamerUdpListener
+	udplRtcp     *streamerUdpListener
+	rtcpReceiver *rtcpReceiver
 }
 
 type streamer struct {
 	p               *program
 	path            string
 	ur              *url.URL
+	user            string
+	pass            string
+	userAgent       string
+	tlsConf         *tls.Config       // filled only if the source uses RTSPS
+	transcoder      *sourceTranscoder // filled only if the source is transcoded
 	proto           streamProtocol
+	autoProto       bool // try UDP first, then TCP
 	ready           bool
+	failed          bool // the last attempt failed before publishing, filled by the program routine
 	clientSdpParsed *sdp.Message
 	serverSdpText   []byte
 	serverSdpParsed *sdp.Message
 	firstTime       bool
+	published       bool // the current attempt has started publishing
 	readBuf1        []byte
 	readBuf2        []byte
 	readCurBuf      bool
 
+	// SDP of the published stream, that is the one of the transcoder if
+	// sourceTranscode is set. It is filled by the program routine
+	publishedSdpText   []byte
+	publishedSdpParsed *sdp.Message
+
 	terminate chan struct{}
 	done      chan struct{}
 }
 
-func newStreamer(p *program, path string, source string, sourceProtocol string) (*streamer, error) {
+// redactUrl returns the url with the password replaced, in order to print it
+// without leaking credentials.
+func redactUrl(ur *url.URL) string {
+	if ur.User == nil {
+		return ur.String()
+	}
+
+	if _, ok := ur.User.Password(); !ok {
+		return ur.String()
+	}
+
+	ru := *ur
+	ru.User = url.UserPassword(ur.User.Username(), "xxxxx")
+	return ru.String()
+}
+
+// sourceTlsConf returns the TLS configuration used to connect to a RTSPS
+// source. When a fingerprint is pinned, the certificate chain is not verified,
+// and the certificate of the server must match the fingerprint instead.
+func sourceTlsConf(host string, fingerprint []byte, insecureSkipVerify bool,
+	minVersion uint16, cipherSuites []uint16) *tls.Config {
+	conf := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecureSkipVerify,
+		MinVersion:         minVersion,
+		CipherSuites:       cipherSuites,
+	}
+
+	if fingerprint != nil {
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server did not provide a certificate")
+			}
+
+			h := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(h[:], fingerprint) {
+				return fmt.Errorf("source fingerprint mismatch: expected %s, got %s",
+					hex.EncodeToString(fingerprint), hex.EncodeToString(h[:]))
+			}
+			return nil
+		}
+	}
+
+	return conf
+}
+
+func newStreamer(p *program, path string, source string, sourceProtocol string,
+	sourceUser string, sourcePass string, sourceUserAgent string,
+	sourceFingerprint []byte, sourceInsecureSkipVerify bool, sourceTranscode string) (*streamer, error) {
 	ur, err := url.Parse(source)
 	if err != nil {
-		return nil, fmt.Errorf("'%s' is not a valid source not an RTSP url", source)
-	}
-	if ur.Scheme != "rtsp" {
-		return nil, fmt.Errorf("'%s' is not a valid RTSP url", source)
+		return nil, fmt.Errorf("path '%s': source is not a valid url", path)
 	}
 	if ur.Port() == "" {
-		ur.Host += ":554"
+		if ur.Scheme == "rtsps" {
+			ur.Host += ":322"
+		} else {
+			ur.Host += ":554"
+		}
+	}
+
+	var tlsConf *tls.Config
+	if ur.Scheme == "rtsps" {
+		tlsConf = sourceTlsConf(ur.Hostname(), sourceFingerprint, sourceInsecureSkipVerify,
+			p.conf.tlsMinVersion, p.conf.tlsCipherSuites)
 	}
+
+	// credentials have been checked by checkConf
+	user := sourceUser
+	pass := sourcePass
 	if ur.User != nil {
-		pass, _ := ur.User.Password()
-		user := ur.User.Username()
-		if user != "" && pass == "" ||
-			user == "" && pass != "" {
-			fmt.Errorf("username and password must be both provided")
-		}
+		user = ur.User.Username()
+		pass, _ = ur.User.Password()
+
+		// credentials are sent through the Authorization header,
+		// not through the request urls
+		ur.User = nil
 	}
 
 	proto, err := func() (streamProtocol, error) {
 		switch sourceProtocol {
-		case "udp":
+		case "udp", "auto":
 			return _STREAM_PROTOCOL_UDP, nil
 
 		case "tcp":
@@ -82,7 +165,12 @@ func newStreamer(p *program, path string, source string, sourceProtocol string)
 		p:         p,
 		path:      path,
 		ur:        ur,
+		user:      user,
+		pass:      pass,
+		userAgent: sourceUserAgent,
+		tlsConf:   tlsConf,
 		proto:     proto,
+		autoProto: sourceProtocol == "auto",
 		firstTime: true,
 		readBuf1:  make([]byte, 0, 512*1024),
 		readBuf2:  make([]byte, 0, 512*1024),
@@ -90,6 +178,10 @@ func newStreamer(p *program, path string, source string, sourceProtocol string)
 		done:      make(chan struct{}),
 	}
 
+	if sourceTranscode != "" {
+		s.transcoder = newSourceTranscoder(s, sourceTranscode)
+	}
+
 	return s, nil
 }
 
@@ -102,19 +194,73 @@ func (s *streamer) publisherIsReady() bool {
 }
 
 func (s *streamer) publisherSdpText() []byte {
-	return s.serverSdpText
+	return s.publishedSdpText
 }
 
 func (s *streamer) publisherSdpParsed() *sdp.Message {
-	return s.serverSdpParsed
+	return s.publishedSdpParsed
+}
+
+// startPublishing makes the stream available to readers. When the source is
+// transcoded, this happens once the process has provided its SDP.
+func (s *streamer) startPublishing() {
+	s.published = true
+
+	if s.transcoder != nil {
+		s.transcoder.start(s.serverSdpText)
+		return
+	}
+
+	s.p.events <- programEventStreamerReady{s, s.serverSdpText, s.serverSdpParsed}
+}
+
+func (s *streamer) stopPublishing() {
+	if s.transcoder != nil {
+		s.transcoder.stop()
+		return
+	}
+
+	s.p.events <- programEventStreamerNotReady{s}
+}
+
+func (s *streamer) onFrame(trackId int, trackFlowType trackFlowType, buf []byte) {
+	if s.transcoder != nil {
+		s.transcoder.write(trackId, trackFlowType, buf)
+		return
+	}
+
+	s.p.events <- programEventStreamerFrame{s, trackId, trackFlowType, buf}
+}
+
+func (s *streamer) addHeaders(req *gortsplib.Request) {
+	if req.Header == nil {
+		req.Header = gortsplib.Header{}
+	}
+	req.Header["User-Agent"] = []string{s.userAgent}
+}
+
+func (s *streamer) writeRequest(conn *gortsplib.ConnClient, req *gortsplib.Request) (*gortsplib.Response, error) {
+	s.addHeaders(req)
+	return conn.WriteRequest(req)
+}
+
+func (s *streamer) writeRequestNoResponse(conn *gortsplib.ConnClient, req *gortsplib.Request) error {
+	s.addHeaders(req)
+	return conn.WriteRequestNoResponse(req)
 }
 
 func (s *streamer) run() {
 	for {
+		s.published = false
 		ok := s.do()
 		if !ok {
 			break
 		}
+
+		// the startup probe doesn't wait for sources that can't be reached
+		if !s.published {
+			s.p.events <- programEventStreamerFailed{s}
+		}
 	}
 
 	close(s.done)
@@ -138,7 +284,11 @@ func (s *streamer) do() bool {
 	var err error
 	dialDone := make(chan struct{})
 	go func() {
-		nconn, err = net.DialTimeout("tcp", s.ur.Host, _DIAL_TIMEOUT)
+		if s.tlsConf != nil {
+			nconn, err = tls.DialWithDialer(&net.Dialer{Timeout: _DIAL_TIMEOUT}, "tcp", s.ur.Host, s.tlsConf)
+		} else {
+			nconn, err = net.DialTimeout("tcp", s.ur.Host, _DIAL_TIMEOUT)
+		}
 		close(dialDone)
 	}()
 
@@ -155,32 +305,21 @@ func (s *streamer) do() bool {
 	defer nconn.Close()
 
 	conn, err := gortsplib.NewConnClient(gortsplib.ConnClientConf{
-		NConn: nconn,
-		Username: func() string {
-			if s.ur.User != nil {
-				return s.ur.User.Username()
-			}
-			return ""
-		}(),
-		Password: func() string {
-			if s.ur.User != nil {
-				pass, _ := s.ur.User.Password()
-				return pass
-			}
-			return ""
-		}(),
-		ReadTimeout:  s.p.conf.ReadTimeout,
-		WriteTimeout: s.p.conf.WriteTimeout,
+		NConn:        nconn,
+		Username:     s.user,
+		Password:     s.pass,
+		ReadTimeout:  s.p.conf.SourceReadTimeout,
+		WriteTimeout: s.p.conf.SourceWriteTimeout,
 	})
 	if err != nil {
 		s.log("ERR: %s", err)
 		return true
 	}
 
-	res, err := conn.WriteRequest(&gortsplib.Request{
+	res, err := s.writeRequest(conn, &gortsplib.Request{
 		Method: gortsplib.OPTIONS,
 		Url: &url.URL{
-			Scheme: "rtsp",
+			Scheme: s.ur.Scheme,
 			Host:   s.ur.Host,
 			Path:   "/",
 		},
@@ -196,10 +335,10 @@ func (s *streamer) do() bool {
 		return true
 	}
 
-	res, err = conn.WriteRequest(&gortsplib.Request{
+	res, err = s.writeRequest(conn, &gortsplib.Request{
 		Method: gortsplib.DESCRIBE,
 		Url: &url.URL{
-			Scheme:   "rtsp",
+			Scheme:   s.ur.Scheme,
 			Host:     s.ur.Host,
 			Path:     s.ur.Path,
 			RawQuery: s.ur.RawQuery,
@@ -226,7 +365,7 @@ func (s *streamer) do() bool {
 		return true
 	}
 
-	clientSdpParsed, err := gortsplib.SDPParse(res.Content)
+	clientSdpParsed, err := sdpParse(res.Content)
 	if err != nil {
 		s.log("ERR: invalid SDP: %s", err)
 		return true
@@ -288,7 +427,7 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 			}
 		}()
 
-		res, err := conn.WriteRequest(&gortsplib.Request{
+		res, err := s.writeRequest(conn, &gortsplib.Request{
 			Method: gortsplib.SETUP,
 			Url: func() *url.URL {
 				control := media.Attributes.Value("control")
@@ -299,7 +438,7 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 				}
 
 				// absolute path
-				if strings.HasPrefix(control, "rtsp://") {
+				if strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://") {
 					ur, err := url.Parse(control)
 					if err != nil {
 						return s.ur
@@ -309,7 +448,7 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 
 				// relative path
 				return &url.URL{
-					Scheme: "rtsp",
+					Scheme: s.ur.Scheme,
 					Host:   s.ur.Host,
 					Path: func() string {
 						ret := s.ur.Path
@@ -349,6 +488,10 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 			s.log("ERR: SETUP returned code %d (%s)", res.StatusCode, res.StatusMessage)
 			udplRtp.close()
 			udplRtcp.close()
+
+			if s.autoProto && res.StatusCode == gortsplib.StatusUnsupportedTransport {
+				s.switchToTcp()
+			}
 			return true
 		}
 
@@ -372,16 +515,21 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 		udplRtp.publisherPort = rtpServerPort
 		udplRtcp.publisherPort = rtcpServerPort
 
+		rtcpReceiver := newRtcpReceiver(mediaClockRate(&media))
+		udplRtp.rtcpReceiver = rtcpReceiver
+		udplRtcp.rtcpReceiver = rtcpReceiver
+
 		streamerUdpListenerPairs = append(streamerUdpListenerPairs, streamerUdpListenerPair{
-			udplRtp:  udplRtp,
-			udplRtcp: udplRtcp,
+			udplRtp:      udplRtp,
+			udplRtcp:     udplRtcp,
+			rtcpReceiver: rtcpReceiver,
 		})
 	}
 
-	res, err := conn.WriteRequest(&gortsplib.Request{
+	res, err := s.writeRequest(conn, &gortsplib.Request{
 		Method: gortsplib.PLAY,
 		Url: &url.URL{
-			Scheme:   "rtsp",
+			Scheme:   s.ur.Scheme,
 			Host:     s.ur.Host,
 			Path:     s.ur.Path,
 			RawQuery: s.ur.RawQuery,
@@ -397,33 +545,72 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 		return true
 	}
 
+	playTime := s.p.clock.Now()
+
 	for _, pair := range streamerUdpListenerPairs {
 		pair.udplRtp.start()
 		pair.udplRtcp.start()
 	}
 
+	// in auto mode, UDP is used only if packets are actually received,
+	// since they may be blocked by firewalls or NATs
+	if s.autoProto {
+		received, terminated := s.waitUdpFrame(streamerUdpListenerPairs, playTime)
+		if terminated {
+			return false
+		}
+
+		if !received {
+			s.log("ERR: no UDP packets received within %s", _UDP_FIRST_FRAME_TIMEOUT)
+
+			s.writeRequest(conn, &gortsplib.Request{
+				Method: gortsplib.TEARDOWN,
+				Url: &url.URL{
+					Scheme:   s.ur.Scheme,
+					Host:     s.ur.Host,
+					Path:     s.ur.Path,
+					RawQuery: s.ur.RawQuery,
+				},
+			})
+
+			s.switchToTcp()
+			return true
+		}
+
+		s.log("UDP packets received, using protocol %s", s.proto)
+	}
+
 	tickerSendKeepalive := time.NewTicker(_KEEPALIVE_INTERVAL)
 	defer tickerSendKeepalive.Stop()
 
 	tickerCheckStream := time.NewTicker(_CHECK_STREAM_INTERVAL)
 	defer tickerCheckStream.Stop()
 
-	s.p.events <- programEventStreamerReady{s}
+	// receiver reports keep alive the stream of cameras that require them
+	tickerReceiverReport := time.NewTicker(s.p.conf.SourceRtcpReportPeriod)
+	defer tickerReceiverReport.Stop()
 
-	defer func() {
-		s.p.events <- programEventStreamerNotReady{s}
-	}()
+	s.startPublishing()
+	defer s.stopPublishing()
 
 	for {
 		select {
 		case <-s.terminate:
 			return false
 
+		case <-tickerReceiverReport.C:
+			now := s.p.clock.Now()
+			for _, pair := range streamerUdpListenerPairs {
+				if rr := pair.rtcpReceiver.report(now); rr != nil {
+					pair.udplRtcp.write(rr)
+				}
+			}
+
 		case <-tickerSendKeepalive.C:
-			_, err = conn.WriteRequest(&gortsplib.Request{
+			_, err = s.writeRequest(conn, &gortsplib.Request{
 				Method: gortsplib.OPTIONS,
 				Url: &url.URL{
-					Scheme: "rtsp",
+					Scheme: s.ur.Scheme,
 					Host:   s.ur.Host,
 					Path:   "/",
 				},
@@ -448,7 +635,7 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 				}
 			}
 
-			if time.Since(lastFrameTime) >= _STREAM_DEAD_AFTER {
+			if s.p.clock.Now().Sub(lastFrameTime) >= _STREAM_DEAD_AFTER {
 				s.log("ERR: stream is dead")
 				return true
 			}
@@ -456,11 +643,47 @@ func (s *streamer) runUdp(conn *gortsplib.ConnClient) bool {
 	}
 }
 
+// waitUdpFrame waits until a frame is received by any of the listeners
+// after the given time.
+func (s *streamer) waitUdpFrame(pairs []streamerUdpListenerPair, since time.Time) (bool, bool) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.terminate:
+			return false, true
+
+		case <-ticker.C:
+			for _, pair := range pairs {
+				if pair.udplRtp.lastFrameTime.After(since) ||
+					pair.udplRtcp.lastFrameTime.After(since) {
+					return true, false
+				}
+			}
+
+			if s.p.clock.Now().Sub(since) >= _UDP_FIRST_FRAME_TIMEOUT {
+				return false, false
+			}
+		}
+	}
+}
+
+// switchToTcp makes the next connection attempt use TCP. In auto mode,
+// TCP is kept for all the next attempts.
+func (s *streamer) switchToTcp() {
+	s.log("switching to protocol %s", _STREAM_PROTOCOL_TCP)
+	s.proto = _STREAM_PROTOCOL_TCP
+
+	// retry immediately
+	s.firstTime = true
+}
+
 func (s *streamer) runTcp(conn *gortsplib.ConnClient) bool {
 	for i, media := range s.clientSdpParsed.Medias {
 		interleaved := fmt.Sprintf("interleaved=%d-%d", (i * 2), (i*2)+1)
 
-		res, err := conn.WriteRequest(&gortsplib.Request{
+		res, err := s.writeRequest(conn, &gortsplib.Request{
 			Method: gortsplib.SETUP,
 			Url: func() *url.URL {
 				control := media.Attributes.Value("control")
@@ -471,7 +694,7 @@ func (s *streamer) runTcp(conn *gortsplib.ConnClient) bool {
 				}
 
 				// absolute path
-				if strings.HasPrefix(control, "rtsp://") {
+				if strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://") {
 					ur, err := url.Parse(control)
 					if err != nil {
 						return s.ur
@@ -481,7 +704,7 @@ func (s *streamer) runTcp(conn *gortsplib.ConnClient) bool {
 
 				// relative path
 				return &url.URL{
-					Scheme: "rtsp",
+					Scheme: s.ur.Scheme,
 					Host:   s.ur.Host,
 					Path: func() string {
 						ret := s.ur.Path
@@ -535,10 +758,10 @@ func (s *streamer) runTcp(conn *gortsplib.ConnClient) bool {
 		}
 	}
 
-	err := conn.WriteRequestNoResponse(&gortsplib.Request{
+	err := s.writeRequestNoResponse(conn, &gortsplib.Request{
 		Method: gortsplib.PLAY,
 		Url: &url.URL{
-			Scheme:   "rtsp",
+			Scheme:   s.ur.Scheme,
 			Host:     s.ur.Host,
 			Path:     s.ur.Path,
 			RawQuery: s.ur.RawQuery,
@@ -581,11 +804,8 @@ outer:
 		}
 	}
 
-	s.p.events <- programEventStreamerReady{s}
-
-	defer func() {
-		s.p.events <- programEventStreamerNotReady{s}
-	}()
+	s.startPublishing()
+	defer s.stopPublishing()
 
 	chanConnError := make(chan struct{})
 	go func() {
@@ -608,7 +828,7 @@ outer:
 
 			trackId, trackFlowType := interleavedChannelToTrack(frame.Channel)
 
-			s.p.events <- programEventStreamerFrame{s, trackId, trackFlowType, frame.Content}
+			s.onFrame(trackId, trackFlowType, frame.Content)
 		}
 	}()
 
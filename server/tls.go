@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// parseTlsMinVersion converts the minimum TLS version of the configuration
+// into the crypto/tls constant. An empty version means the default of crypto/tls.
+func parseTlsMinVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s'", v)
+}
+
+// parseTlsCipherSuites converts the names of cipher suites into their IDs.
+// Names are the ones of crypto/tls, i.e. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// An empty list means the default suites of crypto/tls.
+func parseTlsCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ids := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		ids[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		ids[s.Name] = s.ID
+	}
+
+	var ret []uint16
+	for _, name := range names {
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS cipher suite '%s'", name)
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	_UDP_PACER_QUEUE_SIZE = 1024
+
+	// frames that are farther apart are not paced, since the stream
+	// has probably been interrupted
+	_UDP_PACER_MAX_INTERVAL = 1 * time.Second
+)
+
+type udpPacedWrite struct {
+	addr   *net.UDPAddr
+	buf    []byte
+	sendAt time.Time
+}
+
+// udpPacer spreads the RTP packets of a track over the interval between
+// frames, instead of sending them in a burst. Frames are detected through
+// changes of the RTP timestamp; the packets of a frame are spaced by the
+// interval between the two previous frames, divided by the packet count
+// of the previous frame, and are sent within one interval from arrival.
+type udpPacer struct {
+	udpl *serverUdpListener
+
+	frameTs        uint32
+	frameStart     time.Time
+	frameCount     int
+	interval       time.Duration
+	prevFrameCount int
+	sendAt         time.Time // send time of the current packet
+
+	queue chan udpPacedWrite
+}
+
+func newUdpPacer(udpl *serverUdpListener) *udpPacer {
+	pc := &udpPacer{
+		udpl:  udpl,
+		queue: make(chan udpPacedWrite, _UDP_PACER_QUEUE_SIZE),
+	}
+
+	go pc.run()
+	return pc
+}
+
+func (pc *udpPacer) run() {
+	for w := range pc.queue {
+		if d := w.sendAt.Sub(pc.udpl.p.clock.Now()); d > 0 {
+			time.Sleep(d)
+		}
+
+		pc.udpl.write(w.addr, w.buf)
+	}
+}
+
+// close stops the pacer. Packets that are already queued are still sent,
+// unless the listener is closed in the meanwhile.
+func (pc *udpPacer) close() {
+	close(pc.queue)
+}
+
+// schedule computes the send time of a RTP packet, that is used by the
+// next writes. It is called once for each packet, before sending it to readers.
+func (pc *udpPacer) schedule(now time.Time, buf []byte) {
+	if len(buf) < 8 {
+		pc.sendAt = now
+		return
+	}
+
+	ts := binary.BigEndian.Uint32(buf[4:8])
+	if pc.frameCount == 0 || ts != pc.frameTs {
+		if pc.frameCount > 0 {
+			pc.interval = now.Sub(pc.frameStart)
+			pc.prevFrameCount = pc.frameCount
+		}
+		pc.frameTs = ts
+		pc.frameStart = now
+		pc.frameCount = 0
+	}
+	pc.frameCount++
+
+	prev := pc.sendAt
+	pc.sendAt = now
+	if pc.prevFrameCount == 0 || pc.interval > _UDP_PACER_MAX_INTERVAL {
+		return
+	}
+
+	if next := prev.Add(pc.interval / time.Duration(pc.prevFrameCount)); next.After(now) {
+		pc.sendAt = next
+	}
+
+	// the latency never grows beyond one interval
+	if deadline := pc.frameStart.Add(pc.interval); pc.sendAt.After(deadline) {
+		pc.sendAt = deadline
+	}
+}
+
+// write enqueues a packet, that is sent at the scheduled time.
+// It never blocks: packets are dropped if the queue is full, and false is
+// returned.
+func (pc *udpPacer) write(addr *net.UDPAddr, buf []byte) bool {
+	select {
+	case pc.queue <- udpPacedWrite{addr, append([]byte(nil), buf...), pc.sendAt}:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,108 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// environment variable that contains the file descriptor of the pipe used by
+// the new instance to signal that it is ready, during an upgrade
+const _READY_FD_ENV = "RTSP_READY_FD"
+
+// time the new instance has to be ready, otherwise it is killed and the
+// upgrade is aborted
+const _UPGRADE_READY_TIMEOUT = 30 * time.Second
+
+// upgradeSignal returns a channel that receives the signal used to
+// request an upgrade.
+func upgradeSignal() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	return c
+}
+
+// startUpgradedProcess launches the executable with the same arguments,
+// passing it the RTSP listener, and returns its pid and a channel that
+// receives nil when the process is ready, or an error if it exits or
+// doesn't become ready in time.
+func startUpgradedProcess(listener *os.File) (int, <-chan error, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, nil, err
+	}
+	// the process keeps its own copy of the write end
+	defer w.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// extra files are numbered after stdin, stdout and stderr
+	cmd.ExtraFiles = []*os.File{listener, w}
+	cmd.Env = append(os.Environ(),
+		_LISTENER_FD_ENV+"="+strconv.Itoa(3),
+		_READY_FD_ENV+"="+strconv.Itoa(4))
+
+	err = cmd.Start()
+	if err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+
+	// release the process resources when it exits
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		defer r.Close()
+
+		// the read fails when the process exits, since the write end is closed
+		r.SetReadDeadline(time.Now().Add(_UPGRADE_READY_TIMEOUT))
+		_, err := r.Read(make([]byte, 1))
+		if err == nil {
+			ready <- nil
+			return
+		}
+
+		cmd.Process.Kill()
+		if os.IsTimeout(err) {
+			ready <- fmt.Errorf("new instance not ready after %v", _UPGRADE_READY_TIMEOUT)
+		} else {
+			ready <- fmt.Errorf("new instance exited before being ready")
+		}
+	}()
+
+	return cmd.Process.Pid, ready, nil
+}
+
+// notifyUpgradeReady signals to the previous instance, if this instance was
+// started by an upgrade, that the listeners are open.
+func notifyUpgradeReady() {
+	val := os.Getenv(_READY_FD_ENV)
+	if val == "" {
+		return
+	}
+	os.Unsetenv(_READY_FD_ENV)
+
+	fd, err := strconv.Atoi(val)
+	if err != nil {
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"fmt"
+	"os"
+)
+
+func upgradeSignal() <-chan os.Signal {
+	return nil
+}
+
+func startUpgradedProcess(listener *os.File) (int, <-chan error, error) {
+	return 0, nil, fmt.Errorf("not supported")
+}
+
+func notifyUpgradeReady() {
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/binary"
+)
+
+// videoDropper decides which H264 packets are dropped when the write queue
+// of a reader is congested. Packets of keyframes are always kept, while the
+// other ones are dropped until the next keyframe, since the following frames
+// depend on the dropped ones. Packets of the other tracks are never dropped
+// by the dropper, therefore audio and RTCP keep flowing.
+type videoDropper struct {
+	videoTrackId int
+	dropping     bool
+	inKeyframe   bool
+	keyframeTs   uint32
+}
+
+func newVideoDropper(videoTrackId int) *videoDropper {
+	return &videoDropper{
+		videoTrackId: videoTrackId,
+	}
+}
+
+// drop returns whether a RTP packet must be dropped.
+func (d *videoDropper) drop(trackId int, buf []byte, congested bool) bool {
+	if trackId != d.videoTrackId || len(buf) < 12 {
+		return false
+	}
+
+	ts := binary.BigEndian.Uint32(buf[4:8])
+
+	if rtpH264IsKeyframeStart(buf) {
+		d.dropping = false
+		d.inKeyframe = true
+		d.keyframeTs = ts
+		return false
+	}
+
+	// the other packets of the keyframe have the same timestamp
+	if d.inKeyframe && ts == d.keyframeTs {
+		return false
+	}
+	d.inKeyframe = false
+
+	if !d.dropping && congested {
+		d.dropping = true
+	}
+	return d.dropping
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	_WEBHOOK_TIMEOUT    = 5 * time.Second
+	_WEBHOOK_QUEUE_SIZE = 256
+)
+
+type webhookEvent struct {
+	Path   string            `json:"path"`
+	State  string            `json:"state"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// webhook notifies an external HTTP server when paths become ready or stop
+// being ready. Notifications are sent in order by a dedicated routine, in
+// order not to block the program.
+type webhook struct {
+	p      *program
+	url    string
+	client *http.Client
+	ctx    context.Context // canceled on close
+	cancel context.CancelFunc
+	queue  chan webhookEvent
+	done   chan struct{}
+}
+
+func newWebhook(p *program, url string) *webhook {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &webhook{
+		p:   p,
+		url: url,
+		client: &http.Client{
+			Timeout: _WEBHOOK_TIMEOUT,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  make(chan webhookEvent, _WEBHOOK_QUEUE_SIZE),
+		done:   make(chan struct{}),
+	}
+}
+
+func (w *webhook) log(format string, args ...interface{}) {
+	w.p.log("[webhook] "+format, args...)
+}
+
+func (w *webhook) run() {
+	for evt := range w.queue {
+		// notifications that are still queued on close are dropped
+		if w.ctx.Err() != nil {
+			continue
+		}
+
+		err := w.send(evt)
+		if err != nil && w.ctx.Err() == nil {
+			w.log("ERR: path '%s', state %s: %s", evt.Path, evt.State, err)
+		}
+	}
+
+	close(w.done)
+}
+
+// close cancels the notification that is being sent, in order not to
+// block the shutdown of the program.
+func (w *webhook) close() {
+	w.cancel()
+	close(w.queue)
+	<-w.done
+}
+
+// push enqueues a notification. It is called by the program and never
+// blocks: when the queue is full, the notification is dropped.
+func (w *webhook) push(path string, ready bool) {
+	evt := webhookEvent{
+		Path:  path,
+		State: "notReady",
+	}
+	if ready {
+		evt.State = "ready"
+	}
+	if pconf := w.p.findConfForPath(path); pconf != nil {
+		evt.Labels = pconf.Labels
+	}
+
+	select {
+	case w.queue <- evt:
+	default:
+		w.log("ERR: queue is full, notification of path '%s' dropped", path)
+	}
+}
+
+func (w *webhook) send(evt webhookEvent) error {
+	enc, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(enc))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("server replied with code %d", res.StatusCode)
+	}
+	return nil
+}